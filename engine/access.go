@@ -1,14 +1,140 @@
 package engine
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// The formats that can be used for the --accesslog file
+const (
+	accessLogCombined = "combined"
+	accessLogCommon   = "common"
+	accessLogJSON     = "json"
+)
+
+// validAccessLogFormat checks if the given access log format is supported
+func validAccessLogFormat(format string) bool {
+	switch format {
+	case accessLogCombined, accessLogCommon, accessLogJSON:
+		return true
+	}
+	return false
+}
+
+// requestInfo holds information about a request that the access log can not
+// get from the request itself, like when it started and which kind of
+// handler that served it
+type requestInfo struct {
+	start       time.Time
+	id          string
+	handlerType atomic.Value // string: "static", "lua", "proxy", "renderer" and so on
+	bytesIn     atomic.Int64
+}
+
+// requestInfoKey is the context key for a *requestInfo
+type requestInfoKey struct{}
+
+// countingBody counts the bytes that are read from a request body
+type countingBody struct {
+	io.ReadCloser
+	info *requestInfo
+}
+
+func (cb *countingBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	cb.info.bytesIn.Add(int64(n))
+	return n, err
+}
+
+// newRequestID returns the X-Request-ID header from the client, if it looks
+// like an ID, or a new random ID
+func newRequestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-ID"); id != "" && len(id) <= 128 {
+		valid := true
+		for _, r := range id {
+			if r <= ' ' || r > '~' {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return id
+		}
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestInfoMiddleware attaches a requestInfo to every request, for the
+// JSON access log. It should be the outermost middleware, so that the
+// duration covers as much as possible of handling the request.
+func requestInfoMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info := &requestInfo{start: time.Now(), id: newRequestID(req)}
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = &countingBody{req.Body, info}
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info)))
+	})
+}
+
+// getRequestInfo returns the requestInfo for the request, or nil
+func getRequestInfo(req *http.Request) *requestInfo {
+	info, _ := req.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// setHandlerType records which kind of handler that is serving the request,
+// like "static", "lua", "proxy" or "renderer", for the JSON access log
+func setHandlerType(req *http.Request, handlerType string) {
+	if info := getRequestInfo(req); info != nil {
+		info.handlerType.Store(handlerType)
+	}
+}
+
+// logProtocol returns "HTTP/1.1", "h2" or "h3", for the JSON access log
+func logProtocol(req *http.Request) string {
+	switch req.ProtoMajor {
+	case 2:
+		return "h2"
+	case 3:
+		return "h3"
+	}
+	return req.Proto
+}
+
+// jsonLogEntry is one line in the JSON access log
+type jsonLogEntry struct {
+	Time       string  `json:"time"`
+	RemoteAddr string  `json:"remote_addr"`
+	User       string  `json:"user,omitempty"`
+	Method     string  `json:"method"`
+	Host       string  `json:"host"`
+	URI        string  `json:"uri"`
+	Protocol   string  `json:"protocol"`
+	TLS        string  `json:"tls,omitempty"`
+	Status     int     `json:"status"`
+	BytesIn    int64   `json:"bytes_in"`
+	BytesOut   int64   `json:"bytes_out"`
+	DurationMS float64 `json:"duration_ms"`
+	Handler    string  `json:"handler,omitempty"`
+	RequestID  string  `json:"request_id,omitempty"`
+	Referer    string  `json:"referer,omitempty"`
+	UserAgent  string  `json:"user_agent,omitempty"`
+}
+
 // CommonLogFormat returns a line with the data that is available at the start
 // of a request handler. The log line is in NCSA format, the same log format
 // used by Apache. Fields where data is not available are indicated by a "-".
@@ -61,6 +187,49 @@ func (ac *Config) CombinedLogFormat(req *http.Request, statusCode int, byteSize
 	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %s %s \"%s\" \"%s\"", host, username, timestamp, req.Method, req.RequestURI, req.Proto, statusCodeString, byteSizeString, referer, userAgent)
 }
 
+// JSONLogFormat returns a line with a JSON object that describes the request
+// and the response. The duration, handler type, request ID and the number of
+// bytes that were read from the request body are only available for requests
+// that have passed through requestInfoMiddleware.
+func (ac *Config) JSONLogFormat(req *http.Request, statusCode int, byteSize int64) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	now := time.Now()
+	entry := jsonLogEntry{
+		Time:       now.Format(time.RFC3339Nano),
+		RemoteAddr: host,
+		Method:     req.Method,
+		Host:       req.Host,
+		URI:        req.RequestURI,
+		Protocol:   logProtocol(req),
+		Status:     statusCode,
+		BytesOut:   byteSize,
+		Referer:    req.Header.Get("Referer"),
+		UserAgent:  req.Header.Get("User-Agent"),
+	}
+	if ac.perm != nil {
+		entry.User = ac.perm.UserState().Username(req)
+	}
+	if req.TLS != nil {
+		entry.TLS = tls.VersionName(req.TLS.Version)
+	}
+	if info := getRequestInfo(req); info != nil {
+		entry.DurationMS = float64(now.Sub(info.start).Microseconds()) / 1000
+		entry.RequestID = info.id
+		entry.BytesIn = info.bytesIn.Load()
+		entry.Handler, _ = info.handlerType.Load().(string)
+	} else if req.ContentLength > 0 {
+		entry.BytesIn = req.ContentLength
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
 // LogAccess creates one entry in the access log, given a http.Request,
 // a HTTP status code and the amount of bytes that have been transferred.
 // The line is formatted while the request is still valid, then written.
@@ -69,6 +238,25 @@ func (ac *Config) LogAccess(req *http.Request, statusCode int, byteSize int64) {
 		ac.commonAccessLog.WriteLine(ac.CommonLogFormat(req, statusCode, byteSize))
 	}
 	if ac.combinedAccessLog != nil {
-		ac.combinedAccessLog.WriteLine(ac.CombinedLogFormat(req, statusCode, byteSize))
+		// The format of the --accesslog file can be changed with --accesslog-format
+		switch ac.accessLogFormat {
+		case accessLogJSON:
+			ac.combinedAccessLog.WriteLine(ac.JSONLogFormat(req, statusCode, byteSize))
+		case accessLogCommon:
+			ac.combinedAccessLog.WriteLine(ac.CommonLogFormat(req, statusCode, byteSize))
+		default:
+			ac.combinedAccessLog.WriteLine(ac.CombinedLogFormat(req, statusCode, byteSize))
+		}
+	}
+}
+
+// withAccessLog wraps a handler function, so that the status code and the
+// number of bytes that the client actually received are logged. It wraps
+// the whole middleware chain, in withMiddleware.
+func (ac *Config) withAccessLog(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		sr := newStatusRecorder(w)
+		handlerFunc(sr, req)
+		ac.LogAccess(req, sr.Status(), sr.written)
 	}
 }
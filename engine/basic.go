@@ -310,6 +310,22 @@ func (ac *Config) LoadBasicWeb(w http.ResponseWriter, req *http.Request, L *lua.
 		return 1 // number of results
 	}))
 
+	// Return the value of a wildcard in the handle() pattern, like "id" for "/users/{id}"
+	L.SetGlobal("param", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(req.PathValue(L.ToString(1))))
+		return 1 // number of results
+	}))
+
+	// Return all wildcards in the handle() pattern, as a table
+	L.SetGlobal("params", L.NewFunction(func(L *lua.LState) int {
+		m := make(map[string]string)
+		for _, name := range patternWildcards(req.Pattern) {
+			m[name] = req.PathValue(name)
+		}
+		L.Push(convert.Map2table(L, m))
+		return 1 // number of results
+	}))
+
 	// Return the current HTTP method (GET, POST etc)
 	L.SetGlobal("method", L.NewFunction(func(L *lua.LState) int {
 		L.Push(lua.LString(req.Method))
@@ -2,16 +2,41 @@ package engine
 
 import (
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/xyproto/datablock"
 	lua "github.com/xyproto/gopher-lua"
 	"github.com/xyproto/ollamaclient/v2"
 )
 
-// DataToClient is a helper function for sending file data (that might be cached) to a HTTP client
+// fileCache reads files, possibly from a cache. It is implemented by
+// datablock.FileCache, which keeps the files in memory, and by
+// databaseFileCache, which keeps them in the database backend.
+type fileCache interface {
+	Read(filename string, cached bool) (*datablock.DataBlock, error)
+	Clear()
+	Stats() string
+	BytesUsed() uint64
+}
+
+// DataToClient is a helper function for sending file data (that might be cached) to a HTTP client.
+// The data is minified first, if minification is enabled for the type of output.
 func (ac *Config) DataToClient(w http.ResponseWriter, req *http.Request, filename string, data []byte) {
-	datablock.NewDataBlock(data, true).ToClient(w, req, filename, ac.ClientCanGzip(req), gzipThreshold)
+	data = ac.minified(data, w.Header().Get(contentType), filename)
+	ac.DataBlockToClient(w, req, filename, datablock.NewDataBlock(data, true))
+}
+
+// bundleToClient sends a bundle from bundleFile to a HTTP client, with the
+// contentSum that was found when the bundle entered the cache, if any, and
+// the modification time of the source file as Last-Modified
+func (ac *Config) bundleToClient(w http.ResponseWriter, req *http.Request, filename string, data []byte, sum string) {
+	var modTime time.Time
+	if info, err := os.Stat(filename); err == nil {
+		modTime = info.ModTime()
+	}
+	ac.serveDataBlock(w, req, filename, modTime, sum, datablock.NewDataBlock(data, true))
 }
 
 // LoadCacheFunctions loads functions related to caching into the given Lua state
@@ -24,7 +49,10 @@ func (ac *Config) LoadCacheFunctions(L *lua.LState) {
 			L.Push(lua.LString(disabledMessage))
 			return 1 // number of results
 		}
-		info := ac.cache.Stats()
+		info := strings.TrimRight(ac.cache.Stats(), "\n") + "\n" + ac.cacheRuleStats()
+		if ac.diskCache != nil {
+			info = strings.TrimRight(info, "\n") + "\n" + ac.diskCache.Stats()
+		}
 		L.Push(lua.LString(strings.TrimRight(info, "\n")))
 		return 1 // number of results
 	})
@@ -61,13 +89,29 @@ func (ac *Config) LoadCacheFunctions(L *lua.LState) {
 	}))
 }
 
-// ClearCache tries to clear the Ollama client cache and the disk cache
+// ClearCache tries to clear the Ollama client cache, the file cache, the
+// chunks of large files, the reverse proxy cache, the compressed variants,
+// the rendered pages and the hashes of the files
 func (ac *Config) ClearCache() {
 	ollamaclient.ClearCache()
+	if ac.reverseProxyConfig != nil {
+		ac.reverseProxyConfig.ClearCache()
+	}
 	if ac.bundleCache != nil {
 		ac.bundleCache.Clear()
 	}
 	if ac.cache != nil {
 		ac.cache.Clear()
 	}
+	if ac.diskCache != nil {
+		ac.diskCache.Clear()
+	}
+	if sc, ok := ac.fs.(*statCache); ok {
+		sc.Clear()
+	}
+	if c := ac.compressedVariants(); c != nil {
+		c.Clear()
+	}
+	ac.fileSums.Clear()
+	ac.renderedPages.Clear()
 }
@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// cacheControlRule is a Cache-Control value for the responses for a file
+// extension, like ".css", or a path prefix, like "/static/"
+type cacheControlRule struct {
+	match string
+	value string
+}
+
+// newCacheControlRule checks that the match is an extension or a path
+// prefix, and that the value can be placed in a header
+func newCacheControlRule(match, value string) (*cacheControlRule, error) {
+	if !strings.HasPrefix(match, ".") && !strings.HasPrefix(match, "/") {
+		return nil, errors.New("not an extension or a path prefix: " + match)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return nil, errors.New("invalid Cache-Control value: " + value)
+	}
+	return &cacheControlRule{match: strings.ToLower(match), value: value}, nil
+}
+
+// cacheControlFor returns the Cache-Control value for the given path, if
+// any. The longest path prefix is used, and then the extension.
+func (ac *Config) cacheControlFor(urlPath string) (string, bool) {
+	var found *cacheControlRule
+	for _, rule := range ac.cacheControls {
+		if strings.HasPrefix(rule.match, "/") && strings.HasPrefix(urlPath, rule.match) && (found == nil || len(rule.match) > len(found.match)) {
+			found = rule
+		}
+	}
+	if found != nil {
+		return found.value, true
+	}
+	ext := strings.ToLower(path.Ext(urlPath))
+	for _, rule := range ac.cacheControls {
+		if rule.match == ext {
+			return rule.value, true
+		}
+	}
+	return "", false
+}
+
+// cacheControlWriter sets the Cache-Control header for successful responses,
+// unless the handler has set it
+type cacheControlWriter struct {
+	http.ResponseWriter
+	value         string
+	headerWritten bool
+}
+
+func (cw *cacheControlWriter) WriteHeader(status int) {
+	if !cw.headerWritten && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		cw.headerWritten = true
+		if (status < 300 || status == http.StatusNotModified) && cw.Header().Get("Cache-Control") == "" {
+			cw.Header().Set("Cache-Control", cw.value)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *cacheControlWriter) Write(p []byte) (int, error) {
+	if !cw.headerWritten {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush sends any buffered data to the client
+func (cw *cacheControlWriter) Flush() {
+	if !cw.headerWritten {
+		cw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Hijack passes WebSocket upgrades through
+func (cw *cacheControlWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(cw.ResponseWriter).Hijack()
+}
+
+func (cw *cacheControlWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
+
+// cacheControlMiddleware sets the Cache-Control header from SetCacheControl
+func (ac *Config) cacheControlMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		value, ok := ac.cacheControlFor(req.URL.Path)
+		if !ok {
+			next.ServeHTTP(w, req)
+			return
+		}
+		next.ServeHTTP(&cacheControlWriter{ResponseWriter: w, value: value}, req)
+	})
+}
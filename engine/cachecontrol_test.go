@@ -0,0 +1,54 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCacheControl(t *testing.T) {
+	ac := &Config{}
+	for _, rule := range [][2]string{
+		{".css", "max-age=3600"},
+		{"/static/", "public, max-age=31536000, immutable"},
+		{"/static/live/", "no-cache"},
+	} {
+		r, err := newCacheControlRule(rule[0], rule[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ac.cacheControls = append(ac.cacheControls, r)
+	}
+	if _, err := newCacheControlRule("css", "no-store"); err == nil {
+		t.Error("expected an error for a rule that is neither an extension nor a prefix")
+	}
+
+	handler := ac.cacheControlMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/missing.css":
+			http.NotFound(w, req)
+		case "/own.css":
+			w.Header().Set("Cache-Control", "private")
+			w.Write([]byte("own"))
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	for _, test := range []struct {
+		path string
+		want string
+	}{
+		{"/style.css", "max-age=3600"},
+		{"/static/app.js", "public, max-age=31536000, immutable"},
+		{"/static/live/feed.css", "no-cache"},
+		{"/index.html", ""},
+		{"/missing.css", ""},
+		{"/own.css", "private"},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if got := rec.Header().Get("Cache-Control"); got != test.want {
+			t.Errorf("%s: got Cache-Control %q, want %q", test.path, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xyproto/algernon/cachemode"
+	"github.com/xyproto/datablock"
+)
+
+// sourceExtensions are the extensions of the files that Algernon renders or
+// runs, which are never binary files, even if the MIME type says otherwise,
+// like video/mp2t for .ts
+var sourceExtensions = []string{".amber", ".gcss", ".happ", ".js", ".jsx", ".lua", ".md", ".po2", ".pongo2", ".scss", ".ts", ".tsx", ".tl", ".tpl"}
+
+// cacheRule says if files that match a glob, an extension or are binary
+// files should be cached, and for how long, from SetCacheRules
+type cacheRule struct {
+	glob          *regexp.Regexp // for the path of the file in the served directory, like "/static/**"
+	globString    string
+	ext           string        // like ".lua"
+	binary        bool          // only binary files, like images, fonts and archives
+	cache         bool          // if the files should be cached
+	ttl           time.Duration // how long the files are kept, 0 for the default
+	maxEntitySize uint64        // the max size of a file that is cached, 0 for the default
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+}
+
+// globToRegexp converts a glob, where "**" matches any number of
+// directories, "*" matches anything but "/" and "?" matches one character
+// that is not "/", to a regular expression
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "/**/"):
+			sb.WriteString("/(.*/)?")
+			i += 3
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			sb.WriteString("[^/]*")
+		case glob[i] == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// newCacheRule creates a rule. The glob must start with "/" and the
+// extension with ".", if they are given. A rule without a glob, an
+// extension or binary matches all files.
+func newCacheRule(glob, ext string, binary, cache bool, ttl time.Duration, maxEntitySize uint64) (*cacheRule, error) {
+	rule := &cacheRule{
+		globString:    glob,
+		ext:           strings.ToLower(ext),
+		binary:        binary,
+		cache:         cache,
+		ttl:           ttl,
+		maxEntitySize: maxEntitySize,
+	}
+	if glob != "" {
+		if !strings.HasPrefix(glob, "/") {
+			return nil, errors.New("the glob must start with /: " + glob)
+		}
+		var err error
+		if rule.glob, err = globToRegexp(glob); err != nil {
+			return nil, err
+		}
+	}
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		return nil, errors.New("the extension must start with a dot: " + ext)
+	}
+	if ttl < 0 {
+		return nil, errors.New("negative ttl")
+	}
+	return rule, nil
+}
+
+// String describes the rule, for CacheInfo
+func (rule *cacheRule) String() string {
+	var fields []string
+	if rule.globString != "" {
+		fields = append(fields, "glob="+rule.globString)
+	}
+	if rule.ext != "" {
+		fields = append(fields, "ext="+rule.ext)
+	}
+	if rule.binary {
+		fields = append(fields, "binary=true")
+	}
+	if len(fields) == 0 {
+		fields = append(fields, "all files")
+	}
+	fields = append(fields, fmt.Sprintf("cache=%v", rule.cache))
+	if rule.ttl > 0 {
+		fields = append(fields, "ttl="+rule.ttl.String())
+	}
+	if rule.maxEntitySize > 0 {
+		fields = append(fields, fmt.Sprintf("maxsize=%d", rule.maxEntitySize))
+	}
+	return strings.Join(fields, " ")
+}
+
+// isBinaryExtension checks if files with the given extension are binary
+// files, by the MIME type
+func isBinaryExtension(ext string) bool {
+	for _, sourceExt := range sourceExtensions {
+		if ext == sourceExt {
+			return false
+		}
+	}
+	contentTypeValue := mime.TypeByExtension(ext)
+	if contentTypeValue == "" || strings.HasPrefix(contentTypeValue, "text/") {
+		return false
+	}
+	// JavaScript, JSON, SVG and XML
+	return minifyType(contentTypeValue, "") == ""
+}
+
+// matches checks if the rule matches a file with the given path in the
+// served directory and extension
+func (rule *cacheRule) matches(urlPath, ext string) bool {
+	if rule.glob != nil && !rule.glob.MatchString(urlPath) {
+		return false
+	}
+	if rule.ext != "" && rule.ext != ext {
+		return false
+	}
+	return !rule.binary || isBinaryExtension(ext)
+}
+
+// cacheRuleFor returns the first rule from SetCacheRules that matches the
+// file, or nil. The globs are for the path of the file in the served
+// directory.
+func (ac *Config) cacheRuleFor(filename, ext string) *cacheRule {
+	if len(ac.cacheRules) == 0 {
+		return nil
+	}
+	urlPath := filepath.ToSlash(filename)
+	if rel, err := filepath.Rel(ac.serverDirOrFilename, filename); err == nil && !strings.HasPrefix(rel, "..") {
+		urlPath = "/" + filepath.ToSlash(rel)
+	}
+	ext = strings.ToLower(ext)
+	for _, rule := range ac.cacheRules {
+		if rule.matches(urlPath, ext) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// readFile reads a file through the file cache, if the first rule from
+// SetCacheRules that matches the file says so. If no rule matches, the
+// cache mode decides, by the extension.
+func (ac *Config) readFile(filename, ext string) (*datablock.DataBlock, error) {
+	rule := ac.cacheRuleFor(filename, ext)
+	if rule == nil {
+		return ac.cache.Read(filename, ac.shouldCache(ext))
+	}
+	if !rule.cache || ac.cacheMode == cachemode.Off {
+		rule.misses.Add(1)
+		return ac.cache.Read(filename, false)
+	}
+	rc, ok := ac.cache.(ruleFileCache)
+	if !ok {
+		return ac.cache.Read(filename, true)
+	}
+	block, hit, err := rc.read(filename, rule.ttl, rule.maxEntitySize)
+	if err != nil {
+		return nil, err
+	}
+	if hit {
+		rule.hits.Add(1)
+	} else {
+		rule.misses.Add(1)
+	}
+	return block, nil
+}
+
+// cacheRuleStats returns the hits and misses for each rule from
+// SetCacheRules, for CacheInfo
+func (ac *Config) cacheRuleStats() string {
+	if len(ac.cacheRules) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("Cache rules:\n")
+	for _, rule := range ac.cacheRules {
+		sb.WriteString(fmt.Sprintf("\t%s\thits=%d\tmisses=%d\n", rule, rule.hits.Load(), rule.misses.Load()))
+	}
+	return sb.String()
+}
@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xyproto/algernon/cachemode"
+	lua "github.com/xyproto/gopher-lua"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob, path string
+		want       bool
+	}{
+		{"/static/**", "/static/app.js", true},
+		{"/static/**", "/static/js/app.js", true},
+		{"/static/**", "/index.html", false},
+		{"/*.html", "/index.html", true},
+		{"/*.html", "/docs/index.html", false},
+		{"/**/*.png", "/logo.png", true},
+		{"/**/*.png", "/img/icons/logo.png", true},
+		{"/img/?.png", "/img/a.png", true},
+		{"/img/?.png", "/img/ab.png", false},
+		{"/a+b/*", "/a+b/c", true},
+	}
+	for _, test := range tests {
+		re, err := globToRegexp(test.glob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := re.MatchString(test.path); got != test.want {
+			t.Errorf("%s with %s: got %v, want %v", test.glob, test.path, got, test.want)
+		}
+	}
+}
+
+func TestLuaCacheRule(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoString(`rules = { {glob="/static/**", cache=true, ttl="1h", maxsize=1024}, {ext=".lua", cache=false}, {ttl=30}, {unknown=true} }`); err != nil {
+		t.Fatal(err)
+	}
+	table := L.GetGlobal("rules").(*lua.LTable)
+	rule, err := luaCacheRule(table.RawGetInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.globString != "/static/**" || !rule.cache || rule.ttl != time.Hour || rule.maxEntitySize != 1024 {
+		t.Errorf("got %s", rule)
+	}
+	if rule, err := luaCacheRule(table.RawGetInt(2)); err != nil || rule.ext != ".lua" || rule.cache {
+		t.Errorf("got %v, %v", rule, err)
+	}
+	if rule, err := luaCacheRule(table.RawGetInt(3)); err != nil || rule.ttl != 30*time.Second || !rule.cache {
+		t.Errorf("got %v, %v", rule, err)
+	}
+	if _, err := luaCacheRule(table.RawGetInt(4)); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+	if _, err := newCacheRule("static/**", "", false, true, 0, 0); err == nil {
+		t.Error("expected an error for a glob that does not start with /")
+	}
+}
+
+func TestCacheRules(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		filename := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(filename), 0o755)
+		if err := os.WriteFile(filename, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	appJS := write("static/app.js", "console.log('hi')")
+	indexLua := write("index.lua", "print('hi')")
+	logoPNG := write("logo.png", "not really a png")
+	bigPNG := write("big.png", strings.Repeat("x", 2048))
+	readme := write("readme.txt", "hello")
+
+	ac := &Config{
+		cache:               newMemoryFileCache(1<<20, false, 0, true, 0),
+		cacheMode:           cachemode.On,
+		serverDirOrFilename: dir,
+	}
+	for _, rule := range []struct {
+		glob, ext     string
+		binary, cache bool
+		ttl           time.Duration
+		maxEntitySize uint64
+	}{
+		{glob: "/static/**", cache: true, ttl: 50 * time.Millisecond},
+		{ext: ".lua", cache: false},
+		{binary: true, cache: true, maxEntitySize: 1024},
+		{cache: false},
+	} {
+		r, err := newCacheRule(rule.glob, rule.ext, rule.binary, rule.cache, rule.ttl, rule.maxEntitySize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ac.cacheRules = append(ac.cacheRules, r)
+	}
+
+	for range 2 {
+		for _, filename := range []string{appJS, indexLua, logoPNG, bigPNG, readme} {
+			if _, err := ac.readFile(filename, filepath.Ext(filename)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i, want := range []struct{ hits, misses uint64 }{
+		{1, 1}, // app.js is read from the cache the second time
+		{0, 2}, // .lua files are not cached
+		{1, 3}, // logo.png is cached, but big.png is too large
+		{0, 2}, // readme.txt is not a binary file
+	} {
+		rule := ac.cacheRules[i]
+		if rule.hits.Load() != want.hits || rule.misses.Load() != want.misses {
+			t.Errorf("%s: got %d hits and %d misses, want %d and %d", rule, rule.hits.Load(), rule.misses.Load(), want.hits, want.misses)
+		}
+	}
+
+	// The files under /static/ expire
+	time.Sleep(60 * time.Millisecond)
+	ac.readFile(appJS, ".js")
+	if misses := ac.cacheRules[0].misses.Load(); misses != 2 {
+		t.Errorf("expected app.js to have expired, got %d misses", misses)
+	}
+
+	if stats := ac.cacheRuleStats(); !strings.Contains(stats, "glob=/static/** cache=true ttl=50ms\thits=1\tmisses=2") {
+		t.Errorf("got the stats %q", stats)
+	}
+}
@@ -0,0 +1,399 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xyproto/datablock"
+	"github.com/xyproto/pinterface/v2"
+	"github.com/xyproto/simpleredis/v2"
+)
+
+// Where the cache can be kept, with --cache
+const (
+	CacheStoreMemory   = "memory"   // in memory, for each instance, the default
+	CacheStoreDatabase = "database" // in the database backend, shared by all instances that use it
+)
+
+// cacheStoreBackends are the names of the database backends that can be
+// given with --cache, like --cache=redis, and the start of the names of the
+// backends in lowercase
+var cacheStoreBackends = map[string]string{
+	"redis":    "redis",
+	"bolt":     "bolt",
+	"sqlite":   "sqlite",
+	"mariadb":  "mariadb",
+	"mysql":    "mariadb",
+	"postgres": "postgresql",
+}
+
+// isCacheStoreName checks if the --cache flag is for where the cache is
+// kept, and not for what is cached
+func isCacheStoreName(name string) bool {
+	_, isBackend := cacheStoreBackends[name]
+	return isBackend || name == CacheStoreMemory || name == CacheStoreDatabase
+}
+
+// cacheKeyPrefix is the prefix for the cache entries in Redis
+const cacheKeyPrefix = "algernon:cache:"
+
+// cacheHashMap is the name of the hash map with the cache entries, for the
+// other database backends
+const cacheHashMap = "algernon_cache"
+
+// cacheCleanupInterval is how often expired cache entries are removed from
+// the hash map
+const cacheCleanupInterval = time.Minute
+
+// cacheStore keeps data by key in the database backend, for a given time.
+// Each entry has metadata, like the modification time of the file that the
+// data is for, that is kept apart from the data, so that it can be checked
+// without reading the data. The data is stored together with a copy of the
+// metadata as well, so that get always returns metadata and data that
+// belong together, also while the entry is being replaced.
+type cacheStore interface {
+	meta(key string) (string, bool)
+	get(key string) (meta string, data []byte, ok bool)
+	set(key, meta string, data []byte, ttl time.Duration)
+	clear() error
+	count() (int, error)
+}
+
+// withMeta puts the metadata in front of the data, for storing them together
+func withMeta(meta string, data []byte) []byte {
+	return append([]byte(meta+"\n"), data...)
+}
+
+// splitMeta splits what was stored by withMeta into metadata and data
+func splitMeta(value []byte) (string, []byte, bool) {
+	meta, data, found := bytes.Cut(value, []byte("\n"))
+	return string(meta), data, found
+}
+
+// redisCacheStore keeps the cache entries as Redis hashes, with the fields
+// "meta" and "data", that expire
+type redisCacheStore struct {
+	pool    *simpleredis.ConnectionPool
+	dbindex int
+}
+
+func (s *redisCacheStore) meta(key string) (string, bool) {
+	conn := s.pool.Get(s.dbindex)
+	defer conn.Close()
+	reply, err := conn.Do("HGET", cacheKeyPrefix+key, "meta")
+	meta, ok := reply.([]byte)
+	if err != nil || !ok {
+		return "", false
+	}
+	return string(meta), true
+}
+
+func (s *redisCacheStore) get(key string) (string, []byte, bool) {
+	conn := s.pool.Get(s.dbindex)
+	defer conn.Close()
+	reply, err := conn.Do("HGET", cacheKeyPrefix+key, "data")
+	value, ok := reply.([]byte)
+	if err != nil || !ok {
+		return "", nil, false
+	}
+	return splitMeta(value)
+}
+
+func (s *redisCacheStore) set(key, meta string, data []byte, ttl time.Duration) {
+	conn := s.pool.Get(s.dbindex)
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("HSET", cacheKeyPrefix+key, "meta", meta, "data", withMeta(meta, data))
+	if ttl > 0 {
+		conn.Send("PEXPIRE", cacheKeyPrefix+key, ttl.Milliseconds())
+	} else {
+		conn.Send("PERSIST", cacheKeyPrefix+key)
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		logrus.Error("cache: could not use Redis: ", err)
+	}
+}
+
+// scan calls f with each batch of cache keys
+func (s *redisCacheStore) scan(f func(keys []any) error) error {
+	conn := s.pool.Get(s.dbindex)
+	defer conn.Close()
+	cursor := "0"
+	for {
+		reply, err := conn.Do("SCAN", cursor, "MATCH", cacheKeyPrefix+"*", "COUNT", 1000)
+		if err != nil {
+			return err
+		}
+		values, ok := reply.([]any)
+		if !ok || len(values) != 2 {
+			return errors.New("unexpected reply to SCAN from Redis")
+		}
+		next, _ := values[0].([]byte)
+		keys, _ := values[1].([]any)
+		if len(keys) > 0 {
+			if err := f(keys); err != nil {
+				return err
+			}
+		}
+		if cursor = string(next); cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+func (s *redisCacheStore) clear() error {
+	return s.scan(func(keys []any) error {
+		conn := s.pool.Get(s.dbindex)
+		defer conn.Close()
+		_, err := conn.Do("DEL", keys...)
+		return err
+	})
+}
+
+func (s *redisCacheStore) count() (int, error) {
+	n := 0
+	err := s.scan(func(keys []any) error {
+		n += len(keys)
+		return nil
+	})
+	return n, err
+}
+
+// databaseCacheStore keeps the cache entries in a hash map in the database
+// backend, like Bolt, with the fields "meta", "data" and "expires". The data
+// is base64 encoded, since not all backends can store binary data, and
+// expired entries are removed now and then, by one goroutine at a time.
+type databaseCacheStore struct {
+	entries     pinterface.IHashMap
+	lastCleanup atomic.Int64 // in nanoseconds since the epoch
+	cleaning    sync.Mutex
+}
+
+// elementID returns the ID of the hash map element for the given key, since
+// the keys can contain characters that the backends do not allow in IDs
+func elementID(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// expired checks if the entry with the given element ID has expired
+func (s *databaseCacheStore) expired(id string, now time.Time) bool {
+	value, err := s.entries.Get(id, "expires")
+	if err != nil {
+		return true
+	}
+	nanoseconds, err := strconv.ParseInt(value, 10, 64)
+	return err != nil || (nanoseconds != 0 && now.UnixNano() > nanoseconds)
+}
+
+// cleanup removes the entries that have expired, if it has not been done
+// for a while, and no other goroutine is already doing it
+func (s *databaseCacheStore) cleanup(now time.Time) {
+	if now.UnixNano()-s.lastCleanup.Load() < int64(cacheCleanupInterval) || !s.cleaning.TryLock() {
+		return
+	}
+	defer s.cleaning.Unlock()
+	s.lastCleanup.Store(now.UnixNano())
+	ids, err := s.entries.All()
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		if s.expired(id, now) {
+			s.entries.Del(id)
+		}
+	}
+}
+
+func (s *databaseCacheStore) meta(key string) (string, bool) {
+	now := time.Now()
+	s.cleanup(now)
+	id := elementID(key)
+	if s.expired(id, now) {
+		return "", false
+	}
+	meta, err := s.entries.Get(id, "meta")
+	return meta, err == nil
+}
+
+func (s *databaseCacheStore) get(key string) (string, []byte, bool) {
+	now := time.Now()
+	s.cleanup(now)
+	id := elementID(key)
+	if s.expired(id, now) {
+		return "", nil, false
+	}
+	value, err := s.entries.Get(id, "data")
+	if err != nil {
+		return "", nil, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", nil, false
+	}
+	return splitMeta(decoded)
+}
+
+func (s *databaseCacheStore) set(key, meta string, data []byte, ttl time.Duration) {
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UnixNano()
+	}
+	id := elementID(key)
+	// Mark the entry as expired while it is stored, and store the expiry
+	// time last, so that the entry is not used before all of it is stored
+	s.entries.Set(id, "expires", "1")
+	if err := s.entries.Set(id, "data", base64.StdEncoding.EncodeToString(withMeta(meta, data))); err != nil {
+		logrus.Error("cache: could not store the data: ", err)
+		return
+	}
+	s.entries.Set(id, "meta", meta)
+	s.entries.Set(id, "expires", strconv.FormatInt(expires, 10))
+}
+
+func (s *databaseCacheStore) clear() error {
+	return s.entries.Clear()
+}
+
+func (s *databaseCacheStore) count() (int, error) {
+	ids, err := s.entries.All()
+	return len(ids), err
+}
+
+// newDatabaseCacheStore creates a store for the cache in the given database
+// backend. name is the name that was given with --cache, which must match
+// the name of the backend in use, dbName, unless it is "database". Redis gets
+// a store of its own, where the entries expire by themselves.
+func newDatabaseCacheStore(perm pinterface.IPermissions, name, dbName string) (cacheStore, error) {
+	if perm == nil {
+		return nil, errors.New("sharing the cache needs a database backend")
+	}
+	if prefix, ok := cacheStoreBackends[name]; ok && !strings.HasPrefix(strings.ToLower(dbName), prefix) {
+		return nil, fmt.Errorf("the database backend is %s, not %s", dbName, name)
+	}
+	if host, ok := perm.UserState().(redisHost); ok {
+		return &redisCacheStore{pool: host.Pool(), dbindex: host.DatabaseIndex()}, nil
+	}
+	entries, err := perm.UserState().Creator().NewHashMap(cacheHashMap)
+	if err != nil {
+		return nil, err
+	}
+	store := &databaseCacheStore{entries: entries}
+	store.lastCleanup.Store(time.Now().UnixNano())
+	return store, nil
+}
+
+// fileMeta returns the metadata for the cache entries of a file, or of the
+// output that is rendered from it, which is the modification time and size
+func fileMeta(info os.FileInfo) string {
+	return strconv.FormatInt(info.ModTime().UnixNano(), 10) + "," + strconv.FormatInt(info.Size(), 10)
+}
+
+// databaseFileCache is a file cache that keeps the files in a cacheStore, so
+// that several instances can share one cache, that also survives restarts.
+// Each file is stored with the modification time and size it had as the
+// metadata, so that files that have changed are read again.
+type databaseFileCache struct {
+	store            cacheStore
+	storeName        string        // the name of the database backend
+	ttl              time.Duration // how long the files are kept
+	maxEntitySize    uint64        // the maximum size of a file that is stored (0 for no limit)
+	compressionSpeed bool
+	hits             atomic.Uint64
+	misses           atomic.Uint64
+}
+
+// newDatabaseFileCache creates a file cache that uses the given store
+func newDatabaseFileCache(store cacheStore, storeName string, ttl time.Duration, maxEntitySize uint64, compressionSpeed bool) *databaseFileCache {
+	return &databaseFileCache{
+		store:            store,
+		storeName:        storeName,
+		ttl:              ttl,
+		maxEntitySize:    maxEntitySize,
+		compressionSpeed: compressionSpeed,
+	}
+}
+
+// Read reads a file from the cache, or from disk if it is not cached, has
+// changed or if cached is false
+func (c *databaseFileCache) Read(filename string, cached bool) (*datablock.DataBlock, error) {
+	if !cached {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return datablock.NewDataBlock(data, c.compressionSpeed), nil
+	}
+	block, _, err := c.read(filename, 0, 0)
+	return block, err
+}
+
+func (c *databaseFileCache) read(filename string, ttl time.Duration, maxEntitySize uint64) (*datablock.DataBlock, bool, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, false, err
+	}
+	key := "file:" + filepath.Clean(filename)
+	meta := fileMeta(info)
+	// Check the metadata first, so that files that have changed are not
+	// fetched from the store before they are read again
+	if m, ok := c.store.meta(key); ok && m == meta {
+		if m, data, ok := c.store.get(key); ok && m == meta {
+			c.hits.Add(1)
+			return datablock.NewDataBlock(data, c.compressionSpeed), true, nil
+		}
+	}
+	c.misses.Add(1)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, false, err
+	}
+	if ttl == 0 {
+		ttl = c.ttl
+	}
+	if maxEntitySize == 0 {
+		maxEntitySize = c.maxEntitySize
+	}
+	if maxEntitySize == 0 || uint64(len(data)) <= maxEntitySize {
+		c.store.set(key, meta, data, ttl)
+	}
+	return datablock.NewDataBlock(data, c.compressionSpeed), false, nil
+}
+
+// Clear removes all entries from the store, also the ones that were stored
+// by other instances
+func (c *databaseFileCache) Clear() {
+	if err := c.store.clear(); err != nil {
+		logrus.Error("cache: could not clear the cache: ", err)
+	}
+}
+
+// Stats returns information about the cache use
+func (c *databaseFileCache) Stats() string {
+	var sb strings.Builder
+	sb.WriteString("Cache information:\n")
+	sb.WriteString("\tStore:\t\t" + c.storeName + ", shared\n")
+	if n, err := c.store.count(); err == nil {
+		sb.WriteString(fmt.Sprintf("\tEntries:\t%d\n", n))
+	}
+	if c.ttl > 0 {
+		sb.WriteString(fmt.Sprintf("\tTime to live:\t%v\n", c.ttl))
+	}
+	sb.WriteString(fmt.Sprintf("\tCache hits:\t%d\n", c.hits.Load()))
+	sb.WriteString(fmt.Sprintf("\tCache misses:\t%d\n", c.misses.Load()))
+	return sb.String()
+}
+
+// BytesUsed returns the memory that is used by the cache, which is none
+func (c *databaseFileCache) BytesUsed() uint64 {
+	return 0
+}
@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "github.com/xyproto/permissionbolt/v2"
+)
+
+func TestDatabaseCacheStore(t *testing.T) {
+	perm, err := bolt.NewWithConf(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newDatabaseCacheStore(perm, "redis", "Bolt (cache.db)"); err == nil {
+		t.Error("expected an error when the backend is not the one that was asked for")
+	}
+	store, err := newDatabaseCacheStore(perm, "bolt", "Bolt (cache.db)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Binary data, and a key with ":" in it
+	data := []byte{0, 1, 2, 0xff, '\n'}
+	store.set("gzip:abc", "1,2", data, time.Hour)
+	if meta, ok := store.meta("gzip:abc"); !ok || meta != "1,2" {
+		t.Errorf("got the metadata %q, %v, want %q", meta, ok, "1,2")
+	}
+	if meta, got, ok := store.get("gzip:abc"); !ok || meta != "1,2" || !bytes.Equal(got, data) {
+		t.Errorf("got %q, %v, %v, want %q, %v", meta, got, ok, "1,2", data)
+	}
+	store.set("expired", "", data, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, _, ok := store.get("expired"); ok {
+		t.Error("expected the entry to have expired")
+	}
+	if _, ok := store.meta("expired"); ok {
+		t.Error("expected the metadata of the entry to have expired")
+	}
+	store.(*databaseCacheStore).lastCleanup.Store(0)
+	store.(*databaseCacheStore).cleanup(time.Now())
+	if n, err := store.count(); err != nil || n != 1 {
+		t.Errorf("expected the expired entry to be removed, got %d entries (%v)", n, err)
+	}
+	if err := store.clear(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := store.get("gzip:abc"); ok {
+		t.Error("expected the store to be empty after clearing it")
+	}
+
+	if _, err := newDatabaseCacheStore(nil, CacheStoreDatabase, ""); err == nil {
+		t.Error("expected an error without a database backend")
+	}
+}
+
+func TestDatabaseFileCache(t *testing.T) {
+	perm, err := bolt.NewWithConf(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := newDatabaseCacheStore(perm, CacheStoreDatabase, "Bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "index.html")
+	html := strings.Repeat("<p>Hello, World!</p>\n", 1000)
+	if err := os.WriteFile(filename, []byte(html), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two instances that share the database
+	newInstance := func() *Config {
+		ac := &Config{cacheSize: 1 << 20, cacheStore: store, cacheTTL: time.Hour}
+		ac.cache = newDatabaseFileCache(store, "Bolt", time.Hour, 0, true)
+		return ac
+	}
+	first, second := newInstance(), newInstance()
+	if _, err := first.cache.Read(filename, true); err != nil {
+		t.Fatal(err)
+	}
+	block, err := second.cache.Read(filename, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.cache.(*databaseFileCache).hits.Load() != 1 || block.String() != html {
+		t.Error("expected the second instance to read the file from the shared cache")
+	}
+
+	// The compressed variants are shared as well
+	get := func(ac *Config) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+		req.Header.Set("Accept-Encoding", "zstd")
+		rec := httptest.NewRecorder()
+		ac.DataToClient(rec, req, filename, []byte(html))
+		return rec
+	}
+	get(first)
+	if rec := get(second); rec.Header().Get("Content-Encoding") != encodingZstd || !bytes.Equal(decode(t, encodingZstd, rec.Body.Bytes()), []byte(html)) {
+		t.Errorf("got %v", rec.Header())
+	}
+	if n, _ := store.count(); n != 2 {
+		t.Errorf("expected the file and the compressed variant in the store, got %d entries", n)
+	}
+
+	// And so are the rendered pages, by the modification time of the source
+	mdname := filepath.Join(filepath.Dir(filename), "index.md")
+	if err := os.WriteFile(mdname, []byte("# Hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(mdname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.storeRendered(mdname, info, renderedPage{modTime: info.ModTime(), size: info.Size(), data: []byte("<h1>Hello</h1>"), sum: "abc"})
+	if page, ok := second.loadRendered(mdname, info); !ok || string(page.data) != "<h1>Hello</h1>" || page.sum != "abc" {
+		t.Errorf("expected the second instance to find the rendered page, got %q, %v", page.data, ok)
+	}
+	os.Chtimes(mdname, info.ModTime().Add(time.Second), info.ModTime().Add(time.Second))
+	if info, err := os.Stat(mdname); err != nil {
+		t.Fatal(err)
+	} else if _, ok := second.loadRendered(mdname, info); ok {
+		t.Error("expected the rendered page to be outdated when the source has changed")
+	}
+
+	// Files that have changed are read again
+	time.Sleep(10 * time.Millisecond)
+	if err := os.WriteFile(filename, []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if block, err := second.cache.Read(filename, true); err != nil || block.String() != "changed" {
+		t.Errorf("expected the changed file, got %v", err)
+	}
+
+	if stats := first.cache.Stats(); !strings.Contains(stats, "Bolt, shared") || !strings.Contains(stats, "Entries:\t3") {
+		t.Errorf("got the stats %q", stats)
+	}
+	first.ClearCache()
+	if n, _ := store.count(); n != 0 {
+		t.Errorf("expected ClearCache to clear the shared cache, got %d entries", n)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"strings"
 
 	"github.com/xyproto/algernon/utils"
-	"github.com/xyproto/sheepcounter"
 )
 
 // canonicalPathMiddleware canonicalizes the request path before the mux, the
@@ -35,12 +34,8 @@ func (ac *Config) permissionMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		// The permission system requires a database backend, so perm can be nil
 		if ac.perm != nil && ac.perm.Rejected(w, req) {
-			// Prepare to count bytes written
-			sc := sheepcounter.New(w)
 			// Get and call the Permission Denied function
-			ac.perm.DenyFunction()(sc, req)
-			// Log the response
-			ac.LogAccess(req, http.StatusForbidden, sc.Counter())
+			ac.perm.DenyFunction()(w, req)
 			// Reject the request by not calling the next handler
 			return
 		}
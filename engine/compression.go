@@ -0,0 +1,518 @@
+package engine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+	"github.com/xyproto/datablock"
+)
+
+// Content codings for responses
+const (
+	encodingIdentity = "identity"
+	encodingGzip     = "gzip"
+	encodingZstd     = "zstd"
+	encodingBrotli   = "br"
+)
+
+// compressEncodings are the content codings that responses can be compressed
+// with, in order of preference when the client likes them equally well
+var compressEncodings = []string{encodingZstd, encodingBrotli, encodingGzip}
+
+// zstdWindowSize is the largest window that browsers accept for zstd
+const zstdWindowSize = 8 << 20
+
+// zstdEncoder compresses whole responses. EncodeAll can be used concurrently.
+var zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+	enc, err := zstd.NewWriter(nil, zstd.WithWindowSize(zstdWindowSize))
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	return enc
+})
+
+// negotiateEncoding returns the content coding among the offers that the
+// Accept-Encoding header value has the highest q-value for, or "identity".
+// Offers with the same q-value are chosen in the order they are given.
+func negotiateEncoding(acceptEncoding string, offers []string) string {
+	qualities := make(map[string]float64)
+	wildcard := -1.0 // not given
+	for part := range strings.SplitSeq(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name == "x-gzip" {
+			name = encodingGzip
+		}
+		q := 1.0
+		for param := range strings.SplitSeq(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(key, "q") {
+				if f, err := strconv.ParseFloat(value, 64); err == nil && f >= 0 && f <= 1 {
+					q = f
+				} else {
+					q = 0
+				}
+			}
+		}
+		if name == "*" {
+			wildcard = q
+		} else {
+			qualities[name] = q
+		}
+	}
+	best, bestQ := encodingIdentity, 0.0
+	for _, offer := range offers {
+		q, ok := qualities[offer]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	// Uncompressed data is only preferred if the client says so
+	if q, ok := qualities[encodingIdentity]; ok && q > bestQ {
+		return encodingIdentity
+	}
+	return best
+}
+
+// acceptedEncoding returns the content coding among the offers that the
+// client prefers, or "identity"
+func (ac *Config) acceptedEncoding(req *http.Request, offers ...string) string {
+	values := req.Header.Values("Accept-Encoding")
+	if len(values) == 0 {
+		// Curl does not use --compressed by default. This causes problems when
+		// serving gzipped contents when curl is run without --compressed!
+		// The wrong data, of the same size, will be downloaded. Beware!
+		if ac.curlSupport || !slices.Contains(offers, encodingGzip) {
+			return encodingIdentity
+		}
+		// Modern browsers support gzip
+		return encodingGzip
+	}
+	return negotiateEncoding(strings.Join(values, ","), offers)
+}
+
+// varyAcceptEncoding adds Accept-Encoding to the Vary header, if it is not there
+func varyAcceptEncoding(header http.Header) {
+	for _, value := range header.Values("Vary") {
+		for name := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
+
+// compress compresses data with the given content coding
+func compress(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case encodingZstd:
+		return zstdEncoder().EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	case encodingBrotli:
+		var buf bytes.Buffer
+		bw := brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+		if _, err := bw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := bw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case encodingGzip:
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return data, nil
+}
+
+// encodedCacheEntry is compressed data, by content coding and the SHA-256
+// sum of the uncompressed data
+type encodedCacheEntry struct {
+	key  string
+	data []byte
+	elem *list.Element
+}
+
+// encodedCache keeps the compressed variants of the files and rendered pages
+// that are sent to clients, so that the same data is only compressed once.
+// The variants are found by the hash of the uncompressed data, so they never
+// need to be invalidated. The cache shares the --cachesize budget with the
+// file cache. If the cache is kept in the database backend, the variants are
+// also stored there, for the other instances.
+type encodedCache struct {
+	entries    map[string]*encodedCacheEntry
+	lru        *list.List // the most recently used entry first
+	otherUsage func() uint64
+	shared     cacheStore    // the cache in the database backend, if any
+	sharedTTL  time.Duration // how long the variants are kept there
+	maxSize    uint64
+	used       uint64
+	mu         sync.Mutex
+}
+
+// newEncodedCache creates a cache for compressed data that may use up to
+// maxSize bytes, minus the bytes that otherUsage returns, if otherUsage is
+// not nil
+func newEncodedCache(maxSize uint64, otherUsage func() uint64) *encodedCache {
+	return &encodedCache{
+		entries:    make(map[string]*encodedCacheEntry),
+		lru:        list.New(),
+		otherUsage: otherUsage,
+		maxSize:    maxSize,
+	}
+}
+
+// Clear removes all compressed data
+func (c *encodedCache) Clear() {
+	c.mu.Lock()
+	c.entries = make(map[string]*encodedCacheEntry)
+	c.lru.Init()
+	c.used = 0
+	c.mu.Unlock()
+}
+
+// get returns the compressed data for the key, if it is stored
+func (c *encodedCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(e.elem)
+	}
+	c.mu.Unlock()
+	if ok {
+		return e.data, true
+	}
+	if c.shared != nil {
+		if _, data, ok := c.shared.get("variant:" + key); ok {
+			c.storeLocal(key, data)
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// store adds compressed data and evicts the least recently used entries,
+// if needed
+func (c *encodedCache) store(key string, data []byte) {
+	if c.shared != nil {
+		c.shared.set("variant:"+key, "", data, c.sharedTTL)
+	}
+	c.storeLocal(key, data)
+}
+
+// storeLocal adds compressed data to the memory only
+func (c *encodedCache) storeLocal(key string, data []byte) {
+	size := uint64(len(key) + len(data))
+	var otherUsage uint64
+	if c.otherUsage != nil {
+		otherUsage = c.otherUsage()
+	}
+	if otherUsage+size > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	for c.used+otherUsage+size > c.maxSize {
+		oldest := c.lru.Back().Value.(*encodedCacheEntry)
+		c.lru.Remove(oldest.elem)
+		delete(c.entries, oldest.key)
+		c.used -= uint64(len(oldest.key) + len(oldest.data))
+	}
+	e := &encodedCacheEntry{key: key, data: data}
+	e.elem = c.lru.PushFront(e)
+	c.entries[key] = e
+	c.used += size
+}
+
+// compressedVariants returns the cache for compressed data, or nil if
+// caching is disabled
+func (ac *Config) compressedVariants() *encodedCache {
+	ac.encodedCacheOnce.Do(func() {
+		if ac.cacheSize > 0 && !ac.noCache {
+			ac.encodedCache = newEncodedCache(ac.cacheSize, func() uint64 {
+				if ac.cache == nil {
+					return 0
+				}
+				return ac.cache.BytesUsed()
+			})
+			ac.encodedCache.shared = ac.cacheStore
+			ac.encodedCache.sharedTTL = ac.cacheTTL
+		}
+	})
+	return ac.encodedCache
+}
+
+// encoded returns the data compressed with the given content coding, from
+// the cache, if possible. sum is the contentSum of the data.
+func (ac *Config) encoded(data []byte, sum, encoding string) ([]byte, error) {
+	c := ac.compressedVariants()
+	if c == nil {
+		return compress(data, encoding)
+	}
+	key := encoding + ":" + sum
+	if compressed, ok := c.get(key); ok {
+		return compressed, nil
+	}
+	compressed, err := compress(data, encoding)
+	if err != nil {
+		return nil, err
+	}
+	c.store(key, compressed)
+	return compressed, nil
+}
+
+// uncompressed returns the uncompressed data of a block. If the block is
+// stored with gzip, and the contentSum of the data is known, the uncompressed
+// data is kept in the cache, so that range requests for different parts of
+// the same file do not decompress all of it every time.
+func (ac *Config) uncompressed(block *datablock.DataBlock, sum string) ([]byte, error) {
+	c := ac.compressedVariants()
+	if !block.IsCompressed() || sum == "" || c == nil {
+		data, _, err := block.UncompressedData()
+		return data, err
+	}
+	key := encodingIdentity + ":" + sum
+	if data, ok := c.get(key); ok {
+		return data, nil
+	}
+	data, _, err := block.UncompressedData()
+	if err != nil {
+		return nil, err
+	}
+	c.store(key, data)
+	return data, nil
+}
+
+// DataBlockToClient sends a data block (that might be cached, and stored
+// with gzip) to a HTTP client. If there is enough data for compression to
+// make sense, it is compressed with the content coding that the client
+// prefers, unless the Content-Encoding header has already been set.
+func (ac *Config) DataBlockToClient(w http.ResponseWriter, req *http.Request, filename string, block *datablock.DataBlock) {
+	ac.serveDataBlock(w, req, filename, time.Time{}, "", block)
+}
+
+// serveDataBlock sends a data block to a HTTP client, with an ETag from the
+// hash of the data, and compressed if possible. If the modification time is
+// not zero, it is sent as Last-Modified. sum is the contentSum of the
+// uncompressed data, or "" for finding it here. Conditional requests and
+// range requests are handled by http.ServeContent.
+func (ac *Config) serveDataBlock(w http.ResponseWriter, req *http.Request, filename string, modTime time.Time, sum string, block *datablock.DataBlock) {
+	// Ranges are for the uncompressed data, like for the files on disk, so
+	// that media players can seek and downloads can be resumed
+	ranged := req.Header.Get("Range") != ""
+	encoding := encodingIdentity
+	// Data that is stored with gzip can be sent as it is, regardless of the size
+	if (block.IsCompressed() || block.Length() > gzipThreshold) && w.Header().Get("Content-Encoding") == "" {
+		varyAcceptEncoding(w.Header())
+		if !ranged {
+			encoding = ac.acceptedEncoding(req, compressEncodings...)
+		}
+	}
+	var (
+		data, body []byte
+		err        error
+	)
+	if sum == "" || encoding != encodingGzip || !block.IsCompressed() {
+		if ranged {
+			data, err = ac.uncompressed(block, sum)
+		} else {
+			data, _, err = block.UncompressedData()
+		}
+		if sum == "" && err == nil {
+			sum = contentSum(data)
+		}
+	}
+	switch {
+	case err != nil:
+	case encoding == encodingGzip && block.IsCompressed():
+		// Send the data as it is stored in the file cache
+		body, _, err = block.Gzipped()
+	case encoding == encodingIdentity:
+		body = data
+	default:
+		if body, err = ac.encoded(data, sum, encoding); err != nil {
+			// Send the uncompressed data if compression should fail
+			logrus.Error(err)
+			body, encoding, err = data, encodingIdentity, nil
+		}
+	}
+	if err != nil {
+		logrus.Error("Could not serve " + filename + ": " + err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if encoding != encodingIdentity {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	if w.Header().Get("ETag") == "" {
+		w.Header().Set("ETag", entityTag(sum, encoding))
+	}
+	// Serve the data with http.ServeContent, which supports ranges and
+	// conditional requests
+	http.ServeContent(w, req, filename, modTime, bytes.NewReader(body))
+}
+
+// compressibleType checks if responses with the given Content-Type are
+// likely to be made smaller by compression, and are not event streams
+func compressibleType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	switch {
+	case mediaType == "", mediaType == "image/svg+xml":
+		return true
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	}
+	for _, suffix := range []string{"json", "javascript", "ecmascript", "xml", "wasm"} {
+		if strings.HasSuffix(mediaType, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter compresses the output of Lua scripts, handle() routes and
+// reverse proxies with the content coding that the client prefers. The first gzipThreshold bytes are held
+// back, so that small responses, and responses that are flushed early, like
+// streams, are sent as they are.
+type compressWriter struct {
+	http.ResponseWriter
+	req      *http.Request
+	encoding string
+	buf      []byte
+	enc      io.WriteCloser // nil unless the output is being compressed
+	status   int
+	decided  bool // if the header has been written
+}
+
+// newCompressWriter wraps the given ResponseWriter. Close must be called
+// when the response is done.
+func (ac *Config) newCompressWriter(w http.ResponseWriter, req *http.Request) *compressWriter {
+	return &compressWriter{ResponseWriter: w, req: req, encoding: ac.acceptedEncoding(req, compressEncodings...)}
+}
+
+// decide writes the header, and what has been held back, compressed or not
+func (cw *compressWriter) decide(compressed bool) error {
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	header := cw.Header()
+	bodyless := cw.req.Method == http.MethodHead || cw.status == http.StatusNoContent || cw.status == http.StatusNotModified
+	if compressed && !bodyless && cw.encoding != encodingIdentity && header.Get("Content-Encoding") == "" && compressibleType(header.Get(contentType)) {
+		if header.Get(contentType) == "" {
+			header.Set(contentType, http.DetectContentType(cw.buf))
+		}
+		header.Set("Content-Encoding", cw.encoding)
+		varyAcceptEncoding(header)
+		header.Del("Content-Length")
+		switch cw.encoding {
+		case encodingZstd:
+			enc, err := zstd.NewWriter(cw.ResponseWriter, zstd.WithWindowSize(zstdWindowSize), zstd.WithEncoderConcurrency(1))
+			if err != nil {
+				return err
+			}
+			cw.enc = enc
+		case encodingBrotli:
+			cw.enc = brotli.NewWriterLevel(cw.ResponseWriter, brotli.DefaultCompression)
+		case encodingGzip:
+			cw.enc = gzip.NewWriter(cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if cw.enc != nil {
+		_, err := cw.enc.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided || (status >= 100 && status <= 199) {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) <= gzipThreshold {
+			return len(p), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush sends what has been written so far to the client
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(false)
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
+
+// Close writes what is held back, and the end of the compressed stream
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			// Nothing was written, leave the response to the server
+			return nil
+		}
+		return cw.decide(false)
+	}
+	if cw.enc != nil {
+		return cw.enc.Close()
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package engine
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/xyproto/algernon/cachemode"
+	"github.com/xyproto/datablock"
+	"github.com/xyproto/mime"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"gzip, deflate, br, zstd", encodingZstd},
+		{"gzip, zstd;q=0.5", encodingGzip},
+		{"br;q=1.0, gzip;q=0.8", encodingBrotli},
+		{"gzip, br", encodingBrotli},
+		{"x-gzip", encodingGzip},
+		{"*", encodingZstd},
+		{"*;q=0.5, zstd;q=0", encodingBrotli},
+		{"*;q=0.5, zstd;q=0, br;q=0", encodingGzip},
+		{"identity, gzip;q=0.5", encodingIdentity},
+		{"gzip;q=0, zstd;q=0", encodingIdentity},
+		{"gzip;q=invalid", encodingIdentity},
+		{"deflate", encodingIdentity},
+		{"", encodingIdentity},
+	}
+	for _, test := range tests {
+		if got := negotiateEncoding(test.header, compressEncodings); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.header, got, test.want)
+		}
+	}
+}
+
+// decode decompresses a response body with the given content coding
+func decode(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+	var (
+		r   io.Reader
+		err error
+	)
+	switch encoding {
+	case encodingGzip:
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case encodingZstd:
+		var d *zstd.Decoder
+		d, err = zstd.NewReader(bytes.NewReader(body))
+		if err == nil {
+			defer d.Close()
+		}
+		r = d
+	case encodingBrotli:
+		r = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return body
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDataBlockToClient(t *testing.T) {
+	ac := &Config{cacheSize: 1 << 20}
+	data := []byte(strings.Repeat("<p>Hello, World!</p>\n", 1000))
+	for _, test := range []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"gzip, zstd", encodingZstd},
+		{"gzip, br", encodingBrotli},
+		{"gzip", encodingGzip},
+		{"identity", ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		rec := httptest.NewRecorder()
+		ac.DataToClient(rec, req, "index.html", data)
+		if got := rec.Header().Get("Content-Encoding"); got != test.want {
+			t.Errorf("%q: got Content-Encoding %q, want %q", test.acceptEncoding, got, test.want)
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%q: expected Vary: Accept-Encoding, got %v", test.acceptEncoding, rec.Header())
+		}
+		if got := decode(t, test.want, rec.Body.Bytes()); !bytes.Equal(got, data) {
+			t.Errorf("%q: the decoded body differs from the data", test.acceptEncoding)
+		}
+	}
+
+	// The compressed variants are only made once
+	sizeBefore := ac.compressedVariants().used
+	req := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+	req.Header.Set("Accept-Encoding", "zstd")
+	ac.DataToClient(httptest.NewRecorder(), req, "index.html", data)
+	if used := ac.compressedVariants().used; used == 0 || used != sizeBefore {
+		t.Errorf("expected the cached variants to be reused, used %d bytes before and %d after", sizeBefore, used)
+	}
+
+	// Blocks that are stored with gzip are sent as they are, or decompressed
+	block := datablock.NewDataBlock(data, true)
+	if err := block.Compress(); err != nil {
+		t.Fatal(err)
+	}
+	for _, acceptEncoding := range []string{"gzip", "identity"} {
+		req := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		ac.DataBlockToClient(rec, req, "index.html", block)
+		if got := decode(t, rec.Header().Get("Content-Encoding"), rec.Body.Bytes()); !bytes.Equal(got, data) {
+			t.Errorf("%q: the decoded body differs from the data", acceptEncoding)
+		}
+	}
+
+	// Small responses are not compressed
+	req = httptest.NewRequest(http.MethodGet, "/small.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	ac.DataToClient(rec, req, "small.txt", []byte("hi"))
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "hi" {
+		t.Errorf("expected a small response to be sent as it is, got %v and %q", rec.Header(), rec.Body.String())
+	}
+}
+
+func TestCompressWriter(t *testing.T) {
+	ac := &Config{}
+	large := strings.Repeat(`{"hello": "world"}`, 1000)
+	for _, test := range []struct {
+		body           string
+		contentType    string
+		acceptEncoding string
+		flush          bool
+		want           string
+	}{
+		{large, "application/json", "gzip", false, encodingGzip},
+		{large, "application/json", "gzip, br", false, encodingBrotli},
+		{"{}", "application/json", "gzip", false, ""},
+		{large, "image/png", "gzip", false, ""},
+		{large, "application/json", "gzip", true, ""}, // flushed before there was enough data
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/data.lua", nil)
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		rec := httptest.NewRecorder()
+		cw := ac.newCompressWriter(rec, req)
+		cw.Header().Set(contentType, test.contentType)
+		if test.flush {
+			cw.Flush()
+		}
+		io.WriteString(cw, test.body)
+		if err := cw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != test.want {
+			t.Errorf("%s of %d bytes: got Content-Encoding %q, want %q", test.contentType, len(test.body), got, test.want)
+		}
+		if got := decode(t, test.want, rec.Body.Bytes()); string(got) != test.body {
+			t.Errorf("%s of %d bytes: the decoded body differs", test.contentType, len(test.body))
+		}
+	}
+}
+
+func TestCompressHandleRoute(t *testing.T) {
+	mux := newTestLuaMux(t, `
+handle("/data", function()
+  content("application/json")
+  print(string.rep('{"hello": "world"}', 1000))
+end)
+`)
+	req := httptest.NewRequest(http.MethodGet, "/data", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Encoding"); got != encodingGzip {
+		t.Fatalf("got Content-Encoding %q, want %q", got, encodingGzip)
+	}
+	if got := decode(t, encodingGzip, rec.Body.Bytes()); !strings.HasPrefix(string(got), `{"hello": "world"}`) {
+		t.Errorf("the decoded body differs: %.40q", got)
+	}
+}
+
+func TestCompressProxiedResponse(t *testing.T) {
+	large := strings.Repeat("hello world\n", 1000)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(contentType, "text/plain")
+		w.Header().Set("Content-Length", strconv.Itoa(len(large)))
+		io.WriteString(w, large)
+	}))
+	defer backend.Close()
+
+	ac := &Config{reverseProxyConfig: newTestProxyConfig(t, "/api", backend.URL)}
+	req := httptest.NewRequest(http.MethodGet, "/api/text", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	mux := http.NewServeMux()
+	ac.RegisterHandlers(mux, "/", t.TempDir(), false)
+	mux.ServeHTTP(rec, req)
+	if got := rec.Header().Get("Content-Encoding"); got != encodingGzip {
+		t.Fatalf("got Content-Encoding %q, want %q", got, encodingGzip)
+	}
+	if got := decode(t, encodingGzip, rec.Body.Bytes()); string(got) != large {
+		t.Error("the decoded body differs")
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "video.webm")
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The file cache stores the data with gzip
+	ac := &Config{
+		cache:         datablock.NewFileCache(1<<20, true, 0, true, 0),
+		cacheMode:     cachemode.On,
+		cacheSize:     1 << 20,
+		mimereader:    mime.New("/etc/mime.types", true),
+		largeFileSize: 1 << 20,
+	}
+	get := func(header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/video.webm", nil)
+		req.Header.Set("Accept-Encoding", "gzip, zstd")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		ac.FilePage(rec, req, filename, "")
+		return rec
+	}
+
+	etag := get("Accept-Encoding", "identity").Header().Get("ETag")
+	for i := range 2 { // the second time, the uncompressed data is in the cache
+		rec := get("Range", "bytes=1000-1999")
+		if rec.Code != http.StatusPartialContent {
+			t.Fatalf("request %d: got %d, want 206", i+1, rec.Code)
+		}
+		if rec.Header().Get("Content-Encoding") != "" || rec.Header().Get("Content-Range") != "bytes 1000-1999/100000" {
+			t.Errorf("request %d: got the headers %v", i+1, rec.Header())
+		}
+		if !bytes.Equal(rec.Body.Bytes(), data[1000:2000]) {
+			t.Errorf("request %d: got the wrong bytes", i+1)
+		}
+	}
+
+	rec := get("Range", "bytes=0-9,-10")
+	if rec.Code != http.StatusPartialContent || !strings.HasPrefix(rec.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Errorf("multiple ranges: got %d with %v", rec.Code, rec.Header())
+	}
+
+	// If-Range with the current ETag gives the range, and an old ETag gives all of it
+	if rec := get("Range", "bytes=0-9", "If-Range", etag); rec.Code != http.StatusPartialContent || rec.Body.Len() != 10 {
+		t.Errorf("If-Range with the current ETag: got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	rec = get("Range", "bytes=0-9", "If-Range", `"outdated"`, "Accept-Encoding", "identity")
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Errorf("If-Range with an old ETag: got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	if rec := get("Range", "bytes=200000-"); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("got %d, want 416", rec.Code)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/rpc"
 	"os"
@@ -47,15 +48,22 @@ const (
 type Config struct {
 	perm                         pinterface.IPermissions // the user state, for the permissions system
 	mimereader                   *mime.Reader
-	serverReadyFunctionLua       func()              // configuration that may only be set in the server configuration script(s)
-	fs                           *datablock.FileStat // for checking if file exists, possibly in a cached way
-	luapool                      *luastate.Pool      // a pool of Lua interpreters
-	handlerPool                  *handlerPool        // a pool of Lua states for handle() requests
-	cache                        *datablock.FileCache
+	serverReadyFunctionLua       func()         // configuration that may only be set in the server configuration script(s)
+	fs                           pathChecker    // for checking if file exists, possibly in a cached way
+	luapool                      *luastate.Pool // a pool of Lua interpreters
+	handlerPool                  *handlerPool   // a pool of Lua states for handle() requests
+	streamPool                   *streamPool    // a pool of Lua states for WebSocket connections and event streams
+	cache                        fileCache      // the file cache, in memory or in the database backend
 	reverseProxyConfig           *ReverseProxyConfig
+	proxyHooks                   []*proxyHooks // the Lua hooks given to AddReverseProxy
+	fastCGIConfig                *FastCGIConfig
+	routingRules                 []*routingRule         // Redirect, Rewrite, RewritePrefix and RewritePort rules
 	bundleCache                  *bundleCache           // cache for on-the-fly esbuild bundles
 	dirConfCache                 *dirConfigCache        // cache for parsed .algernon configurations
 	pluginClients                map[string]*rpc.Client // cache of persistent plugin clients
+	luaRoutes                    map[string]*luaRoute   // handle() routes, by path pattern
+	websocketOrigins             []string               // other origins that may open WebSocket connections, or "*" for all
+	luaMiddleware                []*luaMiddleware       // use() functions, by script
 	redisAddr                    string
 	defaultEventPath             string
 	defaultEventRefresh          string
@@ -89,7 +97,11 @@ type Config struct {
 	commonAccessLogFilename      string // NCSA access log
 	combinedAccessLog            *logWriter
 	commonAccessLog              *logWriter
-	serverLog                    *logWriter // the --log file, if any
+	accessLogFormat              string       // format of the --accesslog file: "combined" (the default), "common" or "json"
+	trustedProxyFlag             string       // from --trusted-proxy, a comma separated list of IP addresses and CIDR ranges
+	trustedProxies               []*net.IPNet // proxies that are trusted to give the client IP in the forwarding headers
+	forwardedHeader              string       // the header that the trusted proxies give the client IP in: "X-Forwarded-For" (the default) or "Forwarded"
+	serverLog                    *logWriter   // the --log file, if any
 	boltFilename                 string
 	internalLogFilename          string               // exposed to the server configuration scripts(s)
 	mariadbDSN                   string               // connection string
@@ -115,10 +127,32 @@ type Config struct {
 	defaultLargeFileSize         uint64        // 42 MiB: the default size for when a static file is large enough to not be read into memory
 	limitRequests                int64         // rate limit to this many requests per client per second
 	handlerPoolSize              int           // number of Lua states available for handle() request parallelism
+	maxStreams                   int           // number of WebSocket connections and event streams that can be open at the same time
 	writeTimeout                 uint64        // timeout when writing data to a client, in seconds
 	defaultStatCacheRefresh      time.Duration // refresh the stat cache, if the stat cache feature is enabled
 	defaultCacheSize             uint64        // 1 MiB
+	defaultDiskCacheSize         uint64        // 1 GiB
+	defaultCacheTTL              time.Duration // 1 hour, for a cache in the database backend
 	pluginClientsMu              sync.Mutex
+	rateLimits                   []*RateLimit   // rate limits for path prefixes, from SetRateLimit
+	rateLimitStore               rateLimitStore // the token buckets for the rate limits
+	rateLimitStoreName           string         // where the token buckets are kept, from --ratelimit-store
+	rateLimitOnce                sync.Once
+	encodedCache                 *encodedCache // compressed variants of the responses
+	encodedCacheOnce             sync.Once
+	fileSums                     sync.Map            // the content hashes of files that have been sent, for the ETags
+	renderedPages                sync.Map            // the output of renderers, with the content hashes, by source filename
+	cacheControls                []*cacheControlRule // Cache-Control values for extensions and path prefixes, from SetCacheControl
+	minifyFlag                   bool                // minify all types of output, from --minify
+	minifyTypes                  map[string]bool     // the types of output that are minified, like "html"
+	diskCacheDir                 string              // directory for caching chunks of large files, from --diskcache
+	diskCacheSize                uint64              // max size of the disk cache, in bytes
+	diskCache                    *diskCache          // chunks of large files, if --diskcache is given
+	cacheStoreName               string              // where the cache is kept, like "memory" or "redis", from --cache
+	cacheStore                   cacheStore          // the cache in the database backend, if it is shared
+	cacheTTL                     time.Duration       // how long entries are kept in a shared cache
+	cacheRules                   []*cacheRule        // which files are cached, and for how long, from SetCacheRules
+	cacheWatcher                 *cacheWatcher       // removes files from the caches when they change on disk
 	defaultPermissions           os.FileMode
 	quietMode                    bool // no output to the command line
 	autoRefresh                  bool // enable the event server and inject JavaScript to reload pages when sources change
@@ -141,6 +175,7 @@ type Config struct {
 	noHeaders                    bool // HTTP headers
 	redisAddrSpecified           bool
 	noCache                      bool
+	noWatch                      bool // don't watch the served directory for changes to cached files
 	showVersion                  bool
 	curlSupport                  bool // support clients like "curl" that downloads uncompressed by default
 	noBanner                     bool // don't display the ANSI-graphics banner at start
@@ -160,9 +195,14 @@ type Config struct {
 
 // PortSetting describes a single listener endpoint with a protocol and TLS preference
 type PortSetting struct {
-	Addr     string // [host]:port
-	Protocol string // "http", "http2", "http3" (or "quic"), "event"
-	TLS      bool   // use TLS?
+	Addr     string      // [host]:port or unix:/path/to.sock
+	Protocol string      // "http", "http2", "http3" (or "quic"), "event"
+	TLS      bool        // use TLS?
+	Mode     os.FileMode // file mode for Unix sockets, or 0 for the default
+	// ProxyProtocol is for reading a PROXY protocol header (v1 or v2) at the
+	// start of every connection, for getting the client address from a load
+	// balancer in front
+	ProxyProtocol bool
 }
 
 // ServeConfig groups all listener and TLS settings. It is the single source of
@@ -173,6 +213,7 @@ type ServeConfig struct {
 	serverCert          string        // exposed to the server configuration scripts(s)
 	serverKey           string        // exposed to the server configuration scripts(s)
 	portSettings        []PortSetting // explicit listener configuration (from SetPorts in Lua)
+	socketMode          os.FileMode   // file mode for Unix sockets (from --socketmode)
 	certMagicDomains    []string
 	redirectHTTP        bool // redirect HTTP traffic to HTTPS?
 	useCertMagic        bool // use CertMagic and Let's Encrypt for all directories in the given directory that contains a "."
@@ -200,6 +241,8 @@ func New(versionString, description string) (*Config, error) {
 		// Pool size for parallel Lua handle() requests. One state per CPU by default.
 		handlerPoolSize: runtime.NumCPU(),
 
+		maxStreams: defaultMaxStreams,
+
 		defaultWebColonPort:       ":3000",
 		defaultRedisColonPort:     ":6379",
 		defaultEventColonPort:     ":5553",
@@ -207,9 +250,11 @@ func New(versionString, description string) (*Config, error) {
 		defaultEventPath:          "/sse",
 		defaultLimit:              10,
 		defaultPermissions:        0o660,
-		defaultCacheSize:          1 * utils.MiB,   // 1 MiB
-		defaultCacheMaxEntitySize: 64 * utils.KiB,  // 64 KB
-		defaultStatCacheRefresh:   time.Minute * 1, // Refresh the stat cache, if the stat cache feature is enabled
+		defaultCacheSize:          1 * utils.MiB,    // 1 MiB
+		defaultDiskCacheSize:      1024 * utils.MiB, // 1 GiB
+		defaultCacheTTL:           time.Hour,        // for a cache in the database backend
+		defaultCacheMaxEntitySize: 64 * utils.KiB,   // 64 KB
+		defaultStatCacheRefresh:   time.Minute * 1,  // Refresh the stat cache, if the stat cache feature is enabled
 
 		// Threshold for streaming static files instead of reading them
 		// into memory. Also caps incoming request body size.
@@ -261,7 +306,11 @@ func New(versionString, description string) (*Config, error) {
 	ac.setupLogging()
 
 	// File stat cache
-	ac.fs = datablock.NewFileStat(ac.cacheFileStat, ac.defaultStatCacheRefresh)
+	if ac.cacheFileStat {
+		ac.fs = newStatCache(ac.defaultStatCacheRefresh)
+	} else {
+		ac.fs = datablock.NewFileStat(false, ac.defaultStatCacheRefresh)
+	}
 
 	return ac, nil
 }
@@ -303,6 +352,39 @@ func (ac *Config) initFilesAndCache() error {
 		}
 		ac.commonAccessLog = lw
 	}
+	if ac.accessLogFormat != "" && !validAccessLogFormat(ac.accessLogFormat) {
+		return fmt.Errorf("unknown access log format: %s, use combined, common or json", ac.accessLogFormat)
+	}
+	if ac.rateLimitStoreName != "" && ac.rateLimitStoreName != RateLimitStoreMemory && ac.rateLimitStoreName != RateLimitStoreDatabase {
+		return fmt.Errorf("unknown rate limit store: %s, use %s or %s", ac.rateLimitStoreName, RateLimitStoreMemory, RateLimitStoreDatabase)
+	}
+	if ac.minifyFlag {
+		ac.minifyTypes = make(map[string]bool)
+		for _, kind := range minifyTypes {
+			ac.minifyTypes[kind] = true
+		}
+	}
+	if ac.diskCacheDir != "" && !ac.noCache {
+		dc, err := newDiskCache(ac.diskCacheDir, ac.diskCacheSize)
+		if err != nil {
+			return fmt.Errorf("could not use %s for the disk cache: %w", ac.diskCacheDir, err)
+		}
+		ac.diskCache = dc
+	}
+	if ac.trustedProxyFlag != "" {
+		trustedProxies, err := parseTrustedProxies(strings.Split(ac.trustedProxyFlag, ","))
+		if err != nil {
+			return err
+		}
+		ac.trustedProxies = trustedProxies
+	}
+	if ac.forwardedHeader != "" {
+		forwardedHeader, err := parseForwardedHeader(ac.forwardedHeader)
+		if err != nil {
+			return err
+		}
+		ac.forwardedHeader = forwardedHeader
+	}
 	// Open the combined access log, if specified
 	if ac.combinedAccessLogFilename != "" {
 		lw, err := openLogWriter(ac.combinedAccessLogFilename, defaultLogPermissions)
@@ -314,7 +396,7 @@ func (ac *Config) initFilesAndCache() error {
 	// Create a cache struct for reading files (contains functions that can
 	// be used for reading files, also when caching is disabled).
 	// The final argument is for compressing with "fast" instead of "best".
-	ac.cache = datablock.NewFileCache(ac.cacheSize, ac.cacheCompression, ac.cacheMaxEntitySize, ac.cacheCompressionSpeed, ac.cacheMaxGivenDataSize)
+	ac.cache = newMemoryFileCache(ac.cacheSize, ac.cacheCompression, ac.cacheMaxEntitySize, ac.cacheCompressionSpeed, ac.cacheMaxGivenDataSize)
 	return nil
 }
 
@@ -564,6 +646,24 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 		}
 	}
 
+	// Keep the token buckets for the rate limits in Redis, so that they are
+	// shared between several instances
+	if ac.rateLimitStoreName == RateLimitStoreDatabase {
+		if ac.rateLimitStore, err = newDatabaseRateLimitStore(ac.perm, ac.dbName); err != nil {
+			logrus.Errorf("Could not keep the rate limits in the database, keeping them in memory: %v", err)
+		}
+	}
+
+	// Keep the file cache and the compressed variants in the database, so
+	// that they are shared between several instances
+	if ac.cacheStoreName != "" && ac.cacheStoreName != CacheStoreMemory && ac.cacheMode != cachemode.Off && !ac.noCache {
+		if ac.cacheStore, err = newDatabaseCacheStore(ac.perm, ac.cacheStoreName, ac.dbName); err != nil {
+			logrus.Errorf("Could not keep the cache in the database, keeping it in memory: %v", err)
+		} else {
+			ac.cache = newDatabaseFileCache(ac.cacheStore, ac.dbName, ac.cacheTTL, ac.cacheMaxEntitySize, ac.cacheCompressionSpeed)
+		}
+	}
+
 	// Lua LState pool
 	ac.luapool = luastate.New()
 	AtShutdown(func() {
@@ -684,6 +784,19 @@ func (ac *Config) MustServe(mux *http.ServeMux) error {
 	// If --eventserver was explicitly provided, use a separate SSE server
 	ac.separateEventServer = ac.eventAddr != ""
 
+	// Remove files from the caches as soon as they change on disk
+	caching := !ac.noCache && ac.cacheMode != cachemode.Off
+	if (caching || ac.cacheFileStat) && !ac.noWatch && !ac.singleFileMode && ac.fs.IsDir(ac.serverDirOrFilename) {
+		if cw, err := ac.watchForChanges(ac.serverDirOrFilename); err != nil {
+			logrus.Warn("Could not watch for changes, the caches must be cleared when files change: ", err)
+		} else {
+			ac.cacheWatcher = cw
+			AtShutdown(func() {
+				cw.Close()
+			})
+		}
+	}
+
 	// Set the values that has not been set by flags nor scripts
 	// (and can be set by both)
 	ranServerReadyFunction := ac.finalConfiguration(ac.serverHost)
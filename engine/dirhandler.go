@@ -46,6 +46,13 @@ type dirConfigCache struct {
 	mu      sync.RWMutex
 }
 
+// remove removes the parsed configuration from the given .algernon file
+func (dc *dirConfigCache) remove(filename string) {
+	dc.mu.Lock()
+	delete(dc.entries, filename)
+	dc.mu.Unlock()
+}
+
 // DirectoryListing serves the given directory as a web page with links the the contents
 func (ac *Config) DirectoryListing(w http.ResponseWriter, req *http.Request, rootdir, dirname, theme string) {
 	var (
@@ -161,6 +168,8 @@ func (ac *Config) DirPage(w http.ResponseWriter, req *http.Request, rootdir, dir
 		return
 	}
 
+	setHandlerType(req, "directory")
+
 	// Handle the serving of index files, if needed
 	var filename string
 	for _, indexfile := range indexFilenames {
@@ -228,7 +237,7 @@ func (ac *Config) readDirConfig(filename string) DirConfig {
 
 	// Read and parse
 	var dirConf DirConfig
-	block, err := ac.cache.Read(filename, ac.shouldCache(".algernon"))
+	block, err := ac.readFile(filename, ".algernon")
 	if err != nil {
 		return dirConf
 	}
@@ -0,0 +1,306 @@
+package engine
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/utils"
+)
+
+// diskCacheChunkSize is the size of the chunks that large files are cached in
+const diskCacheChunkSize = 1 * utils.MiB
+
+// diskCacheSuffix is the extension of the chunk files in the disk cache directory
+const diskCacheSuffix = ".chunk"
+
+type diskCacheEntry struct {
+	name string
+	size uint64
+	elem *list.Element
+}
+
+// diskCache keeps chunks of the files that are too large to be read into
+// memory in a directory, which can be on a fast disk or on tmpfs. Files are
+// read in chunks of diskCacheChunkSize bytes, as they are requested, so that
+// files on network-mounted or slow storage can be served from the cache
+// without holding them in memory. The chunks are found by the filename,
+// modification time and size of the file, so chunks of files that have
+// changed are never used, and are evicted when they are the least recently
+// used ones.
+type diskCache struct {
+	dir     string
+	entries map[string]*diskCacheEntry
+	lru     *list.List // the most recently used chunk first
+	maxSize uint64
+	used    uint64
+	hits    uint64
+	misses  uint64
+	mu      sync.Mutex
+}
+
+// newDiskCache creates a disk cache that may use up to maxSize bytes in the
+// given directory. The directory is created if it is missing, and chunks
+// that are left from earlier runs are removed.
+func newDiskCache(dir string, maxSize uint64) (*diskCache, error) {
+	if maxSize == 0 {
+		return nil, errors.New("the disk cache size is 0")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	dc := &diskCache{
+		dir:     dir,
+		entries: make(map[string]*diskCacheEntry),
+		lru:     list.New(),
+		maxSize: maxSize,
+	}
+	if err := dc.removeChunkFiles(); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// removeChunkFiles removes the chunk files, and any partially written ones,
+// from the cache directory
+func (dc *diskCache) removeChunkFiles() error {
+	entries, err := os.ReadDir(dc.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasSuffix(name, diskCacheSuffix) || strings.HasSuffix(name, diskCacheSuffix+".tmp") {
+			os.Remove(filepath.Join(dc.dir, name))
+		}
+	}
+	return nil
+}
+
+// Clear removes all chunks from the cache
+func (dc *diskCache) Clear() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	for _, e := range dc.entries {
+		os.Remove(filepath.Join(dc.dir, e.name))
+	}
+	dc.entries = make(map[string]*diskCacheEntry)
+	dc.lru.Init()
+	dc.used = 0
+}
+
+// Stats returns information about the disk cache use
+func (dc *diskCache) Stats() string {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	var sb strings.Builder
+	sb.WriteString("Disk cache information:\n")
+	sb.WriteString("\tDirectory:\t" + dc.dir + "\n")
+	sb.WriteString(fmt.Sprintf("\tTotal cache:\t%d bytes\n", dc.maxSize))
+	sb.WriteString(fmt.Sprintf("\tUsed cache:\t%d bytes\n", dc.used))
+	sb.WriteString(fmt.Sprintf("\tChunks:\t\t%d\n", len(dc.entries)))
+	sb.WriteString(fmt.Sprintf("\tChunk hits:\t%d\n", dc.hits))
+	sb.WriteString(fmt.Sprintf("\tChunk misses:\t%d\n", dc.misses))
+	return sb.String()
+}
+
+// chunkName returns the name of the chunk file for the chunk with the given
+// index of the file
+func chunkName(filename string, info os.FileInfo, index int64) string {
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\x00%d\x00%d\x00%d", filename, info.ModTime().UnixNano(), info.Size(), index))
+	return hex.EncodeToString(sum[:16]) + diskCacheSuffix
+}
+
+// open opens a cached chunk, if it is in the cache
+func (dc *diskCache) open(name string) (*os.File, bool) {
+	dc.mu.Lock()
+	e, ok := dc.entries[name]
+	if ok {
+		dc.lru.MoveToFront(e.elem)
+		dc.hits++
+	} else {
+		dc.misses++
+	}
+	dc.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(filepath.Join(dc.dir, name))
+	if err != nil {
+		// The chunk file has been removed by someone else
+		dc.remove(name)
+		return nil, false
+	}
+	return f, true
+}
+
+// remove removes a chunk from the cache
+func (dc *diskCache) remove(name string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if e, ok := dc.entries[name]; ok {
+		dc.lru.Remove(e.elem)
+		delete(dc.entries, name)
+		dc.used -= e.size
+		os.Remove(filepath.Join(dc.dir, name))
+	}
+}
+
+// store writes a chunk to the cache directory and evicts the least recently
+// used chunks, if needed. The chunk is first written to a temporary file, so
+// that a partially written chunk is never used.
+func (dc *diskCache) store(name string, data []byte) {
+	size := uint64(len(data))
+	if size > dc.maxSize {
+		return
+	}
+	dc.mu.Lock()
+	_, ok := dc.entries[name]
+	dc.mu.Unlock()
+	if ok {
+		return
+	}
+	tmp, err := os.CreateTemp(dc.dir, "*"+diskCacheSuffix+".tmp")
+	if err != nil {
+		logrus.Warn("Could not write to the disk cache: " + err.Error())
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dc.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logrus.Warn("Could not write to the disk cache: " + err.Error())
+		return
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if _, ok := dc.entries[name]; ok {
+		// The same chunk was stored by another request in the meantime
+		return
+	}
+	for dc.used+size > dc.maxSize {
+		oldest := dc.lru.Back().Value.(*diskCacheEntry)
+		dc.lru.Remove(oldest.elem)
+		delete(dc.entries, oldest.name)
+		dc.used -= oldest.size
+		os.Remove(filepath.Join(dc.dir, oldest.name))
+	}
+	e := &diskCacheEntry{name: name, size: size}
+	e.elem = dc.lru.PushFront(e)
+	dc.entries[name] = e
+	dc.used += size
+}
+
+// chunkedReader reads a file through the disk cache. The chunks that are
+// not cached are read from the file and then stored in the cache.
+type chunkedReader struct {
+	dc       *diskCache
+	f        *os.File
+	filename string
+	info     os.FileInfo
+	offset   int64
+	index    int64       // the index of the current chunk, or -1
+	chunk    io.ReaderAt // the current chunk
+	chunkLen int64
+	closer   io.Closer // for the current chunk, if it is read from the cache
+}
+
+// newReader returns an io.ReadSeeker for the given file, that has been
+// opened and stat'ed by the caller. The reader must be closed after use,
+// but the file is not closed by it.
+func (dc *diskCache) newReader(filename string, f *os.File, info os.FileInfo) *chunkedReader {
+	return &chunkedReader{dc: dc, f: f, filename: filename, info: info, index: -1}
+}
+
+// Seek sets the offset for the next Read
+func (r *chunkedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.info.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Read reads from the current chunk, and loads the next chunk when needed
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if r.offset >= r.info.Size() {
+		return 0, io.EOF
+	}
+	if index := r.offset / diskCacheChunkSize; index != r.index {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	pos := r.offset - r.index*diskCacheChunkSize
+	if remaining := r.chunkLen - pos; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.chunk.ReadAt(p, pos)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// load makes the chunk with the given index the current one
+func (r *chunkedReader) load(index int64) error {
+	r.closeChunk()
+	start := index * diskCacheChunkSize
+	length := min(diskCacheChunkSize, r.info.Size()-start)
+	name := chunkName(r.filename, r.info, index)
+	if f, ok := r.dc.open(name); ok {
+		r.chunk, r.closer = f, f
+	} else {
+		data := make([]byte, length)
+		n, err := r.f.ReadAt(data, start)
+		switch {
+		case err == io.EOF:
+			// The file has been truncated since it was stat'ed, so the chunk is not cached
+			length = int64(n)
+		case err != nil:
+			return err
+		default:
+			r.dc.store(name, data)
+		}
+		r.chunk = bytes.NewReader(data[:length])
+	}
+	r.index, r.chunkLen = index, length
+	return nil
+}
+
+// closeChunk closes the current chunk file, if there is one
+func (r *chunkedReader) closeChunk() {
+	if r.closer != nil {
+		r.closer.Close()
+	}
+	r.chunk, r.closer, r.index = nil, nil, -1
+}
+
+// Close closes the current chunk file, if there is one
+func (r *chunkedReader) Close() error {
+	r.closeChunk()
+	return nil
+}
@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "large.bin")
+	data := make([]byte, 2*diskCacheChunkSize+1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Room for two chunks
+	dc, err := newDiskCache(filepath.Join(t.TempDir(), "chunks"), 2*diskCacheChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func() []byte {
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := dc.newReader(filename, f, info)
+		defer r.Close()
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	if !bytes.Equal(read(), data) {
+		t.Fatal("the data read through the disk cache differs from the file")
+	}
+	if dc.misses != 3 || len(dc.entries) != 2 || dc.used > dc.maxSize {
+		t.Errorf("expected 3 misses and 2 chunks, got %d misses, %d chunks and %d bytes used", dc.misses, len(dc.entries), dc.used)
+	}
+	entries, err := os.ReadDir(dc.dir)
+	if err != nil || len(entries) != 2 {
+		t.Errorf("expected 2 chunk files, got %d (%v)", len(entries), err)
+	}
+
+	// The chunks are read from the cache, also when the file has been removed
+	os.Remove(filename)
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filename, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+	if !bytes.Equal(read(), data) {
+		t.Fatal("the data read after the file changed differs from the file")
+	}
+
+	dc.Clear()
+	if entries, _ := os.ReadDir(dc.dir); len(entries) != 0 || dc.used != 0 {
+		t.Errorf("expected the chunk files to be removed, got %d", len(entries))
+	}
+}
+
+func TestDiskCacheRanges(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "video.webm")
+	data := make([]byte, diskCacheChunkSize+5000)
+	for i := range data {
+		data[i] = byte(i % 253)
+	}
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dc, err := newDiskCache(t.TempDir(), 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := &Config{diskCache: dc, largeFileSize: 1000}
+	for i := range 2 { // the second time, the chunks are in the cache
+		req := httptest.NewRequest(http.MethodGet, "/video.webm", nil)
+		req.Header.Set("Range", "bytes=1048000-1049999") // across two chunks
+		rec := httptest.NewRecorder()
+		ac.FilePage(rec, req, filename, "")
+		if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[1048000:1050000]) {
+			t.Errorf("request %d: got %d with %d bytes", i+1, rec.Code, rec.Body.Len())
+		}
+	}
+	if dc.hits == 0 {
+		t.Error("expected the chunks to be read from the cache")
+	}
+}
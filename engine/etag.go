@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xyproto/datablock"
+)
+
+// contentSum returns the hex encoded start of the SHA-256 hash of the data
+func contentSum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// entityTag returns a strong ETag for data with the given contentSum, when
+// sent with the given content coding. Each content coding is a different
+// representation, with an ETag of its own.
+func entityTag(sum, encoding string) string {
+	if encoding == encodingIdentity {
+		return `"` + sum + `"`
+	}
+	return `"` + sum + "-" + encoding + `"`
+}
+
+// fileSum is the contentSum of a file with the given modification time and size
+type fileSum struct {
+	modTime time.Time
+	size    int64
+	sum     string
+}
+
+// fileContentSum returns the contentSum of a file that has been read into a
+// data block. The sums are kept, so that files are only hashed again when
+// they have changed, or when the cache has been cleared.
+func (ac *Config) fileContentSum(filename string, info os.FileInfo, block *datablock.DataBlock) (string, error) {
+	if v, ok := ac.fileSums.Load(filename); ok {
+		if fs := v.(fileSum); fs.modTime.Equal(info.ModTime()) && fs.size == info.Size() {
+			return fs.sum, nil
+		}
+	}
+	data, _, err := block.UncompressedData()
+	if err != nil {
+		return "", err
+	}
+	sum := contentSum(data)
+	ac.fileSums.Store(filename, fileSum{modTime: info.ModTime(), size: info.Size(), sum: sum})
+	return sum, nil
+}
+
+// serveFileBlock sends a file that has been read into a data block to a HTTP
+// client, with the ETag and Last-Modified headers. If info is nil, the file
+// is stat'ed here.
+func (ac *Config) serveFileBlock(w http.ResponseWriter, req *http.Request, filename string, info os.FileInfo, block *datablock.DataBlock) {
+	if ac.minifies(w.Header().Get(contentType), filename) {
+		ac.serveMinifiedFile(w, req, filename, block)
+		return
+	}
+	if info == nil {
+		var err error
+		if info, err = os.Stat(filename); err != nil {
+			ac.DataBlockToClient(w, req, filename, block)
+			return
+		}
+	}
+	sum, err := ac.fileContentSum(filename, info, block)
+	if err != nil {
+		logrus.Error("Could not serve " + filename + ": " + err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	ac.serveDataBlock(w, req, filename, info.ModTime(), sum, block)
+}
@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xyproto/algernon/cachemode"
+	"github.com/xyproto/datablock"
+	"github.com/xyproto/mime"
+)
+
+func TestConditionalFileRequests(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "readme.txt")
+	if err := os.WriteFile(filename, []byte(strings.Repeat("Hello, World!\n", 500)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filename, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	ac := &Config{
+		cache:         datablock.NewFileCache(1<<20, true, 0, true, 0),
+		cacheMode:     cachemode.On,
+		mimereader:    mime.New("/etc/mime.types", true),
+		largeFileSize: 1 << 20,
+	}
+	get := func(header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/readme.txt", nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		ac.FilePage(rec, req, filename, "")
+		return rec
+	}
+
+	rec := get("Accept-Encoding", "identity")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("got %d with the ETag %q", rec.Code, etag)
+	}
+	if got := rec.Header().Get("Last-Modified"); got != modified.Format(http.TimeFormat) {
+		t.Errorf("got Last-Modified %q", got)
+	}
+	if rec := get("Accept-Encoding", "identity", "If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: got %d, want 304", rec.Code)
+	}
+	if rec := get("Accept-Encoding", "identity", "If-Modified-Since", modified.Format(http.TimeFormat)); rec.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: got %d, want 304", rec.Code)
+	}
+	// The gzip variant, that is sent as it is stored in the file cache, has an ETag of its own
+	rec = get("Accept-Encoding", "gzip")
+	if gzipTag := rec.Header().Get("ETag"); rec.Header().Get("Content-Encoding") != "gzip" || gzipTag == etag {
+		t.Errorf("got the ETag %q for %q", gzipTag, rec.Header().Get("Content-Encoding"))
+	}
+	if rec := get("Accept-Encoding", "gzip", "If-None-Match", etag); rec.Code != http.StatusOK {
+		t.Errorf("If-None-Match with the ETag of another encoding: got %d, want 200", rec.Code)
+	}
+
+	// Changed files get a new ETag
+	if err := os.WriteFile(filename, []byte(strings.Repeat("Changed\n", 500)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ac.ClearCache()
+	if rec := get("Accept-Encoding", "identity", "If-None-Match", etag); rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("after changing the file: got %d with the ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestRenderedETag(t *testing.T) {
+	ac := &Config{}
+	serve := func(data, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/index.md", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		ac.DataToClient(rec, req, "index.md", []byte(data))
+		return rec
+	}
+	etag := serve("<h1>Hi</h1>", "").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag")
+	}
+	if rec := serve("<h1>Hi</h1>", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("got %d, want 304", rec.Code)
+	}
+	if rec := serve("<h1>Hello</h1>", etag); rec.Code != http.StatusOK {
+		t.Errorf("got %d for other content, want 200", rec.Code)
+	}
+}
+
+func TestRenderedPageCache(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "index.md")
+	if err := os.WriteFile(filename, []byte("# Hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filename, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	ac := &Config{
+		cache:         datablock.NewFileCache(1<<20, true, 0, true, 0),
+		cacheMode:     cachemode.On,
+		fs:            datablock.NewFileStat(true, time.Minute),
+		mimereader:    mime.New("/etc/mime.types", true),
+		largeFileSize: 1 << 20,
+	}
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		ac.FilePage(rec, httptest.NewRequest(http.MethodGet, "/index.md", nil), filename, "")
+		return rec
+	}
+
+	rec := get()
+	if got := rec.Header().Get("Last-Modified"); got != modified.Format(http.TimeFormat) {
+		t.Errorf("got Last-Modified %q, want the modification time of the source", got)
+	}
+	v, ok := ac.renderedPages.Load(filename)
+	if !ok {
+		t.Fatal("expected the rendered page to be kept")
+	}
+	if page := v.(renderedPage); rec.Header().Get("ETag") != entityTag(page.sum, encodingIdentity) {
+		t.Errorf("got the ETag %q, want the one for the kept sum %q", rec.Header().Get("ETag"), page.sum)
+	}
+
+	// The kept output is sent while the source file is unchanged
+	ac.renderedPages.Store(filename, renderedPage{modTime: modified, size: int64(len("# Hello\n")), data: []byte("kept"), sum: contentSum([]byte("kept"))})
+	if rec := get(); rec.Body.String() != "kept" {
+		t.Errorf("got %q, want the kept output", rec.Body.String())
+	}
+	// And rendered again when the source file has changed
+	if err := os.Chtimes(filename, modified.Add(time.Hour), modified.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(); !strings.Contains(rec.Body.String(), "Hello") {
+		t.Errorf("got %q, want the page to be rendered again", rec.Body.String())
+	}
+}
@@ -0,0 +1,440 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/utils"
+)
+
+// FastCGI record types and roles, from the FastCGI specification
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+	fcgiMaxContent   = 65535
+	fcgiRequestID    = 1 // there is only one request per connection
+)
+
+// fcgiDialTimeout is how long to wait for the FastCGI server to accept a connection
+const fcgiDialTimeout = 10 * time.Second
+
+// FastCGI holds which path prefix (like "/legacy") should be served by which
+// FastCGI server (like "unix:/run/php-fpm.sock"), and where the scripts are
+// found on the FastCGI server
+type FastCGI struct {
+	PathPrefix string
+	Network    string // "unix" or "tcp"
+	Address    string
+	Root       string // the document root, both here and on the FastCGI server
+	Index      string // the script to use for directories, like "index.php"
+	ServerName string // for SERVER_SOFTWARE
+	PHP        bool   // also serve .php files in the served directories
+}
+
+// FastCGIConfig holds several "path prefix --> FastCGI server" FastCGI structs,
+// together with structures that speeds up the prefix matching
+type FastCGIConfig struct {
+	fcgiMatcher utils.PrefixMatch
+	prefix2fcgi map[string]int
+	php         *FastCGI // for .php files in the served directories, if any
+	FastCGIs    []FastCGI
+}
+
+// NewFastCGIConfig creates a new and empty FastCGIConfig struct
+func NewFastCGIConfig() *FastCGIConfig {
+	return &FastCGIConfig{}
+}
+
+// ParseFastCGIAddress parses addresses like "unix:/run/php-fpm.sock",
+// "tcp://127.0.0.1:9000" or "127.0.0.1:9000" into a network and an address
+func ParseFastCGIAddress(s string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(s, "unix:"):
+		socketPath := strings.TrimPrefix(strings.TrimPrefix(s, "unix:"), "//")
+		if socketPath == "" {
+			return "", "", errors.New("no socket path given in " + s)
+		}
+		return "unix", socketPath, nil
+	case strings.HasPrefix(s, "tcp://"):
+		s = strings.TrimPrefix(s, "tcp://")
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return "", "", err
+	}
+	return "tcp", s, nil
+}
+
+// Add can add a FastCGI struct and will also (re-)initialize the internal matcher
+func (fc *FastCGIConfig) Add(fcgi *FastCGI) {
+	fc.FastCGIs = append(fc.FastCGIs, *fcgi)
+	fc.Init()
+}
+
+// Init prepares the fcgiMatcher and prefix2fcgi fields according to the FastCGI structs
+func (fc *FastCGIConfig) Init() {
+	keys := make([]string, 0, len(fc.FastCGIs))
+	fc.prefix2fcgi = make(map[string]int)
+	fc.php = nil
+	for i := range fc.FastCGIs {
+		fcgi := &fc.FastCGIs[i]
+		if fcgi.PHP && fc.php == nil {
+			fc.php = fcgi
+		}
+		if fcgi.PathPrefix == "" {
+			continue // only for .php files
+		}
+		keys = append(keys, fcgi.PathPrefix)
+		fc.prefix2fcgi[fcgi.PathPrefix] = i
+	}
+	fc.fcgiMatcher.Build(keys)
+}
+
+// FindMatchingFastCGI checks if the given URL path should be served by a FastCGI server
+func (fc *FastCGIConfig) FindMatchingFastCGI(urlPath string) *FastCGI {
+	var match *FastCGI
+	maxlen := 0
+	for _, prefix := range fc.fcgiMatcher.Match(urlPath) {
+		if len(prefix) > maxlen {
+			maxlen = len(prefix)
+			match = &fc.FastCGIs[fc.prefix2fcgi[prefix]]
+		}
+	}
+	return match
+}
+
+// PHP returns the FastCGI server for .php files in the served directories, or nil
+func (fc *FastCGIConfig) PHP() *FastCGI {
+	return fc.php
+}
+
+// splitScriptPath splits a path like "/index.php/users/1" into the script,
+// "/index.php", and the path info, "/users/1". Paths without a script name
+// are given the index script.
+func (fcgi *FastCGI) splitScriptPath(p string) (string, string) {
+	index := fcgi.Index
+	if index == "" {
+		index = "index.php"
+	}
+	ext := path.Ext(index)
+	if i := strings.Index(p, ext+"/"); i >= 0 {
+		return p[:i+len(ext)], p[i+len(ext):]
+	}
+	if strings.HasSuffix(p, ext) {
+		return p, ""
+	}
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return p + index, ""
+}
+
+// ServeHTTP sends the request to the FastCGI server. The path prefix is
+// stripped from the path, and the rest is found below Root. Scripts that do
+// not exist get 404 Not Found, so that the FastCGI server never gets to
+// guess which part of a path like "/uploads/x.jpg/y.php" is the script.
+func (fcgi *FastCGI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rel := strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(fcgi.PathPrefix, "/"))
+	if !strings.HasPrefix(rel, "/") {
+		rel = "/" + rel
+	}
+	scriptRel, pathInfo := fcgi.splitScriptPath(rel)
+	scriptFilename := path.Join(fcgi.Root, scriptRel)
+	if fi, err := os.Stat(scriptFilename); err != nil || fi.IsDir() {
+		http.NotFound(w, req)
+		return
+	}
+	prefix := strings.TrimSuffix(fcgi.PathPrefix, "/")
+	fcgi.ServeScript(w, req, scriptFilename, prefix+scriptRel, pathInfo, fcgi.Root)
+}
+
+// ServeScript sends the request to the FastCGI server, for running the
+// given script, and sends the response back to the client while it arrives
+func (fcgi *FastCGI) ServeScript(w http.ResponseWriter, req *http.Request, scriptFilename, scriptName, pathInfo, documentRoot string) {
+	params := fcgi.params(req, scriptFilename, scriptName, pathInfo, documentRoot)
+
+	// FastCGI servers like PHP-FPM need to know the length of the body
+	body := req.Body
+	if body == nil {
+		body = http.NoBody
+	}
+	if req.ContentLength < 0 {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			http.Error(w, "could not read the request body", http.StatusBadRequest)
+			return
+		}
+		body = io.NopCloser(bytes.NewReader(data))
+		params["CONTENT_LENGTH"] = strconv.Itoa(len(data))
+	}
+
+	dialer := net.Dialer{Timeout: fcgiDialTimeout}
+	conn, err := dialer.DialContext(req.Context(), fcgi.Network, fcgi.Address)
+	if err != nil {
+		fcgi.badGateway(w, err)
+		return
+	}
+	defer conn.Close()
+	// Stop waiting for the FastCGI server if the client goes away
+	stop := context.AfterFunc(req.Context(), func() {
+		conn.Close()
+	})
+	defer stop()
+
+	// Send the request while the response is being read, so that large
+	// request bodies and early responses do not block each other
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- writeFastCGIRequest(conn, params, body)
+	}()
+
+	stdout, stdoutWriter := io.Pipe()
+	go func() {
+		stdoutWriter.CloseWithError(readFastCGIResponse(conn, stdoutWriter, func(stderr []byte) {
+			logrus.Warnf("FastCGI %s: %s", scriptName, strings.TrimSpace(string(stderr)))
+		}))
+	}()
+	defer stdout.Close()
+
+	br := bufio.NewReader(stdout)
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		select {
+		case werr := <-writeErr:
+			if werr != nil {
+				err = werr
+			}
+		default:
+		}
+		fcgi.badGateway(w, err)
+		return
+	}
+	status := http.StatusOK
+	if s := header.Get("Status"); s != "" {
+		code, _, _ := strings.Cut(s, " ")
+		if status, err = strconv.Atoi(code); err != nil || status < 100 || status > 999 {
+			fcgi.badGateway(w, errors.New("invalid Status header: "+s))
+			return
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(status)
+
+	// Stream the body
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := br.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if br.Buffered() == 0 {
+				rc.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF && req.Context().Err() == nil {
+				logrus.Errorf("FastCGI %s: %v", scriptName, err)
+			}
+			return
+		}
+	}
+}
+
+// badGateway logs the error and replies with 502
+func (fcgi *FastCGI) badGateway(w http.ResponseWriter, err error) {
+	logrus.Errorf("FastCGI %s -> %s:%s: %v\nPlease check your server config for AddFastCGI calls.", fcgi.PathPrefix, fcgi.Network, fcgi.Address, err)
+	w.WriteHeader(http.StatusBadGateway)
+	w.Write([]byte("FastCGI error, please check your server config for AddFastCGI calls\n"))
+}
+
+// params returns the CGI variables for the request
+func (fcgi *FastCGI) params(req *http.Request, scriptFilename, scriptName, pathInfo, documentRoot string) map[string]string {
+	serverName, serverPort, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		serverName = req.Host
+		serverPort = "80"
+		if req.TLS != nil {
+			serverPort = "443"
+		}
+	}
+	remoteAddr, remotePort, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteAddr = req.RemoteAddr
+	}
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   fcgi.ServerName,
+		"SERVER_PROTOCOL":   req.Proto,
+		"SERVER_NAME":       serverName,
+		"SERVER_PORT":       serverPort,
+		"REQUEST_METHOD":    req.Method,
+		"REQUEST_URI":       req.URL.RequestURI(),
+		"REQUEST_SCHEME":    requestScheme(req),
+		"QUERY_STRING":      req.URL.RawQuery,
+		"DOCUMENT_ROOT":     documentRoot,
+		"DOCUMENT_URI":      scriptName + pathInfo,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   scriptFilename,
+		"PATH_INFO":         pathInfo,
+		"REMOTE_ADDR":       remoteAddr,
+		"REMOTE_PORT":       remotePort,
+		"CONTENT_TYPE":      req.Header.Get("Content-Type"),
+		"CONTENT_LENGTH":    "",
+		// Needed by PHP when cgi.force_redirect is enabled
+		"REDIRECT_STATUS": "200",
+	}
+	if req.ContentLength > 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	}
+	if pathInfo != "" {
+		params["PATH_TRANSLATED"] = path.Join(documentRoot, pathInfo)
+	}
+	if req.TLS != nil {
+		params["HTTPS"] = "on"
+	}
+	if localAddr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if host, _, err := net.SplitHostPort(localAddr.String()); err == nil {
+			params["SERVER_ADDR"] = host
+		}
+	}
+	for name, values := range req.Header {
+		switch name {
+		case "Content-Type", "Content-Length":
+			continue
+		case "Proxy":
+			continue // see https://httpoxy.org
+		}
+		params["HTTP_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))] = strings.Join(values, ", ")
+	}
+	return params
+}
+
+// writeFastCGIRecord writes one record, with the given content
+func writeFastCGIRecord(w io.Writer, recordType byte, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	header := [8]byte{fcgiVersion, recordType}
+	binary.BigEndian.PutUint16(header[2:], fcgiRequestID)
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+	header[6] = byte(padding)
+	record := make([]byte, 0, len(header)+len(content)+padding)
+	record = append(record, header[:]...)
+	record = append(record, content...)
+	record = append(record, make([]byte, padding)...)
+	_, err := w.Write(record)
+	return err
+}
+
+// writeFastCGIStream writes data as a stream of records of the given type,
+// ending with an empty record
+func writeFastCGIStream(w io.Writer, recordType byte, data []byte) error {
+	for len(data) > 0 {
+		n := min(len(data), fcgiMaxContent)
+		if err := writeFastCGIRecord(w, recordType, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return writeFastCGIRecord(w, recordType, nil)
+}
+
+// appendFastCGILength appends a name or value length, as it is encoded in a
+// name-value pair
+func appendFastCGILength(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+}
+
+// writeFastCGIRequest sends the BeginRequest record, the parameters and the
+// request body
+func writeFastCGIRequest(w io.Writer, params map[string]string, body io.Reader) error {
+	begin := []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}
+	if err := writeFastCGIRecord(w, fcgiBeginRequest, begin); err != nil {
+		return err
+	}
+	var encoded []byte
+	for name, value := range params {
+		encoded = appendFastCGILength(encoded, len(name))
+		encoded = appendFastCGILength(encoded, len(value))
+		encoded = append(encoded, name...)
+		encoded = append(encoded, value...)
+	}
+	if err := writeFastCGIStream(w, fcgiParams, encoded); err != nil {
+		return err
+	}
+	buf := make([]byte, fcgiMaxContent)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if werr := writeFastCGIRecord(w, fcgiStdin, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return writeFastCGIRecord(w, fcgiStdin, nil)
+}
+
+// readFastCGIResponse reads records until the EndRequest record, and writes
+// the stdout stream to the given writer
+func readFastCGIResponse(r io.Reader, stdout io.Writer, stderr func([]byte)) error {
+	br := bufio.NewReader(r)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		contentLength := int(binary.BigEndian.Uint16(header[4:]))
+		content := make([]byte, contentLength+int(header[6]))
+		if _, err := io.ReadFull(br, content); err != nil {
+			return err
+		}
+		content = content[:contentLength]
+		switch header[1] {
+		case fcgiStdout:
+			if _, err := stdout.Write(content); err != nil {
+				return err
+			}
+		case fcgiStderr:
+			if len(content) > 0 {
+				stderr(content)
+			}
+		case fcgiEndRequest:
+			return nil
+		}
+	}
+}
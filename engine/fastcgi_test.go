@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestFastCGI starts a FastCGI responder on a Unix socket, that replies
+// with the CGI variables it was given, for the scripts in a temporary root
+func newTestFastCGI(t *testing.T) *FastCGI {
+	t.Helper()
+	root := t.TempDir()
+	for _, name := range []string{"index.php", "tool.php", "admin/save.php", "gone.php", "uploads/x.jpg"} {
+		filename := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	socketPath := filepath.Join(t.TempDir(), "fcgi.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Skip("can not listen on a Unix socket:", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		env := fcgi.ProcessEnv(req)
+		body, _ := io.ReadAll(req.Body)
+		w.Header().Set("X-Test", "yes")
+		if env["SCRIPT_FILENAME"] == root+"/gone.php" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprintf(w, "SCRIPT_FILENAME=%s\n", env["SCRIPT_FILENAME"])
+		fmt.Fprintf(w, "QUERY_STRING=%s\n", req.URL.RawQuery)
+		fmt.Fprintf(w, "BODY=%s\n", body)
+	}))
+	network, address, err := ParseFastCGIAddress("unix:" + socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &FastCGI{PathPrefix: "/legacy", Network: network, Address: address, Root: root}
+}
+
+func TestFastCGI(t *testing.T) {
+	fc := NewFastCGIConfig()
+	server := newTestFastCGI(t)
+	fc.Add(server)
+	root := server.Root
+
+	tests := []struct {
+		method, target, body string
+		want                 []string
+	}{
+		{http.MethodGet, "/legacy/", "", []string{"SCRIPT_FILENAME=" + root + "/index.php"}},
+		{http.MethodGet, "/legacy/tool.php/users/1?x=2", "", []string{"SCRIPT_FILENAME=" + root + "/tool.php", "QUERY_STRING=x=2"}},
+		{http.MethodPost, "/legacy/admin/save.php", "a=1&b=2", []string{"SCRIPT_FILENAME=" + root + "/admin/save.php", "BODY=a=1&b=2"}},
+	}
+	for _, tt := range tests {
+		fcgi := fc.FindMatchingFastCGI(tt.target)
+		if fcgi == nil {
+			t.Fatalf("no FastCGI server found for %s", tt.target)
+		}
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		if tt.body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		rec := httptest.NewRecorder()
+		fcgi.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Test") != "yes" {
+			t.Errorf("%s %s: status %d, X-Test %q", tt.method, tt.target, rec.Code, rec.Header().Get("X-Test"))
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("%s %s: expected %q in:\n%s", tt.method, tt.target, want, rec.Body.String())
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	fc.FindMatchingFastCGI("/legacy/gone.php").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/legacy/gone.php", nil))
+	if rec.Code != http.StatusNotFound || rec.Header().Get("X-Test") != "yes" {
+		t.Errorf("status = %d, want the status from the Status header, %d", rec.Code, http.StatusNotFound)
+	}
+
+	// Scripts that do not exist are not sent to the FastCGI server
+	for _, target := range []string{"/legacy/missing.php", "/legacy/uploads/x.jpg/y.php", "/legacy/admin/"} {
+		rec := httptest.NewRecorder()
+		fc.FindMatchingFastCGI(target).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusNotFound || rec.Header().Get("X-Test") != "" {
+			t.Errorf("%s: status = %d, want %d without asking the FastCGI server", target, rec.Code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestFastCGIParams(t *testing.T) {
+	fcgi := &FastCGI{PathPrefix: "/legacy/", Root: "/srv/legacy", Index: "main.php"}
+	for _, tt := range []struct{ path, scriptName, pathInfo string }{
+		{"/legacy", "/legacy/main.php", ""},
+		{"/legacy/sub/", "/legacy/sub/main.php", ""},
+		{"/legacy/tool.php", "/legacy/tool.php", ""},
+		{"/legacy/tool.php/users/1", "/legacy/tool.php", "/users/1"},
+	} {
+		rel := strings.TrimPrefix(tt.path, "/legacy")
+		scriptRel, pathInfo := fcgi.splitScriptPath("/" + strings.TrimPrefix(rel, "/"))
+		params := fcgi.params(httptest.NewRequest(http.MethodGet, tt.path, nil), "/srv/legacy"+scriptRel, "/legacy"+scriptRel, pathInfo, fcgi.Root)
+		if params["SCRIPT_NAME"] != tt.scriptName || params["PATH_INFO"] != tt.pathInfo {
+			t.Errorf("%s: SCRIPT_NAME=%q PATH_INFO=%q, want %q and %q", tt.path, params["SCRIPT_NAME"], params["PATH_INFO"], tt.scriptName, tt.pathInfo)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/legacy/", nil)
+	req.Header.Set("Proxy", "http://evil.example")
+	req.Header.Set("X-Custom-Header", "1")
+	params := fcgi.params(req, "/srv/legacy/main.php", "/legacy/main.php", "", fcgi.Root)
+	if _, ok := params["HTTP_PROXY"]; ok {
+		t.Error("the Proxy header must not be passed on as HTTP_PROXY")
+	}
+	if params["HTTP_X_CUSTOM_HEADER"] != "1" {
+		t.Error("expected the request headers to be passed on as HTTP_ variables")
+	}
+}
+
+func TestFastCGIBadGateway(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "index.php"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fcgi := &FastCGI{PathPrefix: "/legacy", Network: "unix", Address: filepath.Join(t.TempDir(), "gone.sock"), Root: root}
+	rec := httptest.NewRecorder()
+	fcgi.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/legacy/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+}
+
+func TestParseFastCGIAddress(t *testing.T) {
+	for _, tt := range []struct{ in, network, address string }{
+		{"unix:/run/php-fpm.sock", "unix", "/run/php-fpm.sock"},
+		{"tcp://127.0.0.1:9000", "tcp", "127.0.0.1:9000"},
+		{"localhost:9000", "tcp", "localhost:9000"},
+	} {
+		network, address, err := ParseFastCGIAddress(tt.in)
+		if err != nil || network != tt.network || address != tt.address {
+			t.Errorf("%s: got %s, %s, %v", tt.in, network, address, err)
+		}
+	}
+	if _, _, err := ParseFastCGIAddress("php-fpm"); err == nil {
+		t.Error("expected an error for an address without a port")
+	}
+}
@@ -52,6 +52,8 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		serverAddDomainShort, nonInteractive bool
 		// Used when setting the cache mode
 		cacheModeString string
+		// Used when setting the file mode for Unix sockets
+		socketModeString string
 		// Used if disabling cache compression
 		rawCache bool
 		// Used if disabling the database backend
@@ -77,6 +79,7 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.StringVar(&ac.serverAddr, "addr", "", "Server [host][:port] (ie \":443\" or \"[::1]:443\")")
 	flag.StringVar(&ac.serve.httpAddr, "http-addr", "", "HTTP (non-TLS) [host][:port]")
 	flag.StringVar(&ac.serve.httpsAddr, "https-addr", "", "HTTPS (TLS) [host][:port]")
+	flag.StringVar(&socketModeString, "socketmode", "0660", "File mode for Unix sockets (ie \"unix:/run/algernon.sock\" as the address)")
 	flag.StringVar(&ac.serve.serverCert, "cert", "cert.pem", "Server certificate")
 	flag.StringVar(&ac.serve.serverKey, "key", "key.pem", "Server key")
 	flag.StringVar(&ac.redisAddr, "redis", "", "Redis [host][:port] (ie \""+ac.defaultRedisColonPort+"\")")
@@ -105,10 +108,14 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.StringVar(&ac.boltFilename, "boltdb", "", "Bolt database filename")
 	flag.Int64Var(&ac.limitRequests, "limit", ac.defaultLimit, "Limit clients to a number of requests per second")
 	flag.BoolVar(&ac.disableRateLimiting, "nolimit", false, "Disable rate limiting")
+	flag.StringVar(&ac.rateLimitStoreName, "ratelimit-store", RateLimitStoreMemory, "Where to keep the rate limits: memory or database (shared by all instances)")
 	flag.BoolVar(&ac.devMode, "dev", false, "Development mode")
 	flag.BoolVar(&ac.showVersion, "version", false, "Version")
-	flag.StringVar(&cacheModeString, "cache", "", "Cache everything but Amber, Lua, GCSS and Markdown")
+	flag.StringVar(&cacheModeString, "cache", "", "Cache mode, or where to keep the cache: memory, database, redis, bolt, sqlite, mariadb or postgres")
 	flag.Uint64Var(&ac.cacheSize, "cachesize", ac.defaultCacheSize, "Cache size, in bytes")
+	flag.DurationVar(&ac.cacheTTL, "cachettl", ac.defaultCacheTTL, "How long entries are kept when the cache is in the database, like --cache=redis")
+	flag.StringVar(&ac.diskCacheDir, "diskcache", "", "Cache chunks of large files in this directory, for instance on tmpfs")
+	flag.Uint64Var(&ac.diskCacheSize, "diskcachesize", ac.defaultDiskCacheSize, "Disk cache size, in bytes")
 	flag.Uint64Var(&ac.largeFileSize, "largesize", ac.defaultLargeFileSize, "Threshold for not reading static files into memory, in bytes")
 	flag.Uint64Var(&ac.writeTimeout, "timeout", 10, "Timeout when writing to a client, in seconds")
 	flag.BoolVar(&ac.quietMode, "quiet", false, "Quiet")
@@ -120,6 +127,8 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.StringVar(&ac.openExecutable, "open", "", "Open URL after serving, with an application")
 	flag.BoolVar(&ac.quitAfterFirstRequest, "quit", false, "Quit after the first request")
 	flag.BoolVar(&ac.noCache, "nocache", false, "Disable caching")
+	flag.BoolVar(&ac.noWatch, "nowatch", false, "Don't remove changed files from the caches by watching the served directory")
+	flag.BoolVar(&ac.minifyFlag, "minify", false, "Minify HTML, CSS, JavaScript, JSON, SVG and XML output")
 	flag.BoolVar(&ac.noHeaders, "noheaders", false, "Don't set any HTTP headers by default")
 	flag.BoolVar(&ac.stricterHeaders, "stricter", false, "Stricter HTTP headers")
 	flag.StringVar(&ac.defaultTheme, "theme", themes.DefaultTheme, "Theme for Markdown and directory listings")
@@ -132,6 +141,9 @@ func (ac *Config) handleFlags(serverTempDir string) {
 	flag.BoolVar(&ac.onlyLuaMode, "lua", false, "Only present the Lua REPL")
 	flag.StringVar(&ac.combinedAccessLogFilename, "accesslog", "", "Combined access log filename")
 	flag.StringVar(&ac.commonAccessLogFilename, "ncsa", "", "NCSA access log filename")
+	flag.StringVar(&ac.accessLogFormat, "accesslog-format", "", "Access log format: combined, common or json")
+	flag.StringVar(&ac.trustedProxyFlag, "trusted-proxy", "", "Comma separated IP addresses or CIDR ranges of proxies that may give the client IP")
+	flag.StringVar(&ac.forwardedHeader, "forwarded-header", "", "The header that trusted proxies give the client IP in: X-Forwarded-For or Forwarded")
 	flag.BoolVar(&ac.clearDefaultPathPrefixes, "clear", false, "Clear the default URI prefixes for handling permissions")
 	flag.StringVar(&ac.cookieSecret, "cookiesecret", "", "Secret to be used when setting and getting login cookies")
 	flag.BoolVar(&ac.serve.useCertMagic, "letsencrypt", false, "Use Let's Encrypt for all served domains and serve regular HTTPS")
@@ -241,6 +253,17 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		ac.redisAddr = utils.JoinHostPort(host, ac.defaultRedisColonPort)
 	}
 
+	// The cache flag can also say where the cache is kept, like --cache=redis,
+	// and then the default cache mode is used
+	if isCacheStoreName(cacheModeString) {
+		ac.cacheStoreName = cacheModeString
+		if ac.cacheStoreName == "redis" {
+			// Use Redis as the database backend, on the default host and port
+			ac.redisAddrSpecified = true
+		}
+		cacheModeString = ""
+	}
+
 	// May be overridden by devMode
 	if ac.serverMode {
 		ac.debugMode = false
@@ -323,6 +346,12 @@ func (ac *Config) handleFlags(serverTempDir string) {
 		ac.jsxOptions.MinifySyntax = false
 	}
 
+	mode, err := parseSocketMode(socketModeString)
+	if err != nil {
+		logrus.Fatalf("--socketmode: %v", err)
+	}
+	ac.serve.socketMode = mode
+
 	// The cache flag overrides the settings from the other modes
 	if cacheModeString != "" {
 		ac.cacheMode = cachemode.New(cacheModeString)
@@ -17,7 +17,7 @@ func (ac *Config) Lua2funcMap(w http.ResponseWriter, req *http.Request, filename
 	funcs := make(template.FuncMap)
 
 	// Try reading data.lua, if possible
-	luablock, err := ac.cache.Read(luafilename, ac.shouldCache(ext))
+	luablock, err := ac.readFile(luafilename, ext)
 	if err != nil {
 		// Could not find and/or read data.lua
 		luablock = datablock.EmptyDataBlock
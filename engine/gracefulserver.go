@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -21,9 +22,14 @@ type GracefulServer struct {
 	// ShutdownInitiated is called when a shutdown has been initiated, if set
 	ShutdownInitiated func()
 	// Timeout is how long the ongoing requests are given to finish
-	Timeout     time.Duration
-	signalsOnce sync.Once
-	interrupted atomic.Bool
+	Timeout time.Duration
+	// SocketMode is the file mode for the socket, if Addr is a Unix socket,
+	// as in "unix:/run/algernon.sock"
+	SocketMode os.FileMode
+	// WrapListener wraps the listener before serving, if set
+	WrapListener func(net.Listener) net.Listener
+	signalsOnce  sync.Once
+	interrupted  atomic.Bool
 }
 
 // Interrupted returns true if the server was stopped by a signal
@@ -69,16 +75,49 @@ func (gs *GracefulServer) stop() {
 	}
 }
 
+// listen listens on Addr, which can be a Unix socket, or on the given
+// default address if Addr is empty
+func (gs *GracefulServer) listen(defaultAddr string) (net.Listener, error) {
+	var (
+		l   net.Listener
+		err error
+	)
+	if socketPath, ok := unixSocketPath(gs.Addr); ok {
+		l, err = listenUnix(socketPath, gs.SocketMode)
+	} else {
+		addr := gs.Addr
+		if addr == "" {
+			addr = defaultAddr
+		}
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if gs.WrapListener != nil {
+		l = gs.WrapListener(l)
+	}
+	return l, nil
+}
+
 // ListenAndServe serves HTTP until the server is stopped
 func (gs *GracefulServer) ListenAndServe() error {
 	gs.watchSignals()
-	return ignoreServerClosed(gs.Server.ListenAndServe())
+	l, err := gs.listen(":http")
+	if err != nil {
+		return err
+	}
+	return ignoreServerClosed(gs.Server.Serve(l))
 }
 
 // ListenAndServeTLS serves HTTPS, given a certificate and key file
 func (gs *GracefulServer) ListenAndServeTLS(certFile, keyFile string) error {
 	gs.watchSignals()
-	return ignoreServerClosed(gs.Server.ListenAndServeTLS(certFile, keyFile))
+	l, err := gs.listen(":https")
+	if err != nil {
+		return err
+	}
+	return ignoreServerClosed(gs.Server.ServeTLS(l, certFile, keyFile))
 }
 
 // ListenAndServeTLSConfig serves HTTPS, given a TLS configuration.
@@ -86,7 +125,7 @@ func (gs *GracefulServer) ListenAndServeTLS(certFile, keyFile string) error {
 func (gs *GracefulServer) ListenAndServeTLSConfig(tlsConfig *tls.Config) error {
 	gs.watchSignals()
 	gs.Server.TLSConfig = tlsConfig
-	return ignoreServerClosed(gs.Server.ListenAndServeTLS("", ""))
+	return gs.ListenAndServeTLS("", "")
 }
 
 // ignoreServerClosed returns nil if the server was stopped on purpose
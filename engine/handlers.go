@@ -12,19 +12,17 @@ import (
 	"strings"
 	"time"
 
-	"github.com/didip/tollbooth"
 	"github.com/sirupsen/logrus"
 	"github.com/xyproto/algernon/themes"
 	"github.com/xyproto/algernon/utils"
 	"github.com/xyproto/datablock"
 	"github.com/xyproto/ollamaclient/v2"
-	"github.com/xyproto/sheepcounter"
 	"github.com/xyproto/simpleform"
 	"github.com/xyproto/unzip"
 )
 
 const (
-	// Gzip content over this size
+	// Compress content over this size
 	gzipThreshold = 4096
 
 	// Used for deciding how long to wait before quitting when only serving a single file and starting a browser
@@ -37,20 +35,13 @@ const (
 
 // ClientCanGzip checks if the client supports gzip compressed responses
 func (ac *Config) ClientCanGzip(req *http.Request) bool {
-	// Curl does not use --compressed by default. This causes problems when
-	// serving gzipped contents when curl is run without --compressed!
-	// The wrong data, of the same size, will be downloaded. Beware!
-	if ac.curlSupport {
-		return strings.Contains(req.Header.Get("Accept-Encoding"), "gzip")
-	}
-	// Modern browsers support gzip
-	return true
+	return ac.acceptedEncoding(req, encodingGzip) == encodingGzip
 }
 
 // PongoHandler renders and serves a Pongo2 template
 func (ac *Config) PongoHandler(w http.ResponseWriter, req *http.Request, filename, ext string) {
 	w.Header().Add(contentType, htmlUTF8)
-	pongoblock, err := ac.cache.Read(filename, ac.shouldCache(ext))
+	pongoblock, err := ac.readFile(filename, ext)
 	if err != nil {
 		if ac.debugMode {
 			fmt.Fprintf(w, "Unable to read %s: %s", html.EscapeString(filename), html.EscapeString(err.Error()))
@@ -79,7 +70,7 @@ func (ac *Config) PongoHandler(w http.ResponseWriter, req *http.Request, filenam
 		if err != nil {
 			if ac.debugMode {
 				// Try reading luaDataFilename as well, if possible
-				luablock, luablockErr := ac.cache.Read(luafilename, ac.shouldCache(ext))
+				luablock, luablockErr := ac.readFile(luafilename, ext)
 				if luablockErr != nil {
 					// Could not find and/or read luaDataFilename
 					luablock = datablock.EmptyDataBlock
@@ -111,7 +102,7 @@ func (ac *Config) PongoHandler(w http.ResponseWriter, req *http.Request, filenam
 
 // ReadAndLogErrors tries to read a file, and logs an error if it could not be read
 func (ac *Config) ReadAndLogErrors(w http.ResponseWriter, filename, ext string) (*datablock.DataBlock, error) {
-	byteblock, err := ac.cache.Read(filename, ac.shouldCache(ext))
+	byteblock, err := ac.readFile(filename, ext)
 	if err != nil {
 		if ac.debugMode {
 			fmt.Fprintf(w, "Unable to read %s: %s", html.EscapeString(filename), html.EscapeString(err.Error()))
@@ -149,9 +140,26 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 
 	// Serve the file in different ways based on the filename extension.
 	// Simple read+render cases are handled by the Renderer registry first.
+	setHandlerType(req, "renderer")
 	if ac.dispatchRenderer(w, req, filename, ext) {
 		return
 	}
+	setHandlerType(req, "static")
+
+	// PHP scripts are run by the FastCGI server given with {php=true}, if any
+	if ext == ".php" && ac.fastCGIConfig != nil && ac.fastCGIConfig.PHP() != nil {
+		setHandlerType(req, "fastcgi")
+		documentRoot, err := filepath.Abs(ac.serverDirOrFilename)
+		if err != nil {
+			documentRoot = ac.serverDirOrFilename
+		}
+		absFilename, err := filepath.Abs(filename)
+		if err != nil {
+			absFilename = filename
+		}
+		ac.fastCGIConfig.PHP().ServeScript(w, req, absFilename, req.URL.Path, "", documentRoot)
+		return
+	}
 
 	switch ext {
 
@@ -159,6 +167,11 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 	case ".html", ".htm":
 		w.Header().Add(contentType, htmlUTF8)
 
+		// Serve a precompressed variant, like index.html.br, if there is one
+		if !ac.autoRefresh && ac.servePrecompressed(w, req, filename) {
+			return
+		}
+
 		// Read the file (possibly in compressed format, straight from the cache)
 		htmlblock, err := ac.ReadAndLogErrors(w, filename, ext)
 		if err != nil {
@@ -175,7 +188,7 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 			ac.DataToClient(w, req, filename, htmldata)
 		} else {
 			// Serve the file
-			htmlblock.ToClient(w, req, filename, ac.ClientCanGzip(req), gzipThreshold)
+			ac.serveFileBlock(w, req, filename, nil, htmlblock)
 		}
 
 		return
@@ -185,8 +198,9 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 		return
 
 	case ".frm", ".form":
+		setHandlerType(req, "renderer")
 		w.Header().Add(contentType, htmlUTF8)
-		formblock, err := ac.cache.Read(filename, ac.shouldCache(ext))
+		formblock, err := ac.readFile(filename, ext)
 		if err != nil {
 			return
 		}
@@ -200,6 +214,7 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 		return
 
 	case ".amber", ".amb":
+		setHandlerType(req, "renderer")
 		w.Header().Add(contentType, htmlUTF8)
 		amberblock, err := ac.ReadAndLogErrors(w, filename, ext)
 		if err != nil {
@@ -208,7 +223,7 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 
 		// Try reading luaDataFilename as well, if possible
 		luafilename := filepath.Join(filepath.Dir(filename), luaDataFilename)
-		luablock, err := ac.cache.Read(luafilename, ac.shouldCache(ext))
+		luablock, err := ac.readFile(luafilename, ext)
 		if err != nil {
 			// Could not find and/or read luaDataFilename
 			luablock = datablock.EmptyDataBlock
@@ -249,6 +264,7 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 		return
 
 	case ".po2", ".pongo2", ".tpl", ".tmpl":
+		setHandlerType(req, "renderer")
 		ac.PongoHandler(w, req, filename, ext)
 		return
 
@@ -278,6 +294,11 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 		return
 
 	case ".lua", ".tl":
+		setHandlerType(req, "lua")
+		// Compress the output, if the client accepts it and there is enough of it
+		cw := ac.newCompressWriter(w, req)
+		defer cw.Close()
+		w = cw
 		// If in debug mode, let the Lua script print to a buffer first, in
 		// case there are errors that should be displayed instead.
 
@@ -314,7 +335,7 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 			// Run the lua script, without the possibility to flush
 			if err := ac.RunLua(recorder, req, filename, flushFunc, httpStatus); err != nil {
 				errortext := err.Error()
-				fileblock, err := ac.cache.Read(filename, ac.shouldCache(ext))
+				fileblock, err := ac.readFile(filename, ext)
 				if err != nil {
 					// If the file could not be read, use the error message as the data
 					// Use the error as the file contents when displaying the error message
@@ -365,6 +386,7 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 
 	// .prompt files contains a content type and a prompt that is converted to data in a reproducible way, with a newline between them
 	case ".prompt":
+		setHandlerType(req, "renderer")
 		if promptblock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // success
 			lines := strings.Split(promptblock.String(), "\n")
 			if (len(lines) < 4) || (strings.TrimSpace(lines[2]) != "") {
@@ -409,13 +431,13 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 		if jsblock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil {
 			jsdata := jsblock.Bytes()
 			if needsBundling(jsdata) {
-				if bundled, err := ac.bundleFile(filename, jsdata, false); err == nil {
-					ac.DataToClient(w, req, filename, bundled)
+				if bundled, sum, err := ac.bundleFile(filename, jsdata, false); err == nil {
+					ac.bundleToClient(w, req, filename, bundled, sum)
 				} else {
 					logrus.Warnf("Could not bundle %s, serving raw: %v", filename, err)
 					ac.DataToClient(w, req, filename, jsdata)
 				}
-			} else {
+			} else if !ac.servePrecompressed(w, req, filename) {
 				ac.DataToClient(w, req, filename, jsdata)
 			}
 		}
@@ -455,6 +477,11 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 
 	// TODO: Modify ac.fs to also cache .Size(), .Name() and .ModTime()
 
+	// Serve a precompressed variant, like app.wasm.gz, if there is one
+	if ac.servePrecompressed(w, req, filename) {
+		return
+	}
+
 	// Check the size of the file
 	f, err := os.Open(filename)
 	if err != nil {
@@ -477,6 +504,13 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 		// http.ServeContent will first seek to the end of the file, then
 		// serve the file. The alternative here is to use io.Copy(w, f),
 		// but io.Copy does not support ranges.
+		if ac.diskCache != nil {
+			// Read the file in chunks, through the disk cache
+			r := ac.diskCache.newReader(filename, f, fInfo)
+			defer r.Close()
+			http.ServeContent(w, req, fInfo.Name(), fInfo.ModTime(), r)
+			return
+		}
 		http.ServeContent(w, req, fInfo.Name(), fInfo.ModTime(), f)
 
 		return
@@ -485,9 +519,9 @@ func (ac *Config) FilePage(w http.ResponseWriter, req *http.Request, filename, l
 	// Read the file (possibly in compressed format, straight from the cache)
 	if dataBlock, err := ac.ReadAndLogErrors(w, filename, ext); err == nil { // success
 		// Serve the file
-		dataBlock.ToClient(w, req, filename, ac.ClientCanGzip(req), gzipThreshold)
+		ac.serveFileBlock(w, req, filename, fInfo, dataBlock)
 	} else {
-		logrus.Error("Could not serve " + filename + " with datablock.ToClient: " + err.Error())
+		logrus.Error("Could not serve " + filename + ": " + err.Error())
 		return
 	}
 }
@@ -539,9 +573,19 @@ func (ac *Config) RegisterHandlers(mux *http.ServeMux, handlePath, servedir stri
 		//logrus.Infoln("Checking reverse proxy", urlpath, ac.reverseProxyConfig)
 		if ac.reverseProxyConfig != nil {
 			if rproxy := ac.reverseProxyConfig.FindMatchingReverseProxy(urlpath); rproxy != nil {
-				pr := &proxyRecorder{ResponseWriter: w}
-				rproxy.ServeHTTP(pr, req)
-				ac.LogAccess(req, pr.status, pr.written)
+				setHandlerType(req, "proxy")
+				// Responses that the upstream did not compress, and did not
+				// stream, are compressed like other responses
+				cw := ac.newCompressWriter(w, req)
+				defer cw.Close()
+				rproxy.ServeHTTP(cw, req)
+				return
+			}
+		}
+		if ac.fastCGIConfig != nil {
+			if fcgi := ac.fastCGIConfig.FindMatchingFastCGI(urlpath); fcgi != nil {
+				setHandlerType(req, "fastcgi")
+				fcgi.ServeHTTP(w, req)
 				return
 			}
 		}
@@ -557,7 +601,6 @@ func (ac *Config) RegisterHandlers(mux *http.ServeMux, handlePath, servedir stri
 				}
 				if strings.HasPrefix(seg, ".") && seg != ".well-known" {
 					w.WriteHeader(http.StatusNotFound)
-					ac.LogAccess(req, http.StatusNotFound, 0)
 					return
 				}
 			}
@@ -579,36 +622,18 @@ func (ac *Config) RegisterHandlers(mux *http.ServeMux, handlePath, servedir stri
 
 		// Share the directory or file
 		if hasdir {
-			// Prepare to count bytes written
-			sc := sheepcounter.New(w)
 			// Get the directory page
-			ac.DirPage(sc, req, servedir, dirname, theme, defaultLuaDataFilename)
-			// Log the access
-			ac.LogAccess(req, http.StatusOK, sc.Counter())
+			ac.DirPage(w, req, servedir, dirname, theme, defaultLuaDataFilename)
 			return
 		} else if !hasdir && hasfile {
-			// Prepare to count bytes written
-			sc := sheepcounter.New(w)
 			// Share a single file instead of a directory
-			ac.FilePage(sc, req, noslash, defaultLuaDataFilename)
-			// Log the access
-			ac.LogAccess(req, http.StatusOK, sc.Counter())
+			ac.FilePage(w, req, noslash, defaultLuaDataFilename)
 			return
 		}
 		// Not found
 		w.WriteHeader(http.StatusNotFound)
-		data := themes.NoPage(filename, theme)
-		ac.LogAccess(req, http.StatusNotFound, int64(len(data)))
-		w.Write(data)
+		w.Write(themes.NoPage(filename, theme))
 	}
 
-	// Handle requests differently depending on rate limiting being enabled or not
-	if ac.disableRateLimiting {
-		mux.HandleFunc(handlePath, allRequests)
-	} else {
-		limiter := tollbooth.NewLimiter(float64(ac.limitRequests), nil)
-		limiter.SetMessage(themes.MessagePage("Rate-limit exceeded", "<div style='color:red'>You have reached the maximum request limit.</div>", theme))
-		limiter.SetMessageContentType(htmlUTF8)
-		mux.Handle(handlePath, tollbooth.LimitFuncHandler(limiter, allRequests))
-	}
+	ac.handleLimited(mux, handlePath, allRequests, theme)
 }
@@ -99,8 +99,38 @@ DenyHandler(function)
 // Direct the logging to the given filename. If the filename is an empty
 // string, direct logging to stderr. Returns true if successful.
 LogTo(string) -> bool
-// Add a reverse proxy given a path prefix and an endpoint URL
-AddReverseProxy(string, string)
+// Set the format of the --accesslog file: "combined", "common" or "json".
+SetAccessLogFormat(string) -> bool
+// Set the IP addresses or CIDR ranges of the proxies that may give the
+// client IP in X-Forwarded-For or Forwarded, like {"10.0.0.0/8"}.
+SetTrustedProxies(table) -> bool
+// Set the header that the trusted proxies give the client IP in:
+// "X-Forwarded-For" (the default) or "Forwarded".
+SetForwardedHeader(string) -> bool
+// Set a rate limit for a path prefix, given a table with the keys rps, burst
+// and by ("ip", "user" or "header:X-API-Key").
+SetRateLimit(string, table) -> bool
+// Set the Cache-Control header for a file extension, like ".css", or a path
+// prefix, like "/static/". Prefixes are used before extensions.
+SetCacheControl(string, string) -> bool
+// Minify the given types of output, like {html=true, css=true, js=true}.
+// The types are html, css, js, json, svg and xml. true selects all of them.
+SetMinify(table) -> bool
+// Set which files are cached, with a list of rules like
+// {glob="/static/**", cache=true, ttl="1h", maxsize=1048576} or
+// {ext=".lua", cache=false} or {binary=true}. The first matching rule is used.
+SetCacheRules(table) -> bool
+// Add a reverse proxy given a path prefix and an endpoint URL, like
+// "http://localhost:8080" or "unix:/run/app.sock", or a table of
+// endpoint URLs to load balance between. The optional table can have the keys
+// policy ("round_robin", "least_conn", "ip_hash" or "cookie_hash"), cookie,
+// health, interval, timeout, max_fails, fail_timeout, cache and the request,
+// response and body functions, for changing the headers and HTML bodies.
+AddReverseProxy(string, string or table[, table])
+// Add a FastCGI server given a path prefix and an address, like
+// "unix:/run/php-fpm.sock". The optional table can have the keys root,
+// index and php, for also running .php files in the served directories.
+AddFastCGI(string, string[, table])
 
 Output
 
@@ -541,6 +571,10 @@ print(...)
 print_nonl(...)
 // Return the requested URL path.
 urlpath() -> string
+// Return the value of a wildcard in the handle() pattern, like "id" for "/users/{id}".
+param(string) -> string
+// Return all the wildcards in the handle() pattern, as a table.
+params() -> table
 // Return the remote address ("host:port") of the connected client.
 remoteaddr() -> string
 // Return the HTTP header in the request, for a given key, or an empty string.
@@ -615,6 +649,10 @@ SetDirBaseURL(string)
 // Configure listeners with full control over protocol, port and TLS.
 // Takes a table of tables: SetPorts{{":8080","http",false},{":8443","http2",true}}
 // Valid protocols: "http", "http2", "http3" (or "quic"), "event"
+// The address can be a Unix socket, like "unix:/run/algernon.sock".
+// With proxyprotocol=true, a PROXY protocol header (v1 or v2) is expected
+// at the start of every connection from the trusted proxies, for getting
+// the client address. SetTrustedProxies or --trusted-proxy is then needed.
 SetPorts(table)
 // Reset the URL prefixes and make everything *public*.
 ClearPermissions()
@@ -624,9 +662,29 @@ AddAdminPrefix(string)
 AddUserPrefix(string)
 // Provide a lua function that will be used as the permission denied handler.
 DenyHandler(function)
+// Redirect requests that match a regular expression to a target that may
+// refer to captures, like "$1". The status code is optional (301 by default).
+Redirect(string, string[, number])
+// Serve requests that match a regular expression as if they were for the target.
+Rewrite(string, string)
+// Redirect to the same URL, but with a host prefix replaced, like "www." with "".
+RewritePrefix(string, string[, number])
+// Redirect requests for a host ("*" for all) and port to another port.
+RewritePort(string, number, number[, number])
 // Provide a lua function that will be run once,
 // when the server is ready to start serving.
 OnReady(function)
+// Set how many WebSocket connections and event streams can be open at the
+// same time (default 256).
+SetStreamLimit(number)
+// Let pages from other origins, like "https://example.com", open WebSocket
+// connections. "*" allows all origins. By default, only the same origin may.
+SetWebSocketOrigins(string...)
+// Provide lua functions that wrap every request. The first runs before
+// the request is handled, and answers it right away by writing to it.
+// The optional second one runs after, and is given the status code and
+// the number of bytes written.
+use(function[, function])
 // Use a Lua file for setting up HTTP handlers instead of using the directory structure.
 ServerFile(string) -> bool
 // Get the cookie secret from the server configuration.
@@ -665,7 +723,8 @@ Available flags:
   -b, --bolt                   Use "` + ac.defaultBoltFilename + `"
                                for the Bolt database.
   -c, --statcache              Speed up responses by caching os.Stat.
-                               Only use if served files will not be removed.
+                               Changes are picked up by watching the
+                               served directory, unless --nowatch is given.
   -d, --debug                  Enable debug mode (show errors in the browser).
   -e, --dev                    Development mode: Enables Debug mode, uses
                                regular HTTP, Bolt and sets cache mode "dev".
@@ -691,6 +750,7 @@ Available flags:
   -V, --verbose                Slightly more verbose logging.
   -z, --quit                   Quit after the first request has been served.
   --accesslog=FILENAME         Access log filename. Logged in Combined Log Format (CLF).
+  --accesslog-format=FORMAT    Format for the --accesslog file: "combined", "common" or "json".
   --addr=[HOST][:PORT]         Server host and port ("` + ac.defaultWebColonPort + `" is default).
                                IPv6 example: --addr='[::1]:3000'
   --boltdb=FILENAME            Use a specific file for the Bolt database
@@ -702,7 +762,13 @@ Available flags:
                                "small"   - Like "prod", but only files <= 64KB.
                                "images"  - Only images (png, jpg, gif, svg).
                                "off"     - Disable caching.
+                               "database", "redis", "bolt", "sqlite", "mariadb"
+                               or "postgres" - Cache everything, in the database
+                               backend, so that the cache is shared by all
+                               instances that use it, and kept at restarts.
   --cachesize=N                Set the total cache size, in bytes.
+  --cachettl=DURATION          How long entries are kept in the database, when the
+                               cache is there (the default is "1h").
   --cert=FILENAME              TLS certificate, if using HTTPS.
   --conf=FILENAME              Lua script with additional configuration.
   --clear                      Clear the default URI prefixes that are used
@@ -711,12 +777,17 @@ Available flags:
   --ctrld                      Press ctrl-d twice to exit the REPL.
   --dbindex=INDEX              Redis database index (0 is default).
   --dir=DIRECTORY              Set the server directory
+  --diskcache=DIRECTORY        Cache chunks of files that are larger than --largesize
+                               in this directory, for instance on tmpfs.
+  --diskcachesize=N            Disk cache size, in bytes (the default is 1 GiB).
   --eventrefresh=DURATION      How often the event server should refresh
                                (the default is "` + ac.defaultEventRefresh + `").
   --eventserver=[HOST][:PORT]  SSE server address (for filesystem changes).
   --http2only                  Serve HTTP/2, without HTTPS.
   --http-addr=[HOST][:PORT]    HTTP (non-TLS) listen address.
   --https-addr=[HOST][:PORT]   HTTPS (TLS) listen address.
+                               Addresses can also be Unix sockets, like
+                               "unix:/run/algernon.sock".
   --internal=FILENAME          Internal log file (can be a bit verbose).
   --key=FILENAME               TLS key, if using HTTPS.
   --largesize=N                Threshold for not reading static files into memory, in bytes.
@@ -729,23 +800,34 @@ Available flags:
   --log=FILENAME               Log to a file instead of to the console.
   --maria=DSN                  Use the given MariaDB or MySQL host/database.
   --mariadb=NAME               Use the given MariaDB or MySQL database name.
+  --minify                     Minify HTML, CSS, JavaScript, JSON, SVG and XML output.
   --ncsa=FILENAME              Alternative access log filename. Logged in Common Log Format (NCSA).
   --nocache                    Another way to disable the caching.
+  --nowatch                    Don't watch the served directory for changes
+                               to files that are cached.
   --nodb                       No database backend. (same as --boltdb=` + os.DevNull + `).
   --noheaders                  Don't use the security-related HTTP headers.
   --nolimit                    Disable rate limiting.
+  --ratelimit-store=STORE      Keep the rate limits in "memory" (the default) or in the
+                               "database", to share them between several instances.
+                               Only Redis is supported.
   --postgres=DSN               Use the given PostgreSQL host/database.
   --postgresdb=NAME            Use the given PostgreSQL database name.
   --sqlite=FILENAME            Use the given SQLite file (ie. "sqlite.db&cache=shared&mode=memory").
   --redis=[HOST][:PORT]        Use "` + ac.defaultRedisColonPort + `" for the Redis database.
   --rawcache                   Disable cache compression.
   --servername=STRING          Custom HTTP header value for the Server field.
+  --socketmode=MODE            File mode for Unix sockets (the default is 0660).
   --stricter                   Stricter HTTP headers (same origin policy).
   --theme=NAME                 Builtin theme to use for Markdown, error pages,
                                directory listings and HyperApp apps.
                                Possible values are: light, dark, bw, redbox, wing,
                                material, neon, werc or setconf.
   --timeout=N                  Timeout when serving files, in seconds.
+  --trusted-proxy=LIST         Comma separated IP addresses or CIDR ranges of proxies
+                               that may give the client IP in X-Forwarded-For or Forwarded.
+  --forwarded-header=NAME      The header that the trusted proxies give the client IP in:
+                               X-Forwarded-For (the default) or Forwarded.
   --watchdir=DIRECTORY         Enables auto-refresh for only this directory.
   -x, --simple                 Serve as regular HTTP, enable non-interactive
                                mode and disable all features that requires
@@ -0,0 +1,198 @@
+package engine
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/xyproto/recwatch"
+)
+
+// cacheWatcher removes the files that change in the served directory from
+// the caches, as soon as they change, so that caching can be kept on while
+// files are being edited
+type cacheWatcher struct {
+	ac      *Config
+	watcher *fsnotify.Watcher
+	root    string // the served directory, as given
+	absRoot string // the served directory, as an absolute path
+	full    atomic.Bool
+}
+
+// skipWatchingDir checks if a directory below the served directory should
+// not be watched. Hidden directories and node_modules can be large, and
+// would use up the inotify watches.
+func skipWatchingDir(name string) bool {
+	return recwatch.ShouldIgnoreFile(name) || name == "node_modules"
+}
+
+// watchForChanges starts watching the given directory, and the directories
+// below it, for changes. The directories that can not be watched, for
+// instance when the limit for inotify watches is reached, are left to the
+// periodic refresh of the stat cache, and to ClearCache.
+func (ac *Config) watchForChanges(dir string) (*cacheWatcher, error) {
+	absRoot, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	cw := &cacheWatcher{ac: ac, watcher: watcher, root: dir, absRoot: absRoot}
+	if err := watcher.Add(absRoot); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	cw.addSubdirectories(absRoot)
+	go cw.run()
+	return cw, nil
+}
+
+// addSubdirectories watches the directories below the given directory
+func (cw *cacheWatcher) addSubdirectories(dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == dir {
+			return nil
+		}
+		if skipWatchingDir(d.Name()) {
+			return filepath.SkipDir
+		}
+		if err := cw.add(path); err != nil {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+}
+
+// add watches a directory. If the limit for inotify watches, or open files,
+// has been reached, a warning is logged the first time.
+func (cw *cacheWatcher) add(dir string) error {
+	if cw.full.Load() {
+		return errors.New("not watching more directories")
+	}
+	err := cw.watcher.Add(dir)
+	if err != nil && !cw.full.Swap(true) {
+		logrus.Warnf("Could not watch %s for changes: %v. Changes in the directories that are not watched are picked up when the caches are cleared or the stat cache is refreshed. On Linux, the limit can be raised with sysctl fs.inotify.max_user_watches.", dir, err)
+	}
+	return err
+}
+
+// run removes the files from the caches as the events come in, until the
+// watcher is closed
+func (cw *cacheWatcher) run() {
+	for {
+		select {
+		case event, ok := <-cw.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			cw.ac.invalidate(cw.servedPath(event.Name))
+			if event.Has(fsnotify.Create) {
+				// Watch new directories, and the directories in them
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() && !skipWatchingDir(info.Name()) {
+					if cw.add(event.Name) == nil {
+						cw.addSubdirectories(event.Name)
+					}
+				}
+			}
+		case err, ok := <-cw.watcher.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// Events have been lost, so any file may have changed
+				cw.ac.invalidateAll()
+			}
+			logrus.Warn("Watching for changes: ", err)
+		}
+	}
+}
+
+// servedPath returns the path of a file in the served directory, in the same
+// form as the filenames that are used for the cache entries
+func (cw *cacheWatcher) servedPath(path string) string {
+	rel, err := filepath.Rel(cw.absRoot, path)
+	if err != nil {
+		return path
+	}
+	return filepath.Join(cw.root, rel)
+}
+
+// Close stops watching for changes
+func (cw *cacheWatcher) Close() error {
+	return cw.watcher.Close()
+}
+
+// invalidate removes a file, or a directory and the files in it, from the
+// file cache, the stat cache, the bundle cache, the cache of parsed
+// .algernon files, the rendered pages and the content hashes for the ETags
+func (ac *Config) invalidate(path string) {
+	path = filepath.Clean(path)
+	switch c := ac.cache.(type) {
+	case nil:
+	case *memoryFileCache:
+		c.remove(path)
+	case *databaseFileCache:
+		// The files are stored with their modification time and size, and
+		// changed files are read again
+	default:
+		c.Clear()
+	}
+	if sc, ok := ac.fs.(*statCache); ok {
+		sc.remove(path)
+	}
+	if ac.bundleCache != nil && !ac.bundleCache.remove(path) {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".js", ".jsx", ".mjs", ".ts", ".tsx", ".css", ".json":
+			// The file may be imported by any of the bundles
+			ac.bundleCache.Clear()
+		}
+	}
+	if ac.dirConfCache != nil {
+		ac.dirConfCache.remove(path)
+	}
+	prefix := path + string(filepath.Separator)
+	ac.fileSums.Range(func(key, _ any) bool {
+		if filename := key.(string); filename == path || strings.HasPrefix(filename, prefix) {
+			ac.fileSums.Delete(key)
+		}
+		return true
+	})
+	// Rendered pages can also depend on the files next to the source, like style.gcss
+	dir := filepath.Dir(path)
+	ac.renderedPages.Range(func(key, _ any) bool {
+		if filename := key.(string); filename == path || strings.HasPrefix(filename, prefix) || filepath.Dir(filename) == dir {
+			ac.renderedPages.Delete(key)
+		}
+		return true
+	})
+}
+
+// invalidateAll clears the caches that invalidate clears files from
+func (ac *Config) invalidateAll() {
+	if ac.cache != nil {
+		ac.cache.Clear()
+	}
+	if sc, ok := ac.fs.(*statCache); ok {
+		sc.Clear()
+	}
+	if ac.bundleCache != nil {
+		ac.bundleCache.Clear()
+	}
+	if ac.dirConfCache != nil {
+		ac.dirConfCache.mu.Lock()
+		ac.dirConfCache.entries = make(map[string]dirConfigEntry)
+		ac.dirConfCache.mu.Unlock()
+	}
+	ac.fileSums.Clear()
+	ac.renderedPages.Clear()
+}
@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatCache(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "index.html")
+	sc := newStatCache(time.Minute)
+	if sc.Exists(filename) {
+		t.Fatal("the file should not exist yet")
+	}
+	if err := os.WriteFile(filename, []byte("hi"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if sc.Exists(filename) {
+		t.Error("expected the cached result until the path is removed")
+	}
+	sc.remove(dir)
+	if !sc.Exists(filename) || sc.IsDir(filename) || !sc.IsDir(dir) {
+		t.Error("expected the paths below the removed directory to be checked again")
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "index.html")
+	if err := os.WriteFile(filename, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ac := &Config{
+		cache:       newMemoryFileCache(1<<20, false, 0, true, 0),
+		fs:          newStatCache(time.Minute),
+		bundleCache: newBundleCache(),
+	}
+	read := func() string {
+		block, err := ac.cache.Read(filename, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(block.Bytes())
+	}
+	read()
+	ac.fs.Exists(filename)
+	ac.fileSums.Store(filename, fileSum{})
+	mdname := filepath.Join(dir, "index.md")
+	ac.renderedPages.Store(mdname, renderedPage{})
+
+	// The contents and size are changed, but not the modification time
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte("new!"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filename, info.ModTime(), info.ModTime())
+	if got := read(); got != "old" {
+		t.Fatalf("expected the cached contents, got %q", got)
+	}
+	ac.invalidate(filename)
+	if got := read(); got != "new!" {
+		t.Errorf("expected the new contents after invalidating, got %q", got)
+	}
+	if _, ok := ac.fileSums.Load(filename); ok {
+		t.Error("expected the content hash to be removed")
+	}
+	if _, ok := ac.renderedPages.Load(mdname); ok {
+		t.Error("expected the rendered pages in the same directory to be removed")
+	}
+}
+
+func TestWatchForChanges(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "sub", "index.html")
+	if err := os.Mkdir(filepath.Dir(filename), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ac := &Config{
+		cache: newMemoryFileCache(1<<20, false, 0, true, 0),
+		fs:    newStatCache(time.Minute),
+	}
+	cw, err := ac.watchForChanges(dir)
+	if err != nil {
+		t.Skip("could not watch for changes: ", err)
+	}
+	defer cw.Close()
+	if _, err := ac.cache.Read(filename, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for range 100 {
+		if block, err := ac.cache.Read(filename, true); err == nil && string(block.Bytes()) == "new" {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Error("expected the changed file to be removed from the cache")
+}
@@ -7,7 +7,6 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/xyproto/algernon/lua/jnode"
-	"github.com/xyproto/datablock"
 	lua "github.com/xyproto/gopher-lua"
 	"github.com/xyproto/jpath"
 )
@@ -207,7 +206,7 @@ func jfileJSON(L *lua.LState) int {
 }
 
 // Create a new JSON file
-func constructJFile(L *lua.LState, filename string, fperm os.FileMode, fs *datablock.FileStat) (*lua.LUserData, error) {
+func constructJFile(L *lua.LState, filename string, fperm os.FileMode, fs pathChecker) (*lua.LUserData, error) {
 	fullFilename := filename
 	// Check if the file exists
 	if !fs.Exists(fullFilename) {
@@ -14,10 +14,12 @@ import (
 	"github.com/xyproto/algernon/cachemode"
 )
 
-// bundleCacheEntry holds bundled output alongside the source file's modification time.
+// bundleCacheEntry holds bundled output alongside the source file's modification time,
+// and the contentSum of the output, for the ETag.
 type bundleCacheEntry struct {
 	modTime time.Time
 	data    []byte
+	sum     string
 }
 
 // bundleCache is an in-memory cache for esbuild-bundled JS/JSX/TS/TSX files,
@@ -41,6 +43,22 @@ func (bc *bundleCache) Clear() {
 	bc.mu.Unlock()
 }
 
+// remove removes the bundles of the given file from the bundle cache, and
+// reports whether there were any.
+func (bc *bundleCache) remove(filename string) bool {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	found := false
+	for _, key := range []string{filename, filename + "\x00reactEntry"} {
+		if _, ok := bc.entries[key]; ok {
+			delete(bc.entries, key)
+			delete(bc.hits, key)
+			found = true
+		}
+	}
+	return found
+}
+
 // needsBundling reports whether the JS/JSX/TS/TSX source requires full bundling,
 // i.e. it contains ES module import statements.
 func needsBundling(data []byte) bool {
@@ -73,10 +91,13 @@ func loaderForFile(filename string) api.Loader {
 // When reactEntry is true, the react/react-dom globals shim plugin is enabled
 // and the cache entry is kept separate from non-reactEntry builds of the same
 // file, since the two produce different output.
-func (ac *Config) bundleFile(filename string, srcData []byte, reactEntry bool) ([]byte, error) {
+//
+// The contentSum of the output is found when it enters the cache, and is
+// returned with it, or "" if the output is not cached.
+func (ac *Config) bundleFile(filename string, srcData []byte, reactEntry bool) ([]byte, string, error) {
 	info, err := os.Stat(filename)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	modTime := info.ModTime()
 
@@ -98,7 +119,7 @@ func (ac *Config) bundleFile(filename string, srcData []byte, reactEntry bool) (
 			bc.mu.Lock()
 			bc.hits[cacheKey]++
 			bc.mu.Unlock()
-			return entry.data, nil
+			return entry.data, entry.sum, nil
 		}
 	}
 
@@ -150,20 +171,23 @@ func (ac *Config) bundleFile(filename string, srcData []byte, reactEntry bool) (
 		for i, e := range result.Errors {
 			msgs[i] = e.Text
 		}
-		return nil, fmt.Errorf("bundle %s: %s", filepath.Base(filename), strings.Join(msgs, "; "))
+		return nil, "", fmt.Errorf("bundle %s: %s", filepath.Base(filename), strings.Join(msgs, "; "))
 	}
 
 	if len(result.OutputFiles) == 0 {
-		return nil, fmt.Errorf("bundle %s: no output produced", filepath.Base(filename))
+		return nil, "", fmt.Errorf("bundle %s: no output produced", filepath.Base(filename))
 	}
 
 	data := result.OutputFiles[0].Contents
 
+	// The sum is only found here for bundles that are cached
+	var sum string
 	if useCache {
+		sum = contentSum(data)
 		bc.mu.Lock()
 		if ac.cacheMaxEntitySize == 0 || uint64(len(data)) <= ac.cacheMaxEntitySize {
 			if ac.bundleCacheMaxMemory == 0 || bc.BytesUsed()+uint64(len(data)) <= ac.bundleCacheMaxMemory {
-				bc.entries[cacheKey] = bundleCacheEntry{modTime: modTime, data: data}
+				bc.entries[cacheKey] = bundleCacheEntry{modTime: modTime, data: data, sum: sum}
 				bc.hits[cacheKey] = 0
 				logrus.Debugf("bundled and cached %s (%d bytes)", filepath.Base(filename), len(data))
 			} else {
@@ -173,7 +197,7 @@ func (ac *Config) bundleFile(filename string, srcData []byte, reactEntry bool) (
 					}
 				}
 				if bc.BytesUsed()+uint64(len(data)) <= ac.bundleCacheMaxMemory {
-					bc.entries[filename] = bundleCacheEntry{modTime: modTime, data: data}
+					bc.entries[filename] = bundleCacheEntry{modTime: modTime, data: data, sum: sum}
 					bc.hits[filename] = 0
 					logrus.Debugf("bundled and cached %s (%d bytes)", filepath.Base(filename), len(data))
 				}
@@ -182,7 +206,7 @@ func (ac *Config) bundleFile(filename string, srcData []byte, reactEntry bool) (
 		bc.mu.Unlock()
 	}
 
-	return data, nil
+	return data, sum, nil
 }
 
 // BytesUsed returns the total bytes used by all entries in the bundle cache.
@@ -283,6 +283,14 @@ func (ac *Config) RunConfiguration(filename string, mux *http.ServeMux, withHand
 		if err := ac.buildHandlerPool(filename, mux); err != nil {
 			return err
 		}
+		// The use() functions get a pool of their own
+		if err := ac.buildMiddlewarePool(filename, mux); err != nil {
+			return err
+		}
+		// And so do the hooks given to AddReverseProxy
+		if err := ac.buildProxyHookPool(filename, mux); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -313,12 +321,13 @@ func (ac *Config) loadServerConfigNoopFunctions(L *lua.LState) {
 		"SetAddr", "SetHTTPAddr", "SetHTTPSAddr", "SetPorts",
 		"SetRedirect", "SetLetsEncrypt", "SetInteractive",
 		"SetDirBaseURL", "SetCookieSecret", "ClearPermissions",
-		"AddUserPrefix", "AddAdminPrefix", "AddReverseProxy",
-		"DenyHandler", "OnReady",
+		"AddUserPrefix", "AddAdminPrefix", "AddReverseProxy", "AddFastCGI",
+		"Redirect", "Rewrite", "RewritePrefix", "RewritePort",
+		"DenyHandler", "OnReady", "SetStreamLimit", "SetWebSocketOrigins",
 	} {
 		L.SetGlobal(name, noop)
 	}
-	for _, name := range []string{"LogTo", "ServerFile", "ServerDir"} {
+	for _, name := range []string{"LogTo", "ServerFile", "ServerDir", "SetAccessLogFormat", "SetTrustedProxies", "SetForwardedHeader", "SetRateLimit", "SetCacheControl", "SetMinify", "SetCacheRules"} {
 		L.SetGlobal(name, noopTrue)
 	}
 	L.SetGlobal("CookieSecret", cookieSecret)
@@ -331,6 +340,7 @@ func (ac *Config) loadServerConfigNoopFunctions(L *lua.LState) {
 func (ac *Config) loadPoolStateFunctions(L *lua.LState, filename string, mux *http.ServeMux) {
 	ac.LoadBasicSystemFunctions(L)
 	ac.loadServerConfigNoopFunctions(L)
+	loadProxyHookFunctions(L)
 
 	if ac.perm != nil {
 		userstate := ac.perm.UserState()
@@ -362,6 +372,17 @@ func (ac *Config) loadPoolStateFunctions(L *lua.LState, filename string, mux *ht
 // script in each, and enqueues them in ac.handlerPool. Every state ends up
 // with its own copy of each handle() function stored in its Lua registry.
 func (ac *Config) buildHandlerPool(filename string, mux *http.ServeMux) error {
+	pool, err := ac.newScriptPool(filename, mux)
+	if err != nil {
+		return err
+	}
+	ac.handlerPool = pool
+	return nil
+}
+
+// newScriptPool creates a pool of ac.handlerPoolSize fresh Lua states, where
+// the given script has been run in each of them
+func (ac *Config) newScriptPool(filename string, mux *http.ServeMux) (*handlerPool, error) {
 	size := max(ac.handlerPoolSize, 1)
 	pool := newHandlerPool(size)
 	for i := range size {
@@ -371,18 +392,34 @@ func (ac *Config) buildHandlerPool(filename string, mux *http.ServeMux) error {
 			L.Close()
 			if len(pool.states) == 0 {
 				// Couldn't build any usable pool state
-				return err
+				return nil, err
 			}
 			logrus.Errorf("handler pool state %d failed to initialise: %v", i, err)
 			continue
 		}
 		pool.Add(L)
 	}
-	ac.handlerPool = pool
 	AtShutdown(func() {
 		pool.Close()
 	})
-	return nil
+	return pool, nil
+}
+
+// buildStreamPool creates a pool of Lua states for WebSocket connections and
+// event streams. The states are made when they are first needed, by running
+// the script in a fresh Lua state, the same way as for ac.handlerPool.
+func (ac *Config) buildStreamPool(filename string, mux *http.ServeMux) *streamPool {
+	pool := newStreamPool(ac.maxStreams, func() (*lua.LState, error) {
+		L := lua.NewState()
+		ac.loadPoolStateFunctions(L, filename, mux)
+		if err := L.DoFile(filename); err != nil {
+			L.Close()
+			return nil, err
+		}
+		return L, nil
+	})
+	AtShutdown(pool.Close)
+	return pool
 }
 
 // isArrayLikeTable reports whether the table has sequential integer keys 1..N.
@@ -1,17 +1,42 @@
 package engine
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"path/filepath"
+	"strconv"
+	"strings"
 
-	"github.com/didip/tollbooth"
 	"github.com/sirupsen/logrus"
-	"github.com/xyproto/algernon/themes"
+	"github.com/xyproto/algernon/lua/sse"
+	"github.com/xyproto/algernon/lua/websocket"
 	lua "github.com/xyproto/gopher-lua"
 )
 
-// handleRegistryPrefix keys a handler function in a Lua state's registry
-const handleRegistryPrefix = "algernon:handle:"
+const (
+	// handleRegistryPrefix keys a handler function in a Lua state's registry
+	handleRegistryPrefix = "algernon:handle:"
+
+	// websocketRegistryPrefix keys a WebSocket handler function in a Lua state's registry
+	websocketRegistryPrefix = "algernon:websocket:"
+
+	// sseRegistryPrefix keys an event stream handler function in a Lua state's registry
+	sseRegistryPrefix = "algernon:sse:"
+)
+
+// handleLuaRoute registers a route from a Lua server script on the mux. The
+// mux panics if the pattern is invalid or conflicts with a pattern that is
+// already registered, which is returned as an error instead.
+func (ac *Config) handleLuaRoute(mux *http.ServeMux, pattern string, handlerFunc http.HandlerFunc, theme string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	ac.handleLimited(mux, pattern, handlerFunc, theme)
+	return nil
+}
 
 // LoadLuaHandlerFunctions makes functions related to handling HTTP requests
 // available to Lua scripts.
@@ -19,8 +44,13 @@ const handleRegistryPrefix = "algernon:handle:"
 // When registerRoutes is true, handle() registers the route on the mux. That
 // wrapped handler borrows a state from ac.handlerPool at request time, looks
 // up the handler function from the state's registry by path, and runs it.
+// The path may be a http.ServeMux pattern with a method and wildcards, like
+// "GET /users/{id}", and requests with a method that has no handler get 405.
 // When registerRoutes is false, handle() only stores the function in the
 // state's registry; this is the mode used while populating the pool.
+// websocket() and sse() work the same way, but borrow a state from
+// ac.streamPool, and keep it for as long as the WebSocket connection or the
+// event stream is open.
 func (ac *Config) LoadLuaHandlerFunctions(L *lua.LState, filename string, mux *http.ServeMux, addDomain bool, httpStatus *FutureStatus, theme string, registerRoutes bool) {
 	L.SetGlobal("handle", L.NewFunction(func(L *lua.LState) int {
 		handlePath := L.ToString(1)
@@ -29,24 +59,54 @@ func (ac *Config) LoadLuaHandlerFunctions(L *lua.LState, filename string, mux *h
 		// Store the function in this state's registry, keyed by path,
 		// so the request-time wrapper can fetch it from whichever pool
 		// state it happens to borrow.
-		L.G.Registry.RawSetString(handleRegistryPrefix+handlePath, handleFunc)
+		registryKey := handleRegistryPrefix + handlePath
+		L.G.Registry.RawSetString(registryKey, handleFunc)
 
 		if !registerRoutes {
 			return 0 // number of results
 		}
 
+		// Patterns like "GET /users/{id}" and "POST /users/{name}" share one
+		// route on the mux, which then picks a handler by the request method
+		method, pattern := splitMethodPattern(handlePath)
+		if ac.luaRoutes == nil {
+			ac.luaRoutes = make(map[string]*luaRoute)
+		}
+		normalized := normalizePattern(pattern)
+		route, alreadyRegistered := ac.luaRoutes[normalized]
+		if alreadyRegistered {
+			route.add(method, registryKey, pattern)
+			return 0 // number of results
+		}
+		route = newLuaRoute(pattern)
+		route.add(method, registryKey, pattern)
+
 		wrappedHandleFunc := func(w http.ResponseWriter, req *http.Request) {
+			setHandlerType(req, "lua")
+			h, ok := route.lookup(req.Method)
+			if !ok {
+				w.Header().Set("Allow", route.allow())
+				http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			route.setPathValues(req, h)
+			key := h.key
 			if ac.handlerPool == nil {
-				logrus.Error("Handler for " + handlePath + " called before the handler pool was built")
+				logrus.Error("Handler for " + pattern + " called before the handler pool was built")
 				return
 			}
 			poolL := ac.handlerPool.Get()
 			defer ac.handlerPool.Put(poolL)
 
-			fn := poolL.G.Registry.RawGetString(handleRegistryPrefix + handlePath)
+			// Compress the output, if the client accepts it and there is enough of it
+			cw := ac.newCompressWriter(w, req)
+			defer cw.Close()
+			w = cw
+
+			fn := poolL.G.Registry.RawGetString(key)
 			handlerFn, ok := fn.(*lua.LFunction)
 			if !ok {
-				logrus.Error("Handler for " + handlePath + " is missing from the pool state")
+				logrus.Error("Handler for " + strings.TrimPrefix(key, handleRegistryPrefix) + " is missing from the pool state")
 				return
 			}
 
@@ -54,7 +114,7 @@ func (ac *Config) LoadLuaHandlerFunctions(L *lua.LState, filename string, mux *h
 			poolL.Push(handlerFn)
 			if err := poolL.PCall(0, lua.MultRet, nil); err != nil {
 				// Non-fatal error
-				logrus.Error("Handler for "+handlePath+" failed:", err)
+				logrus.Error("Handler for "+strings.TrimPrefix(key, handleRegistryPrefix)+" failed:", err)
 			}
 
 			// Then exit after the first request, if specified
@@ -63,16 +123,156 @@ func (ac *Config) LoadLuaHandlerFunctions(L *lua.LState, filename string, mux *h
 			}
 		}
 
-		// Handle requests differently depending on if rate limiting is enabled or not
-		if ac.disableRateLimiting {
-			mux.HandleFunc(handlePath, wrappedHandleFunc)
-		} else {
-			limiter := tollbooth.NewLimiter(float64(ac.limitRequests), nil)
-			limiter.SetMessage(themes.MessagePage("Rate-limit exceeded", "<div style='color:red'>You have reached the maximum request limit.</div>", theme))
-			limiter.SetMessageContentType(htmlUTF8)
-			mux.Handle(handlePath, tollbooth.LimitFuncHandler(limiter, wrappedHandleFunc))
+		if err := ac.handleLuaRoute(mux, pattern, wrappedHandleFunc, theme); err != nil {
+			L.RaiseError("handle(%q): %v", handlePath, err)
+			return 0 // number of results
+		}
+		ac.luaRoutes[normalized] = route
+
+		return 0 // number of results
+	}))
+
+	L.SetGlobal("websocket", L.NewFunction(func(L *lua.LState) int {
+		handlePath := L.CheckString(1)
+		handleFunc := L.CheckFunction(2)
+
+		// Store the function the same way as handle() does
+		registryKey := websocketRegistryPrefix + handlePath
+		L.G.Registry.RawSetString(registryKey, handleFunc)
+
+		if !registerRoutes {
+			return 0 // number of results
+		}
+		if ac.streamPool == nil {
+			ac.streamPool = ac.buildStreamPool(filename, mux)
+		}
+
+		wrappedHandleFunc := func(w http.ResponseWriter, req *http.Request) {
+			setHandlerType(req, "lua")
+			// The state is taken before the handshake, so that the client can
+			// be told to come back later if all of them are in use
+			poolL, err := ac.streamPool.Get()
+			if err != nil {
+				logrus.Warn("WebSocket handler for "+handlePath+": ", err)
+				if errors.Is(err, errStreamLimit) {
+					http.Error(w, "503 service unavailable", http.StatusServiceUnavailable)
+				} else {
+					http.Error(w, "500 internal server error", http.StatusInternalServerError)
+				}
+				return
+			}
+			// The state is kept for as long as the connection is open
+			defer ac.streamPool.Put(poolL)
+
+			handlerFn, ok := poolL.G.Registry.RawGetString(registryKey).(*lua.LFunction)
+			if !ok {
+				logrus.Error("WebSocket handler for " + handlePath + " is missing from the pool state")
+				http.Error(w, "500 internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			conn, err := websocket.Upgrade(w, req, ac.websocketOrigins)
+			if err != nil {
+				logrus.Warn(err)
+				return
+			}
+			defer conn.Close(websocket.CloseNormal, "")
+
+			ac.LoadCommonFunctions(w, req, filename, poolL, nil, httpStatus)
+			websocket.Load(poolL)
+			poolL.Push(handlerFn)
+			poolL.Push(websocket.New(poolL, conn))
+			if err := poolL.PCall(1, 0, nil); err != nil {
+				// Non-fatal error
+				logrus.Error("WebSocket handler for "+handlePath+" failed:", err)
+				conn.Close(websocket.CloseInternalFailure, "")
+			}
+		}
+
+		if err := ac.handleLuaRoute(mux, handlePath, wrappedHandleFunc, theme); err != nil {
+			L.RaiseError("websocket(%q): %v", handlePath, err)
+		}
+
+		return 0 // number of results
+	}))
+
+	L.SetGlobal("sse", L.NewFunction(func(L *lua.LState) int {
+		handlePath := L.CheckString(1)
+		handleFunc := L.CheckFunction(2)
+
+		// Store the function the same way as handle() does
+		registryKey := sseRegistryPrefix + handlePath
+		L.G.Registry.RawSetString(registryKey, handleFunc)
+
+		if !registerRoutes {
+			return 0 // number of results
+		}
+		if ac.streamPool == nil {
+			ac.streamPool = ac.buildStreamPool(filename, mux)
 		}
 
+		wrappedHandleFunc := func(w http.ResponseWriter, req *http.Request) {
+			setHandlerType(req, "lua")
+			poolL, err := ac.streamPool.Get()
+			if err != nil {
+				logrus.Warn("Event stream handler for "+handlePath+": ", err)
+				if errors.Is(err, errStreamLimit) {
+					http.Error(w, "503 service unavailable", http.StatusServiceUnavailable)
+				} else {
+					http.Error(w, "500 internal server error", http.StatusInternalServerError)
+				}
+				return
+			}
+			// The state is kept for as long as the stream is open
+			defer ac.streamPool.Put(poolL)
+
+			handlerFn, ok := poolL.G.Registry.RawGetString(registryKey).(*lua.LFunction)
+			if !ok {
+				logrus.Error("Event stream handler for " + handlePath + " is missing from the pool state")
+				http.Error(w, "500 internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			stream, err := sse.Open(w, req)
+			if err != nil {
+				logrus.Error(err)
+				return
+			}
+			defer stream.Close()
+
+			ac.LoadCommonFunctions(w, req, filename, poolL, nil, httpStatus)
+			sse.Load(poolL)
+			poolL.Push(handlerFn)
+			poolL.Push(sse.New(poolL, stream))
+			if err := poolL.PCall(1, 0, nil); err != nil {
+				// Non-fatal error
+				logrus.Error("Event stream handler for "+handlePath+" failed:", err)
+			}
+		}
+
+		if err := ac.handleLuaRoute(mux, handlePath, wrappedHandleFunc, theme); err != nil {
+			L.RaiseError("sse(%q): %v", handlePath, err)
+		}
+
+		return 0 // number of results
+	}))
+
+	// The use() functions are keyed by the order they were given in
+	useCount := 0
+	L.SetGlobal("use", L.NewFunction(func(L *lua.LState) int {
+		beforeFunc := L.CheckFunction(1)
+		afterFunc := L.OptFunction(2, nil)
+		useCount++
+		var layer luaMiddlewareLayer
+		layer.before = useRegistryPrefix + strconv.Itoa(useCount)
+		L.G.Registry.RawSetString(layer.before, beforeFunc)
+		if afterFunc != nil {
+			layer.after = layer.before + ":after"
+			L.G.Registry.RawSetString(layer.after, afterFunc)
+		}
+		if registerRoutes {
+			ac.addLuaMiddleware(filename, layer)
+		}
 		return 0 // number of results
 	}))
 
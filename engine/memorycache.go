@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyproto/datablock"
+)
+
+// ruleFileCache is a fileCache that can keep each file for a given time, and
+// with a given max size, for the rules from SetCacheRules. A ttl or
+// maxEntitySize of 0 means the default for the cache. Returns true if the
+// file was read from the cache.
+type ruleFileCache interface {
+	read(filename string, ttl time.Duration, maxEntitySize uint64) (*datablock.DataBlock, bool, error)
+}
+
+type memoryFileCacheEntry struct {
+	filename string
+	block    *datablock.DataBlock
+	expires  time.Time // zero if the entry does not expire
+	elem     *list.Element
+}
+
+// memoryFileCache keeps files in memory, compressed with gzip if compression
+// is enabled, and evicts the least recently used files when it is full.
+// Unlike datablock.FileCache, the files can be kept for a limited time.
+type memoryFileCache struct {
+	entries          map[string]*memoryFileCacheEntry
+	lru              *list.List // the most recently used entry first
+	maxSize          uint64
+	used             uint64
+	maxEntitySize    uint64 // the maximum size of a file, as stored (0 for no limit)
+	maxGivenDataSize uint64 // the maximum size of a file, uncompressed (0 for no limit)
+	hits             uint64
+	misses           uint64
+	compress         bool
+	compressionSpeed bool
+	mu               sync.Mutex
+}
+
+// newMemoryFileCache creates a file cache that may use up to maxSize bytes.
+// The arguments are the same as for datablock.NewFileCache.
+func newMemoryFileCache(maxSize uint64, compress bool, maxEntitySize uint64, compressionSpeed bool, maxGivenDataSize uint64) *memoryFileCache {
+	return &memoryFileCache{
+		entries:          make(map[string]*memoryFileCacheEntry),
+		lru:              list.New(),
+		maxSize:          maxSize,
+		maxEntitySize:    maxEntitySize,
+		maxGivenDataSize: maxGivenDataSize,
+		compress:         compress,
+		compressionSpeed: compressionSpeed,
+	}
+}
+
+// Read reads a file from the cache, or from disk if it is not cached. If
+// cached is false, the file is read from disk and not stored.
+func (c *memoryFileCache) Read(filename string, cached bool) (*datablock.DataBlock, error) {
+	if !cached {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return datablock.NewDataBlock(data, c.compressionSpeed), nil
+	}
+	block, _, err := c.read(filename, 0, 0)
+	return block, err
+}
+
+func (c *memoryFileCache) read(filename string, ttl time.Duration, maxEntitySize uint64) (*datablock.DataBlock, bool, error) {
+	id := filepath.Clean(filename)
+	c.mu.Lock()
+	if e, ok := c.entries[id]; ok {
+		if e.expires.IsZero() || time.Now().Before(e.expires) {
+			c.lru.MoveToFront(e.elem)
+			c.hits++
+			c.mu.Unlock()
+			return e.block, true, nil
+		}
+		c.removeEntry(e)
+	}
+	c.misses++
+	c.mu.Unlock()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, false, err
+	}
+	c.store(id, data, ttl, maxEntitySize)
+	return datablock.NewDataBlock(data, c.compressionSpeed), false, nil
+}
+
+// store adds a file to the cache, if it is not too large, and evicts the
+// least recently used files, if needed
+func (c *memoryFileCache) store(id string, data []byte, ttl time.Duration, maxEntitySize uint64) {
+	if c.maxGivenDataSize != 0 && uint64(len(data)) > c.maxGivenDataSize {
+		return
+	}
+	block := datablock.NewDataBlock(data, c.compressionSpeed)
+	if c.compress {
+		// The block is kept uncompressed if it can not be compressed
+		block.Compress()
+	}
+	size := uint64(block.Length())
+	if maxEntitySize == 0 {
+		maxEntitySize = c.maxEntitySize
+	}
+	if (maxEntitySize != 0 && size > maxEntitySize) || size > c.maxSize {
+		return
+	}
+	e := &memoryFileCacheEntry{filename: id, block: block}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[id]; ok {
+		return
+	}
+	for c.used+size > c.maxSize {
+		c.removeEntry(c.lru.Back().Value.(*memoryFileCacheEntry))
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[id] = e
+	c.used += size
+}
+
+// removeEntry removes an entry. The mutex must be locked.
+func (c *memoryFileCache) removeEntry(e *memoryFileCacheEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.filename)
+	c.used -= uint64(e.block.Length())
+}
+
+// remove removes a file from the cache, or all files below it, if it is a
+// directory
+func (c *memoryFileCache) remove(filename string) {
+	id := filepath.Clean(filename)
+	prefix := id + string(filepath.Separator)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries {
+		if e.filename == id || strings.HasPrefix(e.filename, prefix) {
+			c.removeEntry(e)
+		}
+	}
+}
+
+// Clear removes all files from the cache
+func (c *memoryFileCache) Clear() {
+	c.mu.Lock()
+	c.entries = make(map[string]*memoryFileCacheEntry)
+	c.lru.Init()
+	c.used = 0
+	c.mu.Unlock()
+}
+
+// Stats returns information about the cache use
+func (c *memoryFileCache) Stats() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sb strings.Builder
+	sb.WriteString("Cache information:\n")
+	sb.WriteString(fmt.Sprintf("\tCompression:\t%s\n", map[bool]string{true: "enabled", false: "disabled"}[c.compress]))
+	sb.WriteString(fmt.Sprintf("\tTotal cache:\t%d bytes\n", c.maxSize))
+	sb.WriteString(fmt.Sprintf("\tFree cache:\t%d bytes\n", c.maxSize-c.used))
+	sb.WriteString(fmt.Sprintf("\tFiles:\t\t%d\n", len(c.entries)))
+	sb.WriteString(fmt.Sprintf("\tCache hits:\t%d\n", c.hits))
+	sb.WriteString(fmt.Sprintf("\tCache misses:\t%d\n", c.misses))
+	return sb.String()
+}
+
+// BytesUsed returns the number of bytes that the files use in the cache
+func (c *memoryFileCache) BytesUsed() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used
+}
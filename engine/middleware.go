@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	lua "github.com/xyproto/gopher-lua"
+)
+
+// withMiddleware wraps the given handler in the middleware that every
+// server uses, regardless of protocol
+func (ac *Config) withMiddleware(handler http.Handler) http.Handler {
+	// Cap request bodies before any handler reads them. 0 means unlimited.
+	if ac.largeFileSize > 0 {
+		handler = ac.limitBodyMiddleware(handler)
+	}
+	// Run the Lua functions given to use() around every request that is allowed
+	handler = ac.luaMiddlewareHandler(handler)
+	// Check permissions for every route, not just the ones in RegisterHandlers
+	handler = ac.permissionMiddleware(handler)
+	// Apply the rate limits for path prefixes, also to requests that are denied
+	if len(ac.rateLimits) > 0 && !ac.disableRateLimiting {
+		handler = ac.rateLimitMiddleware(handler)
+	}
+	// Set the Cache-Control header for extensions and path prefixes
+	if len(ac.cacheControls) > 0 {
+		handler = ac.cacheControlMiddleware(handler)
+	}
+	// Redirect or rewrite requests before the permissions are checked
+	handler = ac.routingMiddleware(handler)
+	// Canonicalize the request path before anything else looks at it
+	handler = canonicalPathMiddleware(handler)
+	// Log every request, also the ones that are rejected by the rate limits
+	// or the permissions, or redirected
+	if ac.commonAccessLog != nil || ac.combinedAccessLog != nil {
+		handler = ac.withAccessLog(handler.ServeHTTP)
+	}
+	// Keep track of the duration and request ID, for the JSON access log
+	if ac.accessLogFormat == accessLogJSON && ac.combinedAccessLog != nil {
+		handler = requestInfoMiddleware(handler)
+	}
+	// Let everything see the client instead of the trusted proxy in front
+	if len(ac.trustedProxies) > 0 {
+		handler = ac.realIPMiddleware(handler)
+	}
+	return handler
+}
+
+// useRegistryPrefix keys a use() function in a Lua state's registry
+const useRegistryPrefix = "algernon:use:"
+
+// luaMiddleware holds the use() functions from one Lua script, in the order
+// they were given. A request borrows one state from the pool for running the
+// functions that come before the rest of the chain, and one for running the
+// functions that come after it, if any, so that a request never waits for
+// more than one state per script at a time. The pool is separate from
+// ac.handlerPool, since the inner handler may be a handle() route that needs
+// a state of its own.
+type luaMiddleware struct {
+	filename string
+	layers   []luaMiddlewareLayer // outermost first
+	pool     *handlerPool         // nil until the script has been run
+}
+
+// luaMiddlewareLayer is the Lua registry keys of the functions from one call
+// to use(). after is "" if no function was given for after the request.
+type luaMiddlewareLayer struct {
+	before, after string
+}
+
+// addLuaMiddleware registers the functions from a call to use() in the given script
+func (ac *Config) addLuaMiddleware(filename string, layer luaMiddlewareLayer) {
+	if n := len(ac.luaMiddleware); n > 0 {
+		if mw := ac.luaMiddleware[n-1]; mw.filename == filename && mw.pool == nil {
+			mw.layers = append(mw.layers, layer)
+			return
+		}
+	}
+	ac.luaMiddleware = append(ac.luaMiddleware, &luaMiddleware{filename: filename, layers: []luaMiddlewareLayer{layer}})
+}
+
+// buildMiddlewarePool builds the pool of Lua states for the use() functions
+// that the given script has registered, if any
+func (ac *Config) buildMiddlewarePool(filename string, mux *http.ServeMux) error {
+	for _, mw := range ac.luaMiddleware {
+		if mw.filename != filename || mw.pool != nil {
+			continue
+		}
+		pool, err := ac.newScriptPool(filename, mux)
+		if err != nil {
+			return err
+		}
+		mw.pool = pool
+	}
+	return nil
+}
+
+// luaMiddlewareHandler wraps the given handler in the use() functions, with
+// the functions from the first script that was run as the outermost ones
+func (ac *Config) luaMiddlewareHandler(next http.Handler) http.Handler {
+	for i := len(ac.luaMiddleware) - 1; i >= 0; i-- {
+		next = ac.serveLuaMiddleware(ac.luaMiddleware[i], next)
+	}
+	return next
+}
+
+// serveLuaMiddleware runs the use() functions from one script. The functions
+// that come before the rest of the chain are run first, and their state is
+// returned to the pool before the rest of the chain is called, so that slow
+// responses, like downloads, WebSocket connections and event streams, do not
+// hold on to it. A function that answers the request, by writing to it or by
+// setting the status code, short-circuits the rest of the chain. The
+// functions that come after the request borrow a state again, and are given
+// the status code and the number of bytes written.
+func (ac *Config) serveLuaMiddleware(mw *luaMiddleware, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if mw.pool == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		// Record the status code, so that it can be given to the functions
+		// that come after the request
+		sr := newStatusRecorder(w)
+		ran := ac.runMiddlewareBefore(mw, sr, req)
+		if ran == len(mw.layers) && sr.status == 0 {
+			next.ServeHTTP(sr, req)
+		}
+		ac.runMiddlewareAfter(mw, sr, req, ran)
+	})
+}
+
+// runMiddlewareBefore runs the functions that come before the rest of the
+// chain, until one of them answers the request, and returns how many of the
+// layers that were run
+func (ac *Config) runMiddlewareBefore(mw *luaMiddleware, sr *statusRecorder, req *http.Request) int {
+	L := mw.pool.Get()
+	defer mw.pool.Put(L)
+	ac.LoadCommonFunctions(sr, req, mw.filename, L, nil, nil)
+	ran := 0
+	for i, layer := range mw.layers {
+		ran++
+		fn, ok := L.G.Registry.RawGetString(layer.before).(*lua.LFunction)
+		if !ok {
+			logrus.Error("Middleware " + strconv.Itoa(i+1) + " from " + mw.filename + " is missing from the pool state")
+			continue
+		}
+		L.Push(fn)
+		if err := L.PCall(0, 0, nil); err != nil {
+			// Non-fatal error
+			logrus.Error("Middleware from "+mw.filename+" failed:", err)
+			if sr.status == 0 {
+				http.Error(sr, "500 internal server error", http.StatusInternalServerError)
+			}
+		}
+		if sr.status != 0 {
+			// The request has been answered
+			break
+		}
+	}
+	return ran
+}
+
+// runMiddlewareAfter runs the functions that come after the request, for the
+// given number of layers, innermost first
+func (ac *Config) runMiddlewareAfter(mw *luaMiddleware, sr *statusRecorder, req *http.Request, ran int) {
+	if !slices.ContainsFunc(mw.layers[:ran], func(layer luaMiddlewareLayer) bool { return layer.after != "" }) {
+		return
+	}
+	L := mw.pool.Get()
+	defer mw.pool.Put(L)
+	ac.LoadCommonFunctions(sr, req, mw.filename, L, nil, nil)
+	for i := ran - 1; i >= 0; i-- {
+		if mw.layers[i].after == "" {
+			continue
+		}
+		fn, ok := L.G.Registry.RawGetString(mw.layers[i].after).(*lua.LFunction)
+		if !ok {
+			logrus.Error("Middleware " + strconv.Itoa(i+1) + " from " + mw.filename + " is missing from the pool state")
+			continue
+		}
+		L.Push(fn)
+		L.Push(lua.LNumber(sr.Status()))
+		L.Push(lua.LNumber(sr.written))
+		if err := L.PCall(2, 0, nil); err != nil {
+			// Non-fatal error
+			logrus.Error("Middleware from "+mw.filename+" failed:", err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	lua "github.com/xyproto/gopher-lua"
+)
+
+// newTestMiddleware runs a script with use() calls the same way as
+// RunConfiguration, and wraps the given handler in the middleware
+func newTestMiddleware(t *testing.T, script string, inner http.Handler) http.Handler {
+	t.Helper()
+	ac := &Config{disableRateLimiting: true}
+	mux := http.NewServeMux()
+
+	L := lua.NewState()
+	defer L.Close()
+	ac.LoadLuaHandlerFunctions(L, "serverconf.lua", mux, false, nil, "", true)
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+
+	poolL := lua.NewState()
+	ac.LoadLuaHandlerFunctions(poolL, "serverconf.lua", mux, false, nil, "", false)
+	if err := poolL.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	pool := newHandlerPool(1)
+	pool.Add(poolL)
+	t.Cleanup(pool.Close)
+	for _, mw := range ac.luaMiddleware {
+		mw.pool = pool
+	}
+
+	return ac.luaMiddlewareHandler(inner)
+}
+
+func TestLuaMiddleware(t *testing.T) {
+	inner := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte("inner\n"))
+	})
+	handler := newTestMiddleware(t, `
+use(function()
+  setheader("X-Outer", "yes")
+end, function(status, written)
+  print("outer saw " .. status)
+end)
+use(function()
+  if urlpath() == "/secret" then
+    status(403)
+    print("denied")
+  end
+end)
+`, inner)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := rec.Body.String(); got != "inner\nouter saw 200\n" {
+		t.Errorf("GET / = %q", got)
+	}
+	if rec.Header().Get("X-Outer") != "yes" {
+		t.Error("expected the X-Outer header to be set")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if got := rec.Body.String(); !strings.HasSuffix(got, "outer saw 404\n") {
+		t.Errorf("GET /missing = %q, expected the outer middleware to see 404", got)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/secret", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("GET /secret status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if got := rec.Body.String(); got != "denied\nouter saw 403\n" {
+		t.Errorf("GET /secret = %q", got)
+	}
+}
+
+func TestLuaMiddlewareReleasesState(t *testing.T) {
+	// The inner handler runs after the state has been returned to the pool,
+	// and the function that comes after the request can borrow it again.
+	// With a pool of one state, holding on to it would block forever.
+	inner := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("inner\n"))
+	})
+	handler := newTestMiddleware(t, `
+use(function()
+  setheader("X-Before", "yes")
+end, function(status, written)
+  print("wrote " .. written)
+end)
+`, inner)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := rec.Body.String(); got != "inner\nwrote 6\n" {
+		t.Errorf("GET / = %q", got)
+	}
+}
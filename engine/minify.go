@@ -0,0 +1,229 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/sirupsen/logrus"
+	"github.com/xyproto/datablock"
+)
+
+// The types of output that can be minified
+const (
+	minifyHTML = "html"
+	minifyCSS  = "css"
+	minifyJS   = "js"
+	minifyJSON = "json"
+	minifySVG  = "svg"
+	minifyXML  = "xml"
+)
+
+// minifyTypes are all the types of output that can be minified
+var minifyTypes = []string{minifyHTML, minifyCSS, minifyJS, minifyJSON, minifySVG, minifyXML}
+
+// htmlRawElements are the HTML elements where the whitespace is kept as it is
+var htmlRawElements = []string{"pre", "textarea", "script", "style"}
+
+// minifyType returns the type of output that the given Content-Type, or the
+// extension of the filename, if the Content-Type is empty, is for. Returns
+// "" if the output can not be minified.
+func minifyType(contentTypeValue, filename string) string {
+	if contentTypeValue == "" {
+		contentTypeValue = mime.TypeByExtension(filepath.Ext(filename))
+	}
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentTypeValue), ";")
+	switch mediaType = strings.TrimSpace(mediaType); {
+	case mediaType == "text/html":
+		return minifyHTML
+	case mediaType == "text/css":
+		return minifyCSS
+	case mediaType == "text/javascript", mediaType == "application/javascript":
+		return minifyJS
+	case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		return minifyJSON
+	case mediaType == "image/svg+xml":
+		return minifySVG
+	case mediaType == "text/xml", mediaType == "application/xml", strings.HasSuffix(mediaType, "+xml"):
+		return minifyXML
+	}
+	return ""
+}
+
+// minifyWithESBuild minifies JavaScript or CSS with esbuild
+func minifyWithESBuild(data []byte, loader api.Loader) ([]byte, error) {
+	result := api.Transform(string(data), api.TransformOptions{
+		Loader:            loader,
+		MinifyWhitespace:  true,
+		MinifySyntax:      true,
+		MinifyIdentifiers: loader == api.LoaderJS,
+		Charset:           api.CharsetUTF8,
+	})
+	if len(result.Errors) > 0 {
+		return nil, errors.New(result.Errors[0].Text)
+	}
+	return result.Code, nil
+}
+
+// isSpace checks if the byte is HTML or XML whitespace
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
+
+// isTagStart checks if the data starts with a tag, a closing tag, a
+// declaration or a processing instruction, and not with a "<" in the text
+func isTagStart(data []byte) bool {
+	if len(data) < 2 || data[0] != '<' {
+		return false
+	}
+	b := data[1] | 0x20 // lowercase
+	return (b >= 'a' && b <= 'z') || data[1] == '/' || data[1] == '!' || data[1] == '?'
+}
+
+// minifyMarkup removes comments and whitespace from HTML, SVG or XML. Tags
+// and attributes are kept as they are. In HTML, runs of whitespace in the
+// text are replaced by a single space, except in the htmlRawElements. In SVG
+// and XML, only whitespace between tags that contains a newline is removed,
+// since that is indentation.
+func minifyMarkup(data []byte, html bool) []byte {
+	var out bytes.Buffer
+	out.Grow(len(data))
+	for i := 0; i < len(data); {
+		switch {
+		case bytes.HasPrefix(data[i:], []byte("<!--")):
+			end := bytes.Index(data[i+4:], []byte("-->"))
+			if end < 0 {
+				out.Write(data[i:])
+				return out.Bytes()
+			}
+			end += i + 4 + 3
+			// Keep conditional comments, for old versions of Internet Explorer
+			if bytes.HasPrefix(data[i:], []byte("<!--[if")) {
+				out.Write(data[i:end])
+			}
+			i = end
+		case bytes.HasPrefix(data[i:], []byte("<![CDATA[")):
+			end := bytes.Index(data[i:], []byte("]]>"))
+			if end < 0 {
+				out.Write(data[i:])
+				return out.Bytes()
+			}
+			out.Write(data[i : i+end+3])
+			i += end + 3
+		case isTagStart(data[i:]):
+			// Copy the tag, with the attributes as they are
+			start := i
+			var quote byte
+			for i++; i < len(data); i++ {
+				if quote != 0 {
+					if data[i] == quote {
+						quote = 0
+					}
+				} else if data[i] == '"' || data[i] == '\'' {
+					quote = data[i]
+				} else if data[i] == '>' {
+					i++
+					break
+				}
+			}
+			tag := data[start:i]
+			out.Write(tag)
+			if !html {
+				continue
+			}
+			// Copy the contents of the raw elements as they are
+			for _, name := range htmlRawElements {
+				if len(tag) > len(name)+1 && bytes.EqualFold(tag[1:len(name)+1], []byte(name)) && (tag[len(name)+1] == '>' || isSpace(tag[len(name)+1])) {
+					end := bytes.Index(bytes.ToLower(data[i:]), []byte("</"+name))
+					if end < 0 {
+						end = len(data) - i
+					}
+					out.Write(data[i : i+end])
+					i += end
+					break
+				}
+			}
+		case isSpace(data[i]):
+			start := i
+			for i < len(data) && isSpace(data[i]) {
+				i++
+			}
+			if html {
+				// Also when a comment was removed between two runs of whitespace
+				if b := out.Bytes(); len(b) == 0 || b[len(b)-1] != ' ' {
+					out.WriteByte(' ')
+				}
+			} else if (start > 0 && data[start-1] != '>') || (i < len(data) && data[i] != '<') || !bytes.ContainsRune(data[start:i], '\n') {
+				out.Write(data[start:i])
+			}
+		default:
+			out.WriteByte(data[i])
+			i++
+		}
+	}
+	return out.Bytes()
+}
+
+// minify minifies the data, for the given type of output
+func minify(data []byte, kind string) ([]byte, error) {
+	switch kind {
+	case minifyHTML:
+		return minifyMarkup(data, true), nil
+	case minifySVG, minifyXML:
+		return minifyMarkup(data, false), nil
+	case minifyCSS:
+		return minifyWithESBuild(data, api.LoaderCSS)
+	case minifyJS:
+		return minifyWithESBuild(data, api.LoaderJS)
+	case minifyJSON:
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, data); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return data, nil
+}
+
+// minifies checks if minification is enabled for the given Content-Type, or
+// the extension of the filename
+func (ac *Config) minifies(contentTypeValue, filename string) bool {
+	kind := minifyType(contentTypeValue, filename)
+	return kind != "" && ac.minifyTypes[kind]
+}
+
+// minified returns the data minified, if minification is enabled for the
+// type of output, or the data as it is
+func (ac *Config) minified(data []byte, contentTypeValue, filename string) []byte {
+	kind := minifyType(contentTypeValue, filename)
+	if kind == "" || !ac.minifyTypes[kind] {
+		return data
+	}
+	minData, err := minify(data, kind)
+	if err != nil {
+		// Serve the data as it is, if it could not be minified
+		return data
+	}
+	return minData
+}
+
+// serveMinifiedFile sends a file that has been read into a data block to a
+// HTTP client, minified. The minified file is kept with the rendered pages,
+// so that it is only minified, and hashed, when it enters the cache.
+func (ac *Config) serveMinifiedFile(w http.ResponseWriter, req *http.Request, filename string, block *datablock.DataBlock) {
+	if ac.serveRendered(w, req, filename, filepath.Ext(filename)) {
+		return
+	}
+	data, _, err := block.UncompressedData()
+	if err != nil {
+		logrus.Error("Could not serve " + filename + ": " + err.Error())
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	ac.renderedToClient(w, req, filename, data)
+}
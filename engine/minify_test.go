@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xyproto/algernon/cachemode"
+	"github.com/xyproto/datablock"
+	"github.com/xyproto/mime"
+)
+
+func TestMinifyMarkup(t *testing.T) {
+	html := "<!DOCTYPE html>\n<html>\n  <!-- a comment -->\n  <body class=\"a  b\">\n    <p>Hello,   <b>World</b>!</p>\n    <pre>  keep\n    this  </pre>\n    <script>if (a  <  b) {}</script>\n  </body>\n</html>\n"
+	want := "<!DOCTYPE html> <html> <body class=\"a  b\"> <p>Hello, <b>World</b>!</p> <pre>  keep\n    this  </pre> <script>if (a  <  b) {}</script> </body> </html> "
+	if got := string(minifyMarkup([]byte(html), true)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	svg := "<svg>\n  <!-- comment -->\n  <text x=\"1\">Hello  World</text>\n  <![CDATA[ a  b ]]>\n</svg>\n"
+	want = "<svg><text x=\"1\">Hello  World</text><![CDATA[ a  b ]]></svg>"
+	if got := string(minifyMarkup([]byte(svg), false)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMinifyMarkupText(t *testing.T) {
+	for _, test := range []struct {
+		html, want string
+	}{
+		// A "<" in the text is not the start of a tag
+		{"<p>a  <  b and c <= d</p>\n<p>x   y</p>", "<p>a < b and c <= d</p> <p>x y</p>"},
+		{"<p>1 < 2 isn't   false</p>", "<p>1 < 2 isn't false</p>"},
+		// The contents of elements with attributes are kept as they are too
+		{"<pre class=\"code\">\n  a  b\n</pre>\n<textarea\nname=\"t\">  x  </textarea>", "<pre class=\"code\">\n  a  b\n</pre> <textarea\nname=\"t\">  x  </textarea>"},
+		{"<prefix>  a  </prefix>", "<prefix> a </prefix>"},
+		// Whitespace between inline elements is kept as a single space
+		{"<b>bold</b>\n   <i>italic</i>  <a href=\"/\">link</a>", "<b>bold</b> <i>italic</i> <a href=\"/\">link</a>"},
+		{"<span>a</span><span>b</span>", "<span>a</span><span>b</span>"},
+	} {
+		if got := string(minifyMarkup([]byte(test.html), true)); got != test.want {
+			t.Errorf("minifyMarkup(%q) = %q, want %q", test.html, got, test.want)
+		}
+	}
+}
+
+func TestMinify(t *testing.T) {
+	for _, test := range []struct {
+		kind, data, want string
+	}{
+		{minifyJSON, "{\n  \"a\": [1, 2]\n}\n", `{"a":[1,2]}`},
+		{minifyCSS, "body {\n  color: #ffffff;\n}\n", "body{color:#fff}\n"},
+		{minifyJS, "function hello(name) {\n  return 'Hello, ' + name;\n}\n", "function hello(l){return\"Hello, \"+l}\n"},
+	} {
+		got, err := minify([]byte(test.data), test.kind)
+		if err != nil {
+			t.Errorf("%s: %v", test.kind, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.kind, got, test.want)
+		}
+	}
+	if _, err := minify([]byte("{"), minifyJSON); err == nil {
+		t.Error("expected an error for invalid JSON")
+	}
+}
+
+func TestMinifiedResponse(t *testing.T) {
+	ac := &Config{cacheSize: 1 << 20, minifyTypes: map[string]bool{minifyHTML: true}}
+	serve := func(filename, contentTypeValue, data string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/"+filename, nil)
+		rec := httptest.NewRecorder()
+		rec.Header().Set(contentType, contentTypeValue)
+		ac.DataToClient(rec, req, filename, []byte(data))
+		return rec
+	}
+	rec := serve("index.md", htmlUTF8, "<h1>Hello</h1>\n\n<p>World</p>\n")
+	if rec.Body.String() != "<h1>Hello</h1> <p>World</p> " {
+		t.Errorf("got %q", rec.Body.String())
+	}
+	if got, want := rec.Header().Get("ETag"), entityTag(contentSum(rec.Body.Bytes()), encodingIdentity); got != want {
+		t.Errorf("got the ETag %q, want %q for the minified data", got, want)
+	}
+	// CSS is not minified, since only HTML was selected
+	if rec := serve("style.css", "text/css", "body {\n  color: red;\n}\n"); rec.Body.String() != "body {\n  color: red;\n}\n" {
+		t.Errorf("got %q", rec.Body.String())
+	}
+}
+
+func TestMinifiedFileIsKept(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "index.html")
+	if err := os.WriteFile(filename, []byte("<p>\n  Hello,   World!\n</p>\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ac := &Config{
+		cache:         datablock.NewFileCache(1<<20, true, 0, true, 0),
+		cacheMode:     cachemode.On,
+		fs:            datablock.NewFileStat(true, time.Minute),
+		mimereader:    mime.New("/etc/mime.types", true),
+		largeFileSize: 1 << 20,
+		minifyTypes:   map[string]bool{minifyHTML: true},
+	}
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		ac.FilePage(rec, httptest.NewRequest(http.MethodGet, "/index.html", nil), filename, "")
+		return rec
+	}
+	const want = "<p> Hello, World! </p> "
+	if rec := get(); rec.Body.String() != want {
+		t.Fatalf("got %q, want %q", rec.Body.String(), want)
+	}
+	// The minified file is kept, and sent as it is, until the file changes
+	v, ok := ac.renderedPages.Load(filename)
+	if !ok || string(v.(renderedPage).data) != want {
+		t.Fatal("expected the minified file to be kept")
+	}
+	page := v.(renderedPage)
+	page.data = []byte("kept")
+	ac.renderedPages.Store(filename, page)
+	if rec := get(); rec.Body.String() != "kept" {
+		t.Errorf("got %q, want the kept data", rec.Body.String())
+	}
+}
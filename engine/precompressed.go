@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// precompressedSuffixes are the extensions of precompressed files, like
+// "app.js.br" for "app.js", in order of preference
+var precompressedSuffixes = []struct {
+	encoding string
+	suffix   string
+}{
+	{encodingBrotli, ".br"},
+	{encodingZstd, ".zst"},
+	{encodingGzip, ".gz"},
+}
+
+// servePrecompressed serves a precompressed variant of the given file, if
+// there is one that the client accepts and that is not older than the file.
+// The Content-Type is the one for the original file. Returns true if a
+// variant was served.
+func (ac *Config) servePrecompressed(w http.ResponseWriter, req *http.Request, filename string) bool {
+	if w.Header().Get("Content-Encoding") != "" {
+		return false
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	var offers []string
+	variants := make(map[string]string)
+	for _, p := range precompressedSuffixes {
+		variant := filename + p.suffix
+		if ac.fs != nil && !ac.fs.Exists(variant) {
+			continue
+		}
+		if vInfo, err := os.Stat(variant); err == nil && vInfo.Mode().IsRegular() && !vInfo.ModTime().Before(info.ModTime()) {
+			offers = append(offers, p.encoding)
+			variants[p.encoding] = variant
+		}
+	}
+	if len(offers) == 0 {
+		return false
+	}
+	varyAcceptEncoding(w.Header())
+	encoding := ac.acceptedEncoding(req, offers...)
+	if encoding == encodingIdentity {
+		return false
+	}
+	f, err := os.Open(variants[encoding])
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	w.Header().Set("Content-Encoding", encoding)
+	if vInfo, err := f.Stat(); err == nil {
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%x-%s"`, vInfo.ModTime().UnixNano(), vInfo.Size(), encoding))
+	}
+	// The name of the original file gives the Content-Type, if it is not set,
+	// and http.ServeContent handles ranges of the precompressed data
+	http.ServeContent(w, req, filepath.Base(filename), info.ModTime(), f)
+	return true
+}
@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xyproto/datablock"
+	"github.com/xyproto/mime"
+)
+
+func TestServePrecompressed(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "style.css")
+	css := strings.Repeat("body { color: black; }\n", 100)
+	for name, data := range map[string]string{
+		"style.css":    css,
+		"style.css.br": "brotli data",
+		"style.css.gz": "gzip data",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The variants are newer than the file
+	modified := time.Now().Add(-30 * time.Minute)
+	if err := os.Chtimes(filename, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	ac := &Config{
+		cache:         datablock.NewFileCache(1<<20, false, 0, true, 0),
+		mimereader:    mime.New("/etc/mime.types", true),
+		largeFileSize: 1, // also on the path for streaming large files
+	}
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/style.css", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		ac.FilePage(rec, req, filename, "")
+		return rec
+	}
+	for _, test := range []struct {
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{"gzip, deflate, br, zstd", "br", "brotli data"},
+		{"gzip, br;q=0.5", "gzip", "gzip data"},
+		{"identity", "", css},
+	} {
+		rec := get(test.acceptEncoding)
+		if got := rec.Header().Get("Content-Encoding"); got != test.encoding {
+			t.Errorf("%q: got Content-Encoding %q, want %q", test.acceptEncoding, got, test.encoding)
+		}
+		if rec.Body.String() != test.body {
+			t.Errorf("%q: got the body %q", test.acceptEncoding, rec.Body.String())
+		}
+		if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/css") {
+			t.Errorf("%q: got Content-Type %q, want text/css", test.acceptEncoding, rec.Header().Get("Content-Type"))
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%q: got Vary %q", test.acceptEncoding, rec.Header().Get("Vary"))
+		}
+	}
+
+	// Variants that are older than the file are not used
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "style.css.br"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("br, gzip"); rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected the outdated Brotli variant to be skipped, got %v", rec.Header())
+	}
+}
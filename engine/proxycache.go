@@ -0,0 +1,525 @@
+package engine
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// proxyCacheEntry is one stored response from an upstream. Entries are never
+// modified after they have been stored, a revalidated entry is replaced.
+type proxyCacheEntry struct {
+	key          string
+	varyValues   []string // the values of the request headers named by Vary
+	vary         []string // the canonical header names from Vary
+	header       http.Header
+	body         []byte
+	status       int
+	stored       time.Time
+	initialAge   time.Duration // the Age header from the upstream
+	lifetime     time.Duration // for how long the response is fresh
+	staleWhile   time.Duration // stale-while-revalidate
+	etag         string
+	lastModified string
+	size         uint64
+	elem         *list.Element
+}
+
+// age returns the current age of the stored response
+func (e *proxyCacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.stored)
+}
+
+// proxyCache is an in-memory cache for responses from reverse proxies that
+// have the "cache" option set. The responses are stored according to the
+// Cache-Control, Expires and Vary headers from the upstream. The cache
+// shares the --cachesize budget with the file cache.
+type proxyCache struct {
+	entries       map[string][]*proxyCacheEntry // the variants for each key
+	revalidating  map[*proxyCacheEntry]bool
+	lru           *list.List // the most recently used entry first
+	otherUsage    func() uint64
+	maxSize       uint64
+	maxEntitySize uint64 // 0 for no limit
+	used          uint64
+	mu            sync.Mutex
+}
+
+// newProxyCache creates a proxy cache that may use up to maxSize bytes,
+// minus the bytes that otherUsage returns, if otherUsage is not nil
+func newProxyCache(maxSize, maxEntitySize uint64, otherUsage func() uint64) *proxyCache {
+	return &proxyCache{
+		entries:       make(map[string][]*proxyCacheEntry),
+		revalidating:  make(map[*proxyCacheEntry]bool),
+		lru:           list.New(),
+		otherUsage:    otherUsage,
+		maxSize:       maxSize,
+		maxEntitySize: maxEntitySize,
+	}
+}
+
+// Clear removes all stored responses
+func (c *proxyCache) Clear() {
+	c.mu.Lock()
+	c.entries = make(map[string][]*proxyCacheEntry)
+	c.lru.Init()
+	c.used = 0
+	c.mu.Unlock()
+}
+
+// proxyCacheKey returns the primary cache key for a request
+func proxyCacheKey(req *http.Request) string {
+	return req.Host + req.URL.RequestURI()
+}
+
+// cacheControl parses a Cache-Control header into a map of lowercase
+// directives and their values, if any
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// deltaSeconds parses the value of a Cache-Control directive like max-age
+func deltaSeconds(value string) (time.Duration, bool) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheableStatus checks if responses with the given status code can be stored
+func cacheableStatus(status int) bool {
+	switch status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMultipleChoices, http.StatusMovedPermanently, http.StatusPermanentRedirect,
+		http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusGone,
+		http.StatusRequestURITooLong, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// newProxyCacheEntry creates an entry for a response from the upstream, without the
+// body, or returns nil if the response must not be stored
+func newProxyCacheEntry(req *http.Request, status int, header http.Header, now time.Time) *proxyCacheEntry {
+	if !cacheableStatus(status) || header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	cc := cacheControl(header)
+	if _, ok := cc["no-store"]; ok {
+		return nil
+	}
+	if _, ok := cc["private"]; ok {
+		return nil
+	}
+	// The response to a request with credentials may be for that user only
+	if _, ok := cc["public"]; !ok && hasCredentials(req) {
+		return nil
+	}
+	e := &proxyCacheEntry{
+		key:          proxyCacheKey(req),
+		header:       header.Clone(),
+		status:       status,
+		stored:       now,
+		etag:         header.Get("ETag"),
+		lastModified: header.Get("Last-Modified"),
+	}
+	e.header.Del("X-Cache")
+	for _, value := range header.Values("Vary") {
+		for name := range strings.SplitSeq(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				e.vary = append(e.vary, name)
+				e.varyValues = append(e.varyValues, req.Header.Get(name))
+			}
+		}
+	}
+	if age, ok := deltaSeconds(header.Get("Age")); ok {
+		e.initialAge = age
+	}
+	if _, ok := cc["no-cache"]; !ok {
+		if lifetime, ok := deltaSeconds(cc["s-maxage"]); ok {
+			e.lifetime = lifetime
+		} else if lifetime, ok := deltaSeconds(cc["max-age"]); ok {
+			e.lifetime = lifetime
+		} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+			date, err := http.ParseTime(header.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			e.lifetime = max(expires.Sub(date), 0)
+		}
+		if _, ok := cc["must-revalidate"]; !ok {
+			e.staleWhile, _ = deltaSeconds(cc["stale-while-revalidate"])
+		}
+	}
+	// A response that is never fresh is only useful if it can be revalidated
+	if e.lifetime <= e.initialAge && e.etag == "" && e.lastModified == "" {
+		return nil
+	}
+	return e
+}
+
+// hasCredentials checks if the request has a cookie or an Authorization header
+func hasCredentials(req *http.Request) bool {
+	return req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != ""
+}
+
+// lookup finds the stored variant that matches the request, if any
+func (c *proxyCache) lookup(req *http.Request) *proxyCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries[proxyCacheKey(req)] {
+		match := true
+		for i, name := range e.vary {
+			if req.Header.Get(name) != e.varyValues[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			c.lru.MoveToFront(e.elem)
+			return e
+		}
+	}
+	return nil
+}
+
+// remove removes an entry. c.mu must be held.
+func (c *proxyCache) remove(e *proxyCacheEntry) {
+	variants := c.entries[e.key]
+	for i, other := range variants {
+		if other == e {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(c.entries, e.key)
+	} else {
+		c.entries[e.key] = variants
+	}
+	c.lru.Remove(e.elem)
+	c.used -= e.size
+}
+
+// invalidate removes all variants for the key of the request
+func (c *proxyCache) invalidate(req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries[proxyCacheKey(req)] {
+		c.lru.Remove(e.elem)
+		c.used -= e.size
+	}
+	delete(c.entries, proxyCacheKey(req))
+}
+
+// store adds an entry, replacing the stored variant with the same Vary
+// values, if any, and evicts the least recently used entries if needed
+func (c *proxyCache) store(e *proxyCacheEntry) {
+	e.size = uint64(len(e.key) + len(e.body))
+	for name, values := range e.header {
+		for _, value := range values {
+			e.size += uint64(len(name) + len(value))
+		}
+	}
+	if c.maxEntitySize > 0 && e.size > c.maxEntitySize {
+		return
+	}
+	var otherUsage uint64
+	if c.otherUsage != nil {
+		otherUsage = c.otherUsage()
+	}
+	if otherUsage+e.size > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, other := range c.entries[e.key] {
+		if strings.Join(other.vary, "\x00") == strings.Join(e.vary, "\x00") && strings.Join(other.varyValues, "\x00") == strings.Join(e.varyValues, "\x00") {
+			c.remove(other)
+			break
+		}
+	}
+	for c.used+otherUsage+e.size > c.maxSize {
+		c.remove(c.lru.Back().Value.(*proxyCacheEntry))
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[e.key] = append(c.entries[e.key], e)
+	c.used += e.size
+}
+
+// refreshed returns a copy of the entry, with the headers and freshness from
+// a 304 Not Modified response from the upstream
+func refreshed(req *http.Request, e *proxyCacheEntry, header http.Header, now time.Time) *proxyCacheEntry {
+	merged := e.header.Clone()
+	for name, values := range header {
+		merged[name] = values
+	}
+	fresh := newProxyCacheEntry(req, e.status, merged, now)
+	if fresh == nil {
+		return nil
+	}
+	fresh.body = e.body
+	return fresh
+}
+
+// notModified checks if the conditional headers of the request match the entry
+func (e *proxyCacheEntry) notModified(req *http.Request) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if e.etag == "" {
+			return false
+		}
+		for tag := range strings.SplitSeq(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(e.etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" && e.lastModified != "" {
+		since, err1 := http.ParseTime(ims)
+		modified, err2 := http.ParseTime(e.lastModified)
+		return err1 == nil && err2 == nil && !modified.After(since)
+	}
+	return false
+}
+
+// serve sends a stored response to the client
+func (e *proxyCacheEntry) serve(w http.ResponseWriter, req *http.Request, xcache string, now time.Time) {
+	header := w.Header()
+	for name, values := range e.header {
+		header[name] = values
+	}
+	header.Set("Age", strconv.Itoa(int(e.age(now).Seconds())))
+	header.Set("X-Cache", xcache)
+	if e.status == http.StatusOK && e.notModified(req) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.status)
+	if req.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+// proxyCacheWriter passes a response from the upstream on to the client,
+// while keeping a copy of it, if it can be stored
+type proxyCacheWriter struct {
+	http.ResponseWriter
+	entry         *proxyCacheEntry // nil if the response is not stored
+	cache         *proxyCache
+	req           *http.Request
+	xcache        string
+	body          []byte
+	status        int
+	intercept304  bool // keep a 304 from the upstream from reaching the client
+	notModified   bool
+	headerWritten bool
+}
+
+func (pw *proxyCacheWriter) WriteHeader(status int) {
+	if pw.headerWritten || (status >= 100 && status <= 199 && status != http.StatusSwitchingProtocols) {
+		pw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	pw.headerWritten = true
+	pw.status = status
+	if status == http.StatusNotModified && pw.intercept304 {
+		pw.notModified = true
+		return
+	}
+	if pw.req.Method == http.MethodGet {
+		pw.entry = newProxyCacheEntry(pw.req, status, pw.Header(), time.Now())
+	}
+	pw.Header().Set("X-Cache", pw.xcache)
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+func (pw *proxyCacheWriter) Write(b []byte) (int, error) {
+	if !pw.headerWritten {
+		pw.WriteHeader(http.StatusOK)
+	}
+	if pw.notModified {
+		return len(b), nil
+	}
+	if pw.entry != nil {
+		if pw.cache.maxEntitySize > 0 && uint64(len(pw.body)+len(b)) > pw.cache.maxEntitySize {
+			pw.entry, pw.body = nil, nil
+		} else {
+			pw.body = append(pw.body, b...)
+		}
+	}
+	return pw.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming responses through
+func (pw *proxyCacheWriter) Flush() {
+	if pw.notModified {
+		return
+	}
+	http.NewResponseController(pw.ResponseWriter).Flush()
+}
+
+// Unwrap gives http.ResponseController access to the wrapped ResponseWriter
+func (pw *proxyCacheWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+// finish stores the response, if it can be stored and was received in full
+func (pw *proxyCacheWriter) finish() {
+	if pw.entry == nil {
+		return
+	}
+	if cl := pw.entry.header.Get("Content-Length"); cl != "" && cl != strconv.Itoa(len(pw.body)) {
+		return
+	}
+	pw.entry.body = pw.body
+	pw.cache.store(pw.entry)
+}
+
+// discardWriter is a ResponseWriter for background revalidation, where
+// there is no client to send the response to
+type discardWriter struct {
+	header http.Header
+}
+
+func (dw *discardWriter) Header() http.Header         { return dw.header }
+func (dw *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (dw *discardWriter) WriteHeader(int)             {}
+
+// conditional returns a copy of the request, for revalidating the entry
+func conditional(ctx context.Context, req *http.Request, e *proxyCacheEntry) *http.Request {
+	outreq := req.Clone(ctx)
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range", "Range"} {
+		outreq.Header.Del(name)
+	}
+	if e.etag != "" {
+		outreq.Header.Set("If-None-Match", e.etag)
+	}
+	if e.lastModified != "" {
+		outreq.Header.Set("If-Modified-Since", e.lastModified)
+	}
+	return outreq
+}
+
+// fetch sends the request to the upstream, through next. If a stored entry
+// is given, the request is made conditional, and the entry is served if the
+// upstream replies with 304 Not Modified.
+func (c *proxyCache) fetch(w http.ResponseWriter, req *http.Request, next http.Handler, e *proxyCacheEntry, xcache string) {
+	pw := &proxyCacheWriter{ResponseWriter: w, cache: c, req: req, xcache: xcache}
+	outreq := req
+	if e != nil && (e.etag != "" || e.lastModified != "") {
+		outreq = conditional(req.Context(), req, e)
+		pw.intercept304 = true
+	}
+	next.ServeHTTP(pw, outreq)
+	if !pw.notModified {
+		pw.finish()
+		return
+	}
+	now := time.Now()
+	if fresh := refreshed(req, e, pw.Header(), now); fresh != nil {
+		c.store(fresh)
+		e = fresh
+	}
+	for name := range w.Header() {
+		w.Header().Del(name)
+	}
+	e.serve(w, req, "REVALIDATED", now)
+}
+
+// revalidate refreshes a stale entry in the background, while the stale
+// entry is being served
+func (c *proxyCache) revalidate(req *http.Request, next http.Handler, e *proxyCacheEntry) {
+	c.mu.Lock()
+	if c.revalidating[e] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[e] = true
+	c.mu.Unlock()
+	// The client may be gone before the upstream replies
+	outreq := req.Clone(context.WithoutCancel(req.Context()))
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, e)
+			c.mu.Unlock()
+			if r := recover(); r != nil && r != http.ErrAbortHandler {
+				logrus.Errorf("reverse proxy cache: revalidating %s: %v", e.key, r)
+			}
+		}()
+		c.fetch(&discardWriter{header: make(http.Header)}, outreq, next, e, "REVALIDATED")
+	}()
+}
+
+// ServeHTTP serves GET and HEAD requests from the cache, if possible, and
+// passes the other requests on to next. The X-Cache header is set to HIT,
+// STALE, MISS, REVALIDATED or BYPASS.
+func (c *proxyCache) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.Handler) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		sr := newStatusRecorder(w)
+		next.ServeHTTP(sr, req)
+		if req.Method != http.MethodOptions && req.Method != http.MethodTrace && sr.Status() < 400 {
+			c.invalidate(req)
+		}
+		return
+	}
+	cc := cacheControl(req.Header)
+	_, noStore := cc["no-store"]
+	if noStore || req.Header.Get("Upgrade") != "" || req.Header.Get("Range") != "" {
+		w.Header().Set("X-Cache", "BYPASS")
+		next.ServeHTTP(w, req)
+		return
+	}
+	// Requests with credentials are never served from the cache, but the
+	// response is stored if the upstream marks it as public
+	if hasCredentials(req) {
+		c.fetch(w, req, next, nil, "BYPASS")
+		return
+	}
+	now := time.Now()
+	e := c.lookup(req)
+	if e == nil {
+		c.fetch(w, req, next, nil, "MISS")
+		return
+	}
+	if _, noCache := cc["no-cache"]; !noCache {
+		age := e.age(now)
+		if age < e.lifetime {
+			e.serve(w, req, "HIT", now)
+			return
+		}
+		if age < e.lifetime+e.staleWhile {
+			c.revalidate(req, next, e)
+			e.serve(w, req, "STALE", now)
+			return
+		}
+	}
+	if req.Method == http.MethodHead {
+		next.ServeHTTP(w, req)
+		return
+	}
+	c.fetch(w, req, next, e, "MISS")
+}
@@ -0,0 +1,210 @@
+package engine
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestCachedProxy caches the responses from the given handler under /api
+func newTestCachedProxy(t *testing.T, handler http.HandlerFunc) *ReverseProxy {
+	t.Helper()
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	u, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := NewReverseProxyConfig()
+	rc.cache = newProxyCache(1<<20, 0, nil)
+	rc.Add(&ReverseProxy{PathPrefix: "/api", Endpoint: *u, Options: ProxyOptions{Cache: true}})
+	return rc.FindMatchingReverseProxy("/api")
+}
+
+// cachedGet sends a request through the proxy and returns the recorder
+func cachedGet(rp *ReverseProxy, method, path string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestProxyCacheHitAndMiss(t *testing.T) {
+	var hits atomic.Int64
+	rp := newTestCachedProxy(t, func(w http.ResponseWriter, req *http.Request) {
+		n := hits.Add(1)
+		switch req.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		}
+		io.WriteString(w, "response "+strconv.FormatInt(n, 10))
+	})
+
+	for i, want := range []string{"MISS", "HIT", "HIT"} {
+		rec := cachedGet(rp, http.MethodGet, "/api/fresh")
+		if got := rec.Header().Get("X-Cache"); got != want {
+			t.Errorf("request %d: X-Cache = %q, want %q", i+1, got, want)
+		}
+		if rec.Body.String() != "response 1" {
+			t.Errorf("request %d: body = %q, want the first response", i+1, rec.Body.String())
+		}
+	}
+	if rec := cachedGet(rp, http.MethodHead, "/api/fresh"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.Len() != 0 {
+		t.Errorf("HEAD: X-Cache = %q with %d bytes, want a HIT without a body", rec.Header().Get("X-Cache"), rec.Body.Len())
+	}
+	if rec := cachedGet(rp, http.MethodGet, "/api/fresh", "Cache-Control", "no-store"); rec.Header().Get("X-Cache") != "BYPASS" {
+		t.Errorf("no-store: X-Cache = %q, want BYPASS", rec.Header().Get("X-Cache"))
+	}
+
+	// A successful POST invalidates the stored response
+	cachedGet(rp, http.MethodPost, "/api/fresh")
+	if rec := cachedGet(rp, http.MethodGet, "/api/fresh"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("after POST: X-Cache = %q, want MISS", rec.Header().Get("X-Cache"))
+	}
+
+	cachedGet(rp, http.MethodGet, "/api/private")
+	if rec := cachedGet(rp, http.MethodGet, "/api/private"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("private: X-Cache = %q, want MISS", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestProxyCacheCredentials(t *testing.T) {
+	rp := newTestCachedProxy(t, func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/public" {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		io.WriteString(w, "hello "+req.Header.Get("Cookie")+req.Header.Get("Authorization"))
+	})
+
+	// A response for a logged in user is not stored nor served to others
+	for _, header := range [][]string{{"Cookie", "session=alice"}, {"Authorization", "Bearer alice"}} {
+		path := "/api/" + header[0]
+		if rec := cachedGet(rp, http.MethodGet, path, header...); rec.Header().Get("X-Cache") != "BYPASS" {
+			t.Errorf("%s: X-Cache = %q, want BYPASS", header[0], rec.Header().Get("X-Cache"))
+		}
+		if rec := cachedGet(rp, http.MethodGet, path); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "hello " {
+			t.Errorf("%s: got %q from %s, want a MISS without credentials", header[0], rec.Body.String(), rec.Header().Get("X-Cache"))
+		}
+	}
+	// A request with credentials is not served a stored response
+	if rec := cachedGet(rp, http.MethodGet, "/api/Cookie", "Cookie", "session=bob"); rec.Body.String() != "hello session=bob" {
+		t.Errorf("got %q, want the response for bob", rec.Body.String())
+	}
+
+	// Responses that are marked as public are stored
+	cachedGet(rp, http.MethodGet, "/api/public", "Cookie", "session=alice")
+	if rec := cachedGet(rp, http.MethodGet, "/api/public"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("public: X-Cache = %q, want HIT", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestProxyCacheVary(t *testing.T) {
+	rp := newTestCachedProxy(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		io.WriteString(w, "lang "+req.Header.Get("Accept-Language"))
+	})
+	cachedGet(rp, http.MethodGet, "/api/x", "Accept-Language", "nb")
+	rec := cachedGet(rp, http.MethodGet, "/api/x", "Accept-Language", "en")
+	if rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "lang en" {
+		t.Errorf("got %q from %s, want a MISS for another language", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	rec = cachedGet(rp, http.MethodGet, "/api/x", "Accept-Language", "nb")
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "lang nb" {
+		t.Errorf("got %q from %s, want a HIT for the first language", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestProxyCacheRevalidation(t *testing.T) {
+	var full atomic.Int64
+	rp := newTestCachedProxy(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"v1"`)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		io.WriteString(w, "version 1")
+	})
+	cachedGet(rp, http.MethodGet, "/api/doc")
+	rec := cachedGet(rp, http.MethodGet, "/api/doc")
+	if rec.Code != http.StatusOK || rec.Body.String() != "version 1" || rec.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Errorf("got %d %q from %s, want the stored response, revalidated", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	if full.Load() != 1 {
+		t.Errorf("the upstream sent the full response %d times, want 1", full.Load())
+	}
+	// The client has the same version
+	if rec := cachedGet(rp, http.MethodGet, "/api/doc", "If-None-Match", `"v1"`); rec.Code != http.StatusNotModified {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotModified)
+	}
+}
+
+func TestProxyCacheStaleWhileRevalidate(t *testing.T) {
+	var version atomic.Int64
+	revalidated := make(chan struct{}, 1)
+	rp := newTestCachedProxy(t, func(w http.ResponseWriter, _ *http.Request) {
+		n := version.Add(1)
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=60")
+		io.WriteString(w, "version "+strconv.FormatInt(n, 10))
+		if n == 2 {
+			revalidated <- struct{}{}
+		}
+	})
+	cachedGet(rp, http.MethodGet, "/api/x")
+	// Make the stored response stale, instead of waiting for it
+	for _, e := range rp.cache.entries {
+		e[0].stored = e[0].stored.Add(-2 * time.Second)
+	}
+	rec := cachedGet(rp, http.MethodGet, "/api/x")
+	if rec.Header().Get("X-Cache") != "STALE" || rec.Body.String() != "version 1" {
+		t.Errorf("got %q from %s, want the stale response", rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+	select {
+	case <-revalidated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stale response was not revalidated in the background")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if rec := cachedGet(rp, http.MethodGet, "/api/x"); rec.Body.String() == "version 2" {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("the revalidated response was never served")
+}
+
+func TestProxyCacheEviction(t *testing.T) {
+	c := newProxyCache(200, 0, nil)
+	for i := range 5 {
+		req := httptest.NewRequest(http.MethodGet, "/item"+strconv.Itoa(i), nil)
+		header := http.Header{"Cache-Control": {"max-age=60"}}
+		e := newProxyCacheEntry(req, http.StatusOK, header, time.Now())
+		e.body = []byte(strings.Repeat("x", 50))
+		c.store(e)
+	}
+	if c.used > 200 {
+		t.Errorf("the cache uses %d bytes, more than the 200 it may use", c.used)
+	}
+	if c.lookup(httptest.NewRequest(http.MethodGet, "/item0", nil)) != nil {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+	if c.lookup(httptest.NewRequest(http.MethodGet, "/item4", nil)) == nil {
+		t.Error("expected the most recently stored entry to be kept")
+	}
+}
@@ -0,0 +1,263 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	lua "github.com/xyproto/gopher-lua"
+)
+
+// proxyHookRegistryPrefix keys a request, response or body function from
+// AddReverseProxy in a Lua state's registry
+const proxyHookRegistryPrefix = "algernon:proxyhook:"
+
+// maxHookBodySize is the largest response body that is given to a body hook.
+// Larger bodies are passed through unchanged.
+const maxHookBodySize = 16 * 1024 * 1024
+
+// errProxyHook is returned when a hook fails, so that the request is not
+// proxied, or the response is not sent, without the changes from the hook
+var errProxyHook = errors.New("a hook for the reverse proxy failed")
+
+// proxyHooks holds which Lua functions were given as the request, response
+// and body options to AddReverseProxy, for one path prefix. The functions
+// themselves live in the registry of each state in the pool.
+type proxyHooks struct {
+	filename   string
+	pathPrefix string
+	pool       *handlerPool // nil until the script has been run
+	request    bool
+	response   bool
+	body       bool
+}
+
+// proxyInKey is the context key for the incoming request, for the hooks
+// that only have access to the outgoing request
+type proxyInKey struct{}
+
+// proxyHookErrorKey is the context key for an error from the request hook
+type proxyHookErrorKey struct{}
+
+// proxyHookKey returns the registry key for the given hook and path prefix
+func proxyHookKey(pathPrefix, hook string) string {
+	return proxyHookRegistryPrefix + pathPrefix + ":" + hook
+}
+
+// newProxyHooks returns the hooks in the given AddReverseProxy options
+// table, or nil if there are none
+func newProxyHooks(filename, pathPrefix string, optionTable *lua.LTable) *proxyHooks {
+	_, request := optionTable.RawGetString("request").(*lua.LFunction)
+	_, response := optionTable.RawGetString("response").(*lua.LFunction)
+	_, body := optionTable.RawGetString("body").(*lua.LFunction)
+	if !request && !response && !body {
+		return nil
+	}
+	return &proxyHooks{filename: filename, pathPrefix: pathPrefix, request: request, response: response, body: body}
+}
+
+// loadProxyHookFunctions replaces the AddReverseProxy no-op in a pool state
+// with a function that only stores the hooks in the registry
+func loadProxyHookFunctions(L *lua.LState) {
+	L.SetGlobal("AddReverseProxy", L.NewFunction(func(L *lua.LState) int {
+		pathPrefix := L.ToString(1)
+		optionTable, ok := L.Get(3).(*lua.LTable)
+		if !ok {
+			return 0 // number of results
+		}
+		for _, hook := range []string{"request", "response", "body"} {
+			if fn, ok := optionTable.RawGetString(hook).(*lua.LFunction); ok {
+				L.G.Registry.RawSetString(proxyHookKey(pathPrefix, hook), fn)
+			}
+		}
+		return 0 // number of results
+	}))
+}
+
+// addProxyHooks remembers the hooks, so that a pool can be built for them
+func (ac *Config) addProxyHooks(hooks *proxyHooks) {
+	ac.proxyHooks = append(ac.proxyHooks, hooks)
+}
+
+// buildProxyHookPool builds the pool of Lua states for the hooks that the
+// given script has given to AddReverseProxy, if any
+func (ac *Config) buildProxyHookPool(filename string, mux *http.ServeMux) error {
+	var pool *handlerPool
+	for _, hooks := range ac.proxyHooks {
+		if hooks.filename != filename || hooks.pool != nil {
+			continue
+		}
+		if pool == nil {
+			var err error
+			if pool, err = ac.newScriptPool(filename, mux); err != nil {
+				return err
+			}
+		}
+		hooks.pool = pool
+	}
+	return nil
+}
+
+// headerTable converts HTTP headers to a Lua table. Headers with several
+// values become arrays.
+func headerTable(L *lua.LState, header http.Header) *lua.LTable {
+	table := L.NewTable()
+	for name, values := range header {
+		if len(values) == 1 {
+			table.RawSetString(name, lua.LString(values[0]))
+			continue
+		}
+		array := L.NewTable()
+		for _, value := range values {
+			array.Append(lua.LString(value))
+		}
+		table.RawSetString(name, array)
+	}
+	return table
+}
+
+// applyHeaderTable replaces the given HTTP headers with the ones in the Lua
+// table, so that headers that were removed from the table are removed
+func applyHeaderTable(table *lua.LTable, header http.Header) {
+	for name := range header {
+		delete(header, name)
+	}
+	table.ForEach(func(key, value lua.LValue) {
+		name := http.CanonicalHeaderKey(key.String())
+		switch v := value.(type) {
+		case *lua.LTable:
+			for i := 1; i <= v.Len(); i++ {
+				header.Add(name, v.RawGetInt(i).String())
+			}
+		case lua.LString, lua.LNumber, lua.LBool:
+			header.Set(name, v.String())
+		}
+	})
+}
+
+// infoTable describes the incoming request to the hooks
+func infoTable(L *lua.LState, req *http.Request) *lua.LTable {
+	info := L.NewTable()
+	info.RawSetString("method", lua.LString(req.Method))
+	info.RawSetString("path", lua.LString(req.URL.Path))
+	info.RawSetString("query", lua.LString(req.URL.RawQuery))
+	info.RawSetString("host", lua.LString(req.Host))
+	info.RawSetString("remote_addr", lua.LString(req.RemoteAddr))
+	return info
+}
+
+// call runs one of the hooks, with the given arguments, and returns the
+// first result. The hook is looked up in a state borrowed from the pool.
+func (hooks *proxyHooks) call(hook string, args func(L *lua.LState) []lua.LValue, results func(L *lua.LState, ret lua.LValue)) error {
+	if hooks.pool == nil {
+		return nil
+	}
+	L := hooks.pool.Get()
+	defer hooks.pool.Put(L)
+	fn, ok := L.G.Registry.RawGetString(proxyHookKey(hooks.pathPrefix, hook)).(*lua.LFunction)
+	if !ok {
+		logrus.Error("The " + hook + " hook for " + hooks.pathPrefix + " from " + hooks.filename + " is missing from the pool state")
+		return errProxyHook
+	}
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args(L)...); err != nil {
+		// Non-fatal error
+		logrus.Error("The "+hook+" hook for "+hooks.pathPrefix+" from "+hooks.filename+" failed:", err)
+		return errProxyHook
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	results(L, ret)
+	return nil
+}
+
+// rewriteRequest runs the request hook on the outgoing request. The hook
+// can change the headers. Called from the Rewrite function of the proxy.
+func (hooks *proxyHooks) rewriteRequest(r *httputil.ProxyRequest) {
+	ctx := context.WithValue(r.Out.Context(), proxyInKey{}, r.In)
+	if hooks.body {
+		// The body hook can only read responses that are not compressed
+		r.Out.Header.Del("Accept-Encoding")
+	}
+	if hooks.request {
+		var table *lua.LTable
+		err := hooks.call("request", func(L *lua.LState) []lua.LValue {
+			table = headerTable(L, r.Out.Header)
+			return []lua.LValue{table, infoTable(L, r.In)}
+		}, func(*lua.LState, lua.LValue) {
+			applyHeaderTable(table, r.Out.Header)
+		})
+		if err != nil {
+			ctx = context.WithValue(ctx, proxyHookErrorKey{}, err)
+		}
+	}
+	r.Out = r.Out.WithContext(ctx)
+}
+
+// modifyResponse runs the response and body hooks. Called from the
+// ModifyResponse function of the proxy, after the body has been peeked at.
+func (hooks *proxyHooks) modifyResponse(res *http.Response) error {
+	in, ok := res.Request.Context().Value(proxyInKey{}).(*http.Request)
+	if !ok {
+		in = res.Request
+	}
+	if hooks.response {
+		var table *lua.LTable
+		err := hooks.call("response", func(L *lua.LState) []lua.LValue {
+			table = headerTable(L, res.Header)
+			return []lua.LValue{table, lua.LNumber(res.StatusCode), infoTable(L, in)}
+		}, func(*lua.LState, lua.LValue) {
+			applyHeaderTable(table, res.Header)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !hooks.body || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		return nil
+	}
+	if encoding := res.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxHookBodySize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxHookBodySize {
+		// Too large, send it unchanged
+		res.Body = &peekedBody{Reader: io.MultiReader(bytes.NewReader(data), res.Body), Closer: res.Body}
+		return nil
+	}
+	res.Body.Close()
+	err = hooks.call("body", func(L *lua.LState) []lua.LValue {
+		return []lua.LValue{lua.LString(data), infoTable(L, in)}
+	}, func(_ *lua.LState, ret lua.LValue) {
+		if s, ok := ret.(lua.LString); ok {
+			data = []byte(s)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(data))
+	res.ContentLength = int64(len(data))
+	res.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return nil
+}
+
+// hookTransport refuses to send requests where the request hook failed
+type hookTransport struct {
+	http.RoundTripper
+}
+
+func (t hookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err, ok := req.Context().Value(proxyHookErrorKey{}).(error); ok {
+		return nil, err
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	lua "github.com/xyproto/gopher-lua"
+)
+
+// newTestHookedProxy runs a script with an AddReverseProxy call the same way
+// as RunConfiguration, and returns the configuration
+func newTestHookedProxy(t *testing.T, script string) *ReverseProxyConfig {
+	t.Helper()
+	ac := &Config{}
+
+	L := lua.NewState()
+	defer L.Close()
+	ac.loadServerSettingsFunctions(L, "serverconf.lua")
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ac.reverseProxyConfig.Close)
+
+	poolL := lua.NewState()
+	loadProxyHookFunctions(poolL)
+	if err := poolL.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	pool := newHandlerPool(1)
+	pool.Add(poolL)
+	t.Cleanup(pool.Close)
+	for _, hooks := range ac.proxyHooks {
+		hooks.pool = pool
+	}
+	return ac.reverseProxyConfig
+}
+
+func TestProxyHooks(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Got-Auth", req.Header.Get("Authorization"))
+		w.Header().Set("X-Got-Cookie", req.Header.Get("Cookie"))
+		if req.URL.Path == "/login" {
+			http.Redirect(w, req, "/home", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, `<a href="/home">home</a>`)
+	}))
+	defer backend.Close()
+
+	rc := newTestHookedProxy(t, `
+AddReverseProxy("/app", {"`+backend.URL+`"}, {
+  request = function(headers, info)
+    headers["Cookie"] = nil
+    headers["Authorization"] = "Bearer secret"
+  end,
+  response = function(headers, status, info)
+    headers["Access-Control-Allow-Origin"] = "*"
+    if headers["Location"] then
+      headers["Location"] = "/app" .. headers["Location"]
+    end
+  end,
+  body = function(body, info)
+    return (body:gsub('href="/', 'href="/app/'))
+  end,
+})
+`)
+
+	req := httptest.NewRequest(http.MethodGet, "/app/", nil)
+	req.Header.Set("Cookie", "session=abc")
+	rec := httptest.NewRecorder()
+	rc.FindMatchingReverseProxy("/app/").ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Got-Auth"); got != "Bearer secret" {
+		t.Errorf("the backend got Authorization %q", got)
+	}
+	if got := rec.Header().Get("X-Got-Cookie"); got != "" {
+		t.Errorf("the backend got Cookie %q, want it stripped", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, "*")
+	}
+	if got := rec.Body.String(); got != `<a href="/app/home">home</a>` {
+		t.Errorf("body = %q", got)
+	}
+
+	rec = httptest.NewRecorder()
+	rc.FindMatchingReverseProxy("/app/login").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/app/login", nil))
+	if got := rec.Header().Get("Location"); got != "/app/home" {
+		t.Errorf("Location = %q, want %q", got, "/app/home")
+	}
+}
+
+// A failing hook must not let the request or response through unchanged
+func TestProxyHookFailure(t *testing.T) {
+	var reached bool
+	backend := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		reached = true
+	}))
+	defer backend.Close()
+
+	rc := newTestHookedProxy(t, `
+AddReverseProxy("/app", {"`+backend.URL+`"}, {
+  request = function(headers, info)
+    error("no token")
+  end,
+})
+`)
+	rec := httptest.NewRecorder()
+	rc.FindMatchingReverseProxy("/app/").ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/app/", nil))
+	if rec.Code != http.StatusBadGateway || reached {
+		t.Errorf("status = %d and reached = %v, want %d and false", rec.Code, reached, http.StatusBadGateway)
+	}
+	if strings.Contains(rec.Body.String(), "no token") {
+		t.Error("the Lua error must not be sent to the client")
+	}
+}
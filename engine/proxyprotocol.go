@@ -0,0 +1,211 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// proxyProtocolTimeout is how long a new connection has for sending the
+// PROXY protocol header
+const proxyProtocolTimeout = 5 * time.Second
+
+// proxyProtocolV1Prefix starts the text header of PROXY protocol v1
+const proxyProtocolV1Prefix = "PROXY "
+
+// proxyProtocolV1MaxLength is the longest possible v1 header, including CRLF
+const proxyProtocolV1MaxLength = 107
+
+// proxyProtocolV2Signature starts the binary header of PROXY protocol v2
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	errProxyProtocolHeader    = errors.New("invalid PROXY protocol header")
+	errProxyProtocolUntrusted = errors.New("PROXY protocol header from a peer that is not a trusted proxy")
+)
+
+// proxyProtocolListener reads a PROXY protocol header at the start of every
+// accepted connection, so that the address of the client becomes the remote
+// address of the connection
+type proxyProtocolListener struct {
+	net.Listener
+	trusted func(net.IP) bool
+}
+
+// Accept waits for the next connection. The header is read when the
+// connection is first used, so that a slow peer can not block Accept.
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn), trusted: l.trusted}, nil
+}
+
+// proxyProtocolConn is a connection that starts with a PROXY protocol header
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	trusted func(net.IP) bool
+	once    sync.Once
+	remote  net.Addr // the client, or nil for the address of the peer
+	err     error
+}
+
+// readHeader reads the PROXY protocol header, once
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		// Peers on Unix sockets are local, and can always send the header
+		if tcpAddr, ok := c.Conn.RemoteAddr().(*net.TCPAddr); ok && !c.trusted(tcpAddr.IP) {
+			c.err = errProxyProtocolUntrusted
+			logrus.Warnf("%v: %s", c.err, c.Conn.RemoteAddr())
+			c.Conn.Close()
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		c.remote, c.err = readProxyProtocolHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			logrus.Warnf("%v from %s", c.err, c.Conn.RemoteAddr())
+			// Close the connection, so that nothing is sent back
+			c.Conn.Close()
+		}
+	})
+}
+
+// Read reads from the connection, after the header
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the address of the client, from the header
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader reads a v1 or v2 PROXY protocol header. The
+// returned address is nil if the header does not have a client address,
+// like for health checks from the proxy itself.
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	signature, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, errProxyProtocolHeader
+	}
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(r)
+	}
+	if strings.HasPrefix(string(signature), proxyProtocolV1Prefix) {
+		return readProxyProtocolV1(r)
+	}
+	return nil, errProxyProtocolHeader
+}
+
+// readProxyProtocolV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errProxyProtocolHeader
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyProtocolHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyProtocolHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errProxyProtocolHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2 reads a binary header. Only the addresses of TCP over
+// IPv4 and IPv6 are used, the TLVs after the addresses are skipped.
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errProxyProtocolHeader
+	}
+	versionCommand, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+	if versionCommand>>4 != 2 {
+		return nil, errProxyProtocolHeader
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errProxyProtocolHeader
+	}
+	switch versionCommand & 0x0f {
+	case 0x0: // LOCAL, the connection is from the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errProxyProtocolHeader
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if length < 12 {
+			return nil, errProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if length < 36 {
+			return nil, errProxyProtocolHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	}
+	// UDP, Unix sockets or unspecified
+	return nil, nil
+}
+
+// proxyProtocolWrapper returns a function that wraps listeners so that they
+// read PROXY protocol headers. Only the trusted proxies may connect.
+func (ac *Config) proxyProtocolWrapper() func(net.Listener) net.Listener {
+	return func(l net.Listener) net.Listener {
+		return &proxyProtocolListener{Listener: l, trusted: ac.isTrustedProxy}
+	}
+}
+
+// checkProxyProtocol returns an error if the PROXY protocol is enabled for a
+// listener, but no trusted proxies are given, since any client could then
+// choose its own address
+func (ac *Config) checkProxyProtocol() error {
+	if len(ac.trustedProxies) > 0 {
+		return nil
+	}
+	for _, ps := range ac.serve.portSettings {
+		if ps.ProxyProtocol {
+			return errors.New("the PROXY protocol is enabled for " + ps.Addr + ", but no trusted proxies are given (use --trusted-proxy or SetTrustedProxies)")
+		}
+	}
+	return nil
+}
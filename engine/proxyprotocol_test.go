@@ -0,0 +1,156 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// proxyProtocolV2Header builds a binary header for TCP over IPv4
+func proxyProtocolV2Header(command byte, src net.IP, srcPort uint16) []byte {
+	var b bytes.Buffer
+	b.Write(proxyProtocolV2Signature)
+	b.WriteByte(0x20 | command)
+	b.WriteByte(0x11)
+	binary.Write(&b, binary.BigEndian, uint16(12+3)) // with a TLV of 3 bytes
+	b.Write(src.To4())
+	b.Write(net.IPv4(192, 0, 2, 2).To4())
+	binary.Write(&b, binary.BigEndian, srcPort)
+	binary.Write(&b, binary.BigEndian, uint16(443))
+	b.Write([]byte{0x04, 0x00, 0x00}) // PP2_TYPE_NOOP
+	return b.Bytes()
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string // "" for no address
+		fail   bool
+	}{
+		{"PROXY TCP4 198.51.100.7 192.0.2.2 56324 443\r\n", "198.51.100.7:56324", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 4711 443\r\n", "[2001:db8::1]:4711", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{string(proxyProtocolV2Header(0x1, net.IPv4(198, 51, 100, 7), 56324)), "198.51.100.7:56324", false},
+		{string(proxyProtocolV2Header(0x0, net.IPv4(198, 51, 100, 7), 56324)), "", false},
+		{"PROXY TCP4 2001:db8::1 192.0.2.2 56324 443\r\n", "", true},
+		{"PROXY TCP4 198.51.100.7 192.0.2.2 56324\r\n", "", true},
+		{"PROXY TCP4 198.51.100.7 192.0.2.2 56324 443\n", "", true},
+		{"GET / HTTP/1.1\r\n", "", true},
+		{"PROXY " + strings.Repeat("x", 200) + "\r\n", "", true},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.header + "GET / HTTP/1.1\r\n"))
+		addr, err := readProxyProtocolHeader(r)
+		if test.fail {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.header, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.header, got, test.want)
+		}
+		// The request after the header must be left for the server
+		if rest, _ := io.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%q: got %q after the header", test.header, rest)
+		}
+	}
+}
+
+// serveProxyProtocol serves the remote address over a listener that reads
+// PROXY protocol headers, and returns the address to connect to
+func serveProxyProtocol(t *testing.T, ac *Config) string {
+	t.Helper()
+	gs := &GracefulServer{
+		Server: &http.Server{
+			Addr: "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				io.WriteString(w, req.RemoteAddr)
+			}),
+		},
+		WrapListener: ac.proxyProtocolWrapper(),
+	}
+	l, err := gs.listen(":http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gs.Server.Serve(l)
+	t.Cleanup(func() { gs.Server.Close() })
+	return l.Addr().String()
+}
+
+// sendWithHeader sends a PROXY protocol header and a request, and returns
+// the response body, or an error
+func sendWithHeader(addr, header string) (string, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	io.WriteString(conn, header+"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	return string(body), err
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveProxyProtocol(t, &Config{trustedProxies: trustedProxies})
+	body, err := sendWithHeader(addr, "PROXY TCP4 198.51.100.7 192.0.2.2 56324 443\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "198.51.100.7:56324" {
+		t.Errorf("got remote address %q, want 198.51.100.7:56324", body)
+	}
+	if _, err := sendWithHeader(addr, ""); err == nil {
+		t.Error("expected the connection without a header to be refused")
+	}
+}
+
+func TestProxyProtocolUntrustedPeer(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveProxyProtocol(t, &Config{trustedProxies: trustedProxies})
+	if _, err := sendWithHeader(addr, "PROXY TCP4 198.51.100.7 192.0.2.2 56324 443\r\n"); err == nil {
+		t.Error("expected the connection from a peer that is not trusted to be refused")
+	}
+}
+
+func TestCheckProxyProtocol(t *testing.T) {
+	ac := &Config{}
+	ac.serve.portSettings = []PortSetting{{Addr: ":8080", Protocol: "http", ProxyProtocol: true}}
+	if err := ac.checkProxyProtocol(); err == nil {
+		t.Error("expected an error for the PROXY protocol without trusted proxies")
+	}
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.trustedProxies = trustedProxies
+	if err := ac.checkProxyProtocol(); err != nil {
+		t.Error(err)
+	}
+}
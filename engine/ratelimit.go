@@ -0,0 +1,256 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyproto/algernon/themes"
+)
+
+// What the requests can be rate limited by
+const (
+	RateLimitByIP     = "ip"      // the client IP, the default
+	RateLimitByUser   = "user"    // the logged in user, or the client IP
+	RateLimitByHeader = "header:" // the value of a header, like "header:X-API-Key", or the client IP
+)
+
+// rateLimitCleanupInterval is how often buckets that are full are removed
+const rateLimitCleanupInterval = time.Minute
+
+// RateLimit is a rate limit for the requests that have a path prefix
+type RateLimit struct {
+	Prefix string  // path prefix, like "/api"
+	RPS    float64 // requests per second
+	Burst  int     // requests that can be made at once, after some time without requests
+	By     string  // RateLimitByIP, RateLimitByUser or RateLimitByHeader followed by a header name
+}
+
+// Validate fills in default values and checks the options
+func (rl *RateLimit) Validate() error {
+	if rl.RPS <= 0 {
+		return errors.New("the number of requests per second must be larger than 0")
+	}
+	if rl.Burst <= 0 {
+		rl.Burst = int(math.Max(1, math.Ceil(rl.RPS)))
+	}
+	switch {
+	case rl.By == "":
+		rl.By = RateLimitByIP
+	case rl.By == RateLimitByIP, rl.By == RateLimitByUser:
+	case strings.HasPrefix(rl.By, RateLimitByHeader) && len(rl.By) > len(RateLimitByHeader):
+	default:
+		return errors.New("unknown rate limit key: " + rl.By + ", use ip, user or header:Header-Name")
+	}
+	return nil
+}
+
+// rateLimitResult is the outcome of taking a token from a bucket
+type rateLimitResult struct {
+	allowed    bool
+	remaining  int           // tokens left in the bucket
+	retryAfter time.Duration // until a token is available, if not allowed
+	reset      time.Duration // until the bucket is full again
+}
+
+// tokenBucket is the state of one bucket
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time that has passed since the last
+// request, and then takes a token from it, if there is one
+func (b *tokenBucket) take(rps float64, burst int, now time.Time) rateLimitResult {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+elapsed*rps)
+	}
+	b.last = now
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return newRateLimitResult(allowed, b.tokens, rps, burst)
+}
+
+// newRateLimitResult describes a bucket with the given number of tokens left,
+// after a token has been taken, if it was allowed
+func newRateLimitResult(allowed bool, tokens, rps float64, burst int) rateLimitResult {
+	result := rateLimitResult{allowed: allowed, remaining: int(tokens)}
+	if !allowed {
+		result.retryAfter = time.Duration((1 - tokens) / rps * float64(time.Second))
+	}
+	result.reset = time.Duration((float64(burst) - tokens) / rps * float64(time.Second))
+	return result
+}
+
+// full checks if the bucket would be full by now, so that it can be forgotten
+func (b *tokenBucket) full(rps float64, burst int, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rps >= float64(burst)
+}
+
+// rateLimitStore keeps the token buckets, by key
+type rateLimitStore interface {
+	take(key string, rps float64, burst int) rateLimitResult
+}
+
+// memoryRateLimitStore keeps the token buckets in memory
+type memoryRateLimitStore struct {
+	mut         sync.Mutex
+	buckets     map[string]*memoryBucket
+	lastCleanup time.Time
+}
+
+// memoryBucket is a token bucket, and the rate it is refilled with
+type memoryBucket struct {
+	tokenBucket
+	rps   float64
+	burst int
+}
+
+// newMemoryRateLimitStore creates a store for token buckets in memory
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*memoryBucket), lastCleanup: time.Now()}
+}
+
+func (s *memoryRateLimitStore) take(key string, rps float64, burst int) rateLimitResult {
+	now := time.Now()
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if now.Sub(s.lastCleanup) > rateLimitCleanupInterval {
+		for k, b := range s.buckets {
+			if b.full(b.rps, b.burst, now) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastCleanup = now
+	}
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{rps: rps, burst: burst}
+		s.buckets[key] = b
+	}
+	return b.take(rps, burst, now)
+}
+
+// rateLimitedKey is the context key that marks requests that have been
+// checked by one of the rate limits from SetRateLimit
+type rateLimitedKey struct{}
+
+// rateLimitBuckets returns the store for the token buckets
+func (ac *Config) rateLimitBuckets() rateLimitStore {
+	ac.rateLimitOnce.Do(func() {
+		if ac.rateLimitStore == nil {
+			ac.rateLimitStore = newMemoryRateLimitStore()
+		}
+	})
+	return ac.rateLimitStore
+}
+
+// isAdmin checks if the request is from a logged in administrator, who is
+// not rate limited
+func (ac *Config) isAdmin(req *http.Request) bool {
+	return ac.perm != nil && ac.perm.UserState().AdminRights(req)
+}
+
+// clientKey returns what a request is rate limited by
+func (ac *Config) clientKey(req *http.Request, by string) string {
+	switch {
+	case by == RateLimitByUser:
+		if ac.perm != nil {
+			if username := ac.perm.UserState().Username(req); username != "" {
+				return "user:" + username
+			}
+		}
+	case strings.HasPrefix(by, RateLimitByHeader):
+		if value := req.Header.Get(by[len(RateLimitByHeader):]); value != "" {
+			return by + ":" + value
+		}
+	}
+	// Fall back on the client IP, which has been resolved by realIPMiddleware
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return "ip:" + req.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// allowRequest takes a token from the bucket with the given key and sets the
+// RateLimit headers. If there was no token, and the request is not from an
+// administrator, the rate limit page is served and false is returned.
+func (ac *Config) allowRequest(w http.ResponseWriter, req *http.Request, key string, rps float64, burst int, theme string) bool {
+	result := ac.rateLimitBuckets().take(key, rps, burst)
+	seconds := func(d time.Duration) string {
+		return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+	w.Header().Set("RateLimit-Reset", seconds(result.reset))
+	if result.allowed || ac.isAdmin(req) {
+		return true
+	}
+	w.Header().Set("Retry-After", seconds(result.retryAfter))
+	w.Header().Set("Content-Type", htmlUTF8)
+	w.WriteHeader(http.StatusTooManyRequests)
+	io.WriteString(w, themes.MessagePage("Rate-limit exceeded", "<div style='color:red'>You have reached the maximum request limit.</div>", theme))
+	return false
+}
+
+// findRateLimit returns the rate limit with the longest prefix that matches
+// the path, or nil
+func (ac *Config) findRateLimit(path string) *RateLimit {
+	var found *RateLimit
+	for _, rl := range ac.rateLimits {
+		if strings.HasPrefix(path, rl.Prefix) && (found == nil || len(rl.Prefix) > len(found.Prefix)) {
+			found = rl
+		}
+	}
+	return found
+}
+
+// rateLimitMiddleware applies the rate limits from SetRateLimit. Requests
+// that match one of them are not limited by the default limit as well.
+func (ac *Config) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rl := ac.findRateLimit(req.URL.Path)
+		if rl == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if !ac.allowRequest(w, req, rl.Prefix+"|"+ac.clientKey(req, rl.By), rl.RPS, rl.Burst, ac.defaultTheme) {
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), rateLimitedKey{}, true)))
+	})
+}
+
+// handleLimited registers a handler function on the mux, behind the default
+// rate limit (--limit) unless rate limiting has been disabled. Each client
+// has a bucket per path, and the administrators are not limited.
+func (ac *Config) handleLimited(mux *http.ServeMux, pattern string, handlerFunc http.HandlerFunc, theme string) {
+	// Handle requests differently depending on rate limiting being enabled or not
+	if ac.disableRateLimiting || ac.limitRequests <= 0 {
+		mux.HandleFunc(pattern, handlerFunc)
+		return
+	}
+	rps := float64(ac.limitRequests)
+	burst := int(math.Max(1, rps))
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, req *http.Request) {
+		if limited, _ := req.Context().Value(rateLimitedKey{}).(bool); limited {
+			handlerFunc(w, req)
+			return
+		}
+		if ac.allowRequest(w, req, ac.clientKey(req, RateLimitByIP)+"|"+req.URL.Path, rps, burst, theme) {
+			handlerFunc(w, req)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range 3 {
+		if result := b.take(1, 3, now); !result.allowed || result.remaining != 2-i {
+			t.Fatalf("request %d: got %+v, want allowed with %d remaining", i+1, result, 2-i)
+		}
+	}
+	result := b.take(1, 3, now)
+	if result.allowed || result.retryAfter != time.Second {
+		t.Errorf("got %+v, want denied with a second until the next token", result)
+	}
+	if result.reset != 3*time.Second {
+		t.Errorf("got %s until the bucket is full, want 3s", result.reset)
+	}
+	if result := b.take(1, 3, now.Add(1500*time.Millisecond)); !result.allowed {
+		t.Errorf("expected a token after 1.5 seconds, got %+v", result)
+	}
+	if !b.full(1, 3, now.Add(time.Minute)) {
+		t.Error("expected the bucket to be full after a minute")
+	}
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	rl := RateLimit{Prefix: "/api", RPS: 2.5}
+	if err := rl.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if rl.Burst != 3 || rl.By != RateLimitByIP {
+		t.Errorf("got burst %d and by %q, want 3 and ip", rl.Burst, rl.By)
+	}
+	for _, invalid := range []RateLimit{{RPS: 0}, {RPS: 1, By: "cookie"}, {RPS: 1, By: "header:"}} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", invalid)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	ac := &Config{limitRequests: 1}
+	for _, rl := range []*RateLimit{
+		{Prefix: "/api", RPS: 1, Burst: 2, By: "header:X-API-Key"},
+		{Prefix: "/api/login", RPS: 1, Burst: 1},
+	} {
+		if err := rl.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		ac.rateLimits = append(ac.rateLimits, rl)
+	}
+	mux := http.NewServeMux()
+	ac.handleLimited(mux, "/", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}, "default")
+	handler := ac.rateLimitMiddleware(mux)
+
+	get := func(path, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "198.51.100.7:1234"
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The burst of the /api limit is used instead of the default limit of 1
+	for i := range 2 {
+		if rec := get("/api/users", "a"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d with key a: got %d, want 200", i+1, rec.Code)
+		}
+	}
+	rec := get("/api/users", "a")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "1" || rec.Header().Get("RateLimit-Limit") != "2" || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("got the headers %v", rec.Header())
+	}
+	// Another API key has its own bucket
+	if rec := get("/api/users", "b"); rec.Code != http.StatusOK {
+		t.Errorf("with key b: got %d, want 200", rec.Code)
+	}
+	// The longest prefix is used
+	get("/api/login", "")
+	if rec := get("/api/login", ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second login: got %d, want 429", rec.Code)
+	}
+	// Paths without a rate limit of their own get the default limit, per path
+	get("/index.html", "")
+	if rec := get("/index.html", ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second request for /index.html: got %d, want 429", rec.Code)
+	}
+	if rec := get("/style.css", ""); rec.Code != http.StatusOK {
+		t.Errorf("first request for /style.css: got %d, want 200", rec.Code)
+	}
+}
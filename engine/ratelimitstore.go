@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/sirupsen/logrus"
+	"github.com/xyproto/pinterface/v2"
+	"github.com/xyproto/simpleredis/v2"
+)
+
+// Where the token buckets for the rate limits can be kept
+const (
+	RateLimitStoreMemory   = "memory"   // in memory, for each instance, the default
+	RateLimitStoreDatabase = "database" // in Redis, shared by all instances that use it
+)
+
+// rateLimitKeyPrefix is the prefix for the token buckets in Redis
+const rateLimitKeyPrefix = "algernon:ratelimit:"
+
+// redisErrorLogInterval is how often an error from Redis is logged, when
+// every request fails in the same way
+const redisErrorLogInterval = time.Minute
+
+// redisTokenBucketScript takes a token from a bucket that is stored in a
+// Redis hash, atomically, with the clock of the Redis server, so that all
+// instances agree. Returns 1 or 0 for if it was allowed, and the tokens left.
+// The script is sent by its SHA1 hash, and only sent in full when Redis has
+// not seen it before.
+var redisTokenBucketScript = redis.NewScript(1, `
+if redis.replicate_commands then redis.replicate_commands() end
+local rps = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+local tokens = tonumber(redis.call("HGET", KEYS[1], "tokens"))
+local last = tonumber(redis.call("HGET", KEYS[1], "last"))
+if tokens == nil or last == nil then
+  tokens = burst
+else
+  tokens = math.min(burst, tokens + math.max(0, now - last) * rps)
+end
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil((burst - tokens) / rps * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// redisHost is implemented by the user state of the Redis backend
+type redisHost interface {
+	Pool() *simpleredis.ConnectionPool
+	DatabaseIndex() int
+}
+
+// redisRateLimitStore keeps the token buckets in Redis. The buckets expire
+// when they are full.
+type redisRateLimitStore struct {
+	pool         *simpleredis.ConnectionPool
+	dbindex      int
+	lastErrorLog atomic.Int64 // when an error was last logged, in Unix nanoseconds
+}
+
+func (s *redisRateLimitStore) take(key string, rps float64, burst int) rateLimitResult {
+	conn := s.pool.Get(s.dbindex)
+	defer conn.Close()
+	reply, err := redisTokenBucketScript.Do(conn, rateLimitKeyPrefix+key, rps, burst)
+	values, ok := reply.([]any)
+	if err != nil || !ok || len(values) != 2 {
+		if err == nil {
+			err = errors.New("unexpected reply: " + strconv.Quote(fmt.Sprint(reply)))
+		}
+		// Let the request through rather than failing every request
+		s.logError(err)
+		return newRateLimitResult(true, float64(burst), rps, burst)
+	}
+	allowed, _ := values[0].(int64)
+	tokenBytes, _ := values[1].([]byte)
+	tokens, _ := strconv.ParseFloat(string(tokenBytes), 64)
+	return newRateLimitResult(allowed == 1, tokens, rps, burst)
+}
+
+// logError logs an error from Redis, but at most once every
+// redisErrorLogInterval, so that the log is not flooded while Redis is down
+func (s *redisRateLimitStore) logError(err error) {
+	now := time.Now().UnixNano()
+	last := s.lastErrorLog.Load()
+	if now-last < int64(redisErrorLogInterval) || !s.lastErrorLog.CompareAndSwap(last, now) {
+		return
+	}
+	logrus.Error("rate limit: could not use Redis, letting requests through: ", err)
+}
+
+// newDatabaseRateLimitStore creates a store for the token buckets in the
+// given database backend, where dbName is the name of the backend. Only
+// Redis is supported, since it can update the buckets atomically for all
+// the instances that share it. A Bolt file can only be used by one instance,
+// and the buckets are then kept in memory instead, with the default store.
+func newDatabaseRateLimitStore(perm pinterface.IPermissions, dbName string) (rateLimitStore, error) {
+	if perm == nil {
+		return nil, errors.New("sharing the rate limits needs a database backend")
+	}
+	host, ok := perm.UserState().(redisHost)
+	if !ok {
+		return nil, errors.New("the rate limits can only be shared in Redis, not in " + dbName + ", use --ratelimit-store=memory")
+	}
+	return &redisRateLimitStore{pool: host.Pool(), dbindex: host.DatabaseIndex()}, nil
+}
@@ -0,0 +1,40 @@
+package engine
+
+import (
+	"path/filepath"
+	"testing"
+
+	bolt "github.com/xyproto/permissionbolt/v2"
+	"github.com/xyproto/simpleredis/v2"
+)
+
+func TestDatabaseRateLimitStore(t *testing.T) {
+	if _, err := newDatabaseRateLimitStore(nil, ""); err == nil {
+		t.Error("expected an error without a database backend")
+	}
+	// A Bolt file can not be shared between instances
+	perm, err := bolt.NewWithConf(filepath.Join(t.TempDir(), "ratelimit.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newDatabaseRateLimitStore(perm, "Bolt (ratelimit.db)"); err == nil {
+		t.Error("expected an error for Bolt")
+	}
+}
+
+func TestRedisRateLimitStoreDown(t *testing.T) {
+	// Nothing listens on port 1, so every request fails
+	store := &redisRateLimitStore{pool: simpleredis.NewConnectionPoolHost("127.0.0.1:1")}
+	t.Cleanup(store.pool.Close)
+	if result := store.take("/api|ip:198.51.100.7", 1, 2); !result.allowed {
+		t.Errorf("got %+v, want the request to be let through while Redis is down", result)
+	}
+	logged := store.lastErrorLog.Load()
+	if logged == 0 {
+		t.Fatal("expected the error to be logged")
+	}
+	store.take("/api|ip:198.51.100.7", 1, 2)
+	if store.lastErrorLog.Load() != logged {
+		t.Error("expected the error to only be logged once per interval")
+	}
+}
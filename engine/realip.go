@@ -0,0 +1,147 @@
+package engine
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseTrustedProxies parses a list of trusted proxies, given as IP addresses
+// or as CIDR ranges, like "10.0.0.0/8"
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range proxies {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("invalid IP address for a trusted proxy: " + s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.New("invalid CIDR range for a trusted proxy: " + s)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy checks if the given IP address is one of the trusted proxies
+func (ac *Config) isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range ac.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedIP parses an IP address from X-Forwarded-For or from the
+// "for" parameter of Forwarded, which may be quoted and have a port
+func parseForwardedIP(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// defaultForwardedHeader is the header that the client IP is taken from,
+// unless --forwarded-header or SetForwardedHeader is used
+const defaultForwardedHeader = "X-Forwarded-For"
+
+// parseForwardedHeader checks that the client IP can be taken from the given
+// header, and returns the canonical name of it
+func parseForwardedHeader(name string) (string, error) {
+	switch header := http.CanonicalHeaderKey(strings.TrimSpace(name)); header {
+	case "X-Forwarded-For", "Forwarded":
+		return header, nil
+	}
+	return "", errors.New("unknown forwarding header: " + name + ", use X-Forwarded-For or Forwarded")
+}
+
+// forwardedFor returns the addresses that the request was forwarded for, from
+// the given header, which is either Forwarded or X-Forwarded-For. Only the
+// header that the trusted proxies set is read, since a proxy passes the
+// other one on as the client sent it. The client that the first proxy saw
+// comes first.
+func forwardedFor(req *http.Request, headerName string) []string {
+	var addrs []string
+	if headerName != "Forwarded" {
+		for _, header := range req.Header.Values("X-Forwarded-For") {
+			addrs = append(addrs, strings.Split(header, ",")...)
+		}
+		return addrs
+	}
+	for _, header := range req.Header.Values("Forwarded") {
+		for _, element := range strings.Split(header, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					addrs = append(addrs, value)
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// clientIP returns the IP address of the client. The forwarding headers are
+// only looked at when the request comes from a trusted proxy, and then the
+// addresses are followed from the right, past the trusted proxies, so that
+// a client can not choose its own IP address by sending the headers.
+func (ac *Config) clientIP(req *http.Request) string {
+	peer, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		peer = req.RemoteAddr
+	}
+	if !ac.isTrustedProxy(net.ParseIP(peer)) {
+		return peer
+	}
+	client := peer
+	headerName := ac.forwardedHeader
+	if headerName == "" {
+		headerName = defaultForwardedHeader
+	}
+	addrs := forwardedFor(req, headerName)
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := parseForwardedIP(addrs[i])
+		if ip == nil {
+			// Obfuscated or unknown, like "for=unknown"
+			break
+		}
+		client = ip.String()
+		if !ac.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// realIPMiddleware replaces the remote address of requests from trusted
+// proxies with the address of the client, so that the access logs, the rate
+// limiting, the error pages and the Lua functions all see the client
+func (ac *Config) realIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if peer, port, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			if client := ac.clientIP(req); client != peer {
+				req.RemoteAddr = net.JoinHostPort(client, port)
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		forwardedHeader string // the header that the proxies set, or "" for the default
+		remoteAddr      string
+		header          string
+		value           string
+		want            string
+	}{
+		// Not from a trusted proxy, so the header is ignored
+		{"", "203.0.113.9:1234", "X-Forwarded-For", "127.0.0.1", "203.0.113.9"},
+		{"", "10.1.2.3:1234", "X-Forwarded-For", "203.0.113.9", "203.0.113.9"},
+		{"", "192.0.2.1:1234", "X-Forwarded-For", "203.0.113.9", "203.0.113.9"},
+		// The address that the client sent itself is skipped
+		{"", "10.1.2.3:1234", "X-Forwarded-For", "127.0.0.1, 198.51.100.7, 10.9.9.9", "198.51.100.7"},
+		{"Forwarded", "10.1.2.3:1234", "Forwarded", `for=198.51.100.7;proto=https, for="[2001:db8::1]:4711"`, "198.51.100.7"},
+		{"Forwarded", "10.1.2.3:1234", "Forwarded", `for="[2001:db9::1]:4711"`, "2001:db9::1"},
+		{"Forwarded", "10.1.2.3:1234", "Forwarded", "for=unknown", "10.1.2.3"},
+		{"", "10.1.2.3:1234", "X-Forwarded-For", "", "10.1.2.3"},
+		// Only the header that the proxies set is read
+		{"", "10.1.2.3:1234", "Forwarded", "for=127.0.0.1", "10.1.2.3"},
+		{"Forwarded", "10.1.2.3:1234", "X-Forwarded-For", "127.0.0.1", "10.1.2.3"},
+		// Only trusted proxies in the chain
+		{"", "10.1.2.3:1234", "X-Forwarded-For", "10.4.4.4, 10.5.5.5", "10.4.4.4"},
+	}
+	for _, test := range tests {
+		ac := &Config{trustedProxies: trustedProxies, forwardedHeader: test.forwardedHeader}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.value != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		if got := ac.clientIP(req); got != test.want {
+			t.Errorf("%s with %s: %q: got %s, want %s", test.remoteAddr, test.header, test.value, got, test.want)
+		}
+	}
+
+	// A client can not choose its own IP address by sending a Forwarded
+	// header through a proxy that only appends to X-Forwarded-For
+	ac := &Config{trustedProxies: trustedProxies}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("Forwarded", "for=127.0.0.1")
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	if got := ac.clientIP(req); got != "198.51.100.7" {
+		t.Errorf("got %s from a spoofed Forwarded header, want 198.51.100.7 from X-Forwarded-For", got)
+	}
+
+	if _, err := parseForwardedHeader("x-forwarded-for"); err != nil {
+		t.Error(err)
+	}
+	if _, err := parseForwardedHeader("X-Real-IP"); err == nil {
+		t.Error("expected an error for an unsupported header")
+	}
+
+	if _, err := parseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an error for an invalid CIDR range")
+	}
+	if _, err := parseTrustedProxies([]string{"localhost"}); err == nil {
+		t.Error("expected an error for a host name")
+	}
+}
+
+func TestRealIPMiddleware(t *testing.T) {
+	trustedProxies, err := parseTrustedProxies([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac := &Config{trustedProxies: trustedProxies}
+	var remoteAddr string
+	var loopback bool
+	handler := ac.realIPMiddleware(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		remoteAddr, loopback = req.RemoteAddr, isLoopback(req)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:5555"
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if remoteAddr != "203.0.113.9:5555" || loopback {
+		t.Errorf("got %s (loopback: %v), want 203.0.113.9:5555", remoteAddr, loopback)
+	}
+}
@@ -1,11 +1,74 @@
 package engine
 
 import (
+	"bufio"
 	"bytes"
+	"net"
 	"net/http"
 	"net/http/httptest"
 )
 
+// statusRecorder records the status code and the number of bytes of a
+// response, for the access log, while writing it through to the client.
+// Flush and Hijack are passed through, and Unwrap lets
+// http.ResponseController reach the rest of the wrapped ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	written int64
+	status  int // 0 until the header has been written
+}
+
+// newStatusRecorder wraps the given ResponseWriter
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w}
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	// Informational responses, like 103 Early Hints, are followed by the real one
+	if sr.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(p)
+	sr.written += int64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the client
+func (sr *statusRecorder) Flush() {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	http.NewResponseController(sr.ResponseWriter).Flush()
+}
+
+// Hijack passes WebSocket upgrades through, while recording that the
+// connection was upgraded, so that the access log gets a status code
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(sr.ResponseWriter).Hijack()
+	if err == nil && sr.status == 0 {
+		sr.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter { return sr.ResponseWriter }
+
+// Status returns the status code that was sent to the client. If nothing has
+// been written, the server will reply with 200 OK when the handler returns.
+func (sr *statusRecorder) Status() int {
+	if sr.status == 0 {
+		return http.StatusOK
+	}
+	return sr.status
+}
+
 // WriteRecorder writes to a ResponseWriter from a ResponseRecorder.
 // Also flushes the recorder and returns how many bytes were written.
 func WriteRecorder(w http.ResponseWriter, recorder *httptest.ResponseRecorder) (int64, error) {
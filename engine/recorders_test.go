@@ -0,0 +1,151 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusRecorder(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sr := newStatusRecorder(rec)
+	if sr.Status() != http.StatusOK {
+		t.Errorf("Status() before writing = %d, want %d", sr.Status(), http.StatusOK)
+	}
+	sr.WriteHeader(http.StatusNotFound)
+	sr.WriteHeader(http.StatusInternalServerError) // superfluous, ignored
+	sr.Write([]byte("not here"))
+	if sr.Status() != http.StatusNotFound {
+		t.Errorf("Status() = %d, want %d", sr.Status(), http.StatusNotFound)
+	}
+	if sr.written != int64(len("not here")) {
+		t.Errorf("written = %d, want %d", sr.written, len("not here"))
+	}
+	if err := http.NewResponseController(sr).Flush(); err != nil {
+		t.Errorf("Flush through the recorder failed: %v", err)
+	}
+	if !rec.Flushed {
+		t.Error("expected the wrapped ResponseWriter to be flushed")
+	}
+}
+
+func TestWithAccessLog(t *testing.T) {
+	logFilename := filepath.Join(t.TempDir(), "access.log")
+	lw, err := openLogWriter(logFilename, defaultLogPermissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lw.Close()
+	ac := &Config{commonAccessLog: lw}
+
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	handler := ac.withAccessLog(func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "hello.txt", modTime, strings.NewReader("hello, world"))
+	})
+
+	// A conditional request for a file that has not changed
+	req := httptest.NewRequest(http.MethodGet, "/hello.txt", nil)
+	req.Header.Set("If-Modified-Since", modTime.Format(http.TimeFormat))
+	handler(httptest.NewRecorder(), req)
+
+	// A request for a part of the file
+	req = httptest.NewRequest(http.MethodGet, "/hello.txt", nil)
+	req.Header.Set("Range", "bytes=0-4")
+	handler(httptest.NewRecorder(), req)
+
+	data, err := os.ReadFile(logFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines in the access log, got:\n%s", data)
+	}
+	if !strings.HasSuffix(lines[0], `" 304 0`) {
+		t.Errorf("expected 304 with 0 bytes to be logged, got: %s", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], `" 206 5`) {
+		t.Errorf("expected 206 with 5 bytes to be logged, got: %s", lines[1])
+	}
+}
+
+func TestAccessLogRateLimited(t *testing.T) {
+	logFilename := filepath.Join(t.TempDir(), "access.log")
+	lw, err := openLogWriter(logFilename, defaultLogPermissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lw.Close()
+	ac := &Config{commonAccessLog: lw, limitRequests: 1}
+
+	mux := http.NewServeMux()
+	ac.handleLimited(mux, "/", func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("hi"))
+	}, "default")
+	handler := ac.withMiddleware(mux)
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, "/index.html", nil)
+		req.RemoteAddr = "198.51.100.7:1234"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	data, err := os.ReadFile(logFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines in the access log, got:\n%s", data)
+	}
+	if !strings.HasSuffix(lines[0], `" 200 2`) {
+		t.Errorf("expected 200 with 2 bytes to be logged, got: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `" 429 `) {
+		t.Errorf("expected the rate limited request to be logged with 429, got: %s", lines[1])
+	}
+}
+
+func TestJSONAccessLog(t *testing.T) {
+	logFilename := filepath.Join(t.TempDir(), "access.log")
+	lw, err := openLogWriter(logFilename, defaultLogPermissions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lw.Close()
+	ac := &Config{combinedAccessLog: lw, accessLogFormat: accessLogJSON}
+
+	handler := requestInfoMiddleware(ac.withAccessLog(func(w http.ResponseWriter, req *http.Request) {
+		setHandlerType(req, "lua")
+		body := make([]byte, 16)
+		n, _ := req.Body.Read(body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body[:n])
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("payload"))
+	req.Header.Set("X-Request-ID", "abc-123")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	data, err := os.ReadFile(logFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry jsonLogEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("the access log line is not JSON: %v\n%s", err, data)
+	}
+	if entry.Status != http.StatusCreated || entry.BytesIn != 7 || entry.BytesOut != 7 {
+		t.Errorf("got status %d, %d bytes in and %d bytes out, want 201, 7 and 7", entry.Status, entry.BytesIn, entry.BytesOut)
+	}
+	if entry.Handler != "lua" || entry.RequestID != "abc-123" || entry.Protocol != "HTTP/1.1" {
+		t.Errorf("got handler %q, request ID %q and protocol %q", entry.Handler, entry.RequestID, entry.Protocol)
+	}
+	if entry.Method != http.MethodPost || entry.URI != "/upload" {
+		t.Errorf("got %s %s, want POST /upload", entry.Method, entry.URI)
+	}
+}
@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/xyproto/algernon/cachemode"
+	"github.com/xyproto/datablock"
+)
+
+// renderedPage is the output of a renderer, alongside the modification time
+// and size of the source file, and the contentSum of the output, for the ETag
+type renderedPage struct {
+	modTime time.Time
+	size    int64
+	data    []byte
+	sum     string
+}
+
+// cacheRendered returns true if the rendered output of the given source file
+// should be kept, by the rules from SetCacheRules, or by the cache mode.
+// Pages with the auto-refresh script are not kept, since the script depends
+// on the request.
+func (ac *Config) cacheRendered(filename, ext string) bool {
+	if ac.cache == nil || ac.autoRefresh {
+		return false
+	}
+	ext = strings.ToLower(ext)
+	if rule := ac.cacheRuleFor(filename, ext); rule != nil {
+		return rule.cache && ac.cacheMode != cachemode.Off
+	}
+	return ac.shouldCache(ext)
+}
+
+// loadRendered returns the kept output for the given source file, if the
+// file has not changed since it was rendered. If the cache is shared, the
+// output is kept in the database backend, with the modification time, size
+// and contentSum as the metadata, which is checked before the output is
+// fetched.
+func (ac *Config) loadRendered(filename string, info os.FileInfo) (renderedPage, bool) {
+	if ac.cacheStore != nil {
+		key := "rendered:" + filepath.Clean(filename)
+		prefix := fileMeta(info) + ","
+		if meta, ok := ac.cacheStore.meta(key); !ok || !strings.HasPrefix(meta, prefix) {
+			return renderedPage{}, false
+		}
+		meta, data, ok := ac.cacheStore.get(key)
+		if !ok || !strings.HasPrefix(meta, prefix) {
+			return renderedPage{}, false
+		}
+		return renderedPage{modTime: info.ModTime(), size: info.Size(), data: data, sum: strings.TrimPrefix(meta, prefix)}, true
+	}
+	v, ok := ac.renderedPages.Load(filename)
+	if !ok {
+		return renderedPage{}, false
+	}
+	page := v.(renderedPage)
+	if !page.modTime.Equal(info.ModTime()) || page.size != info.Size() {
+		return renderedPage{}, false
+	}
+	return page, true
+}
+
+// storeRendered keeps the output for the given source file, in memory or in
+// the shared cache
+func (ac *Config) storeRendered(filename string, info os.FileInfo, page renderedPage) {
+	if ac.cacheStore != nil {
+		ac.cacheStore.set("rendered:"+filepath.Clean(filename), fileMeta(info)+","+page.sum, page.data, ac.cacheTTL)
+		return
+	}
+	ac.renderedPages.Store(filename, page)
+}
+
+// serveRendered sends the kept output for the given source file to a HTTP
+// client, and returns true. If the output has not been kept, or the source
+// file has changed since it was rendered, false is returned.
+func (ac *Config) serveRendered(w http.ResponseWriter, req *http.Request, filename, ext string) bool {
+	if !ac.cacheRendered(filename, ext) {
+		return false
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	page, ok := ac.loadRendered(filename, info)
+	if !ok {
+		return false
+	}
+	ac.serveDataBlock(w, req, filename, page.modTime, page.sum, datablock.NewDataBlock(page.data, true))
+	return true
+}
+
+// renderedToClient sends the output of a renderer to a HTTP client, with the
+// modification time of the source file as Last-Modified. The output is
+// minified, if enabled, before it is kept, and if it is kept, its contentSum
+// is found here, once, instead of for every request.
+func (ac *Config) renderedToClient(w http.ResponseWriter, req *http.Request, filename string, data []byte) {
+	data = ac.minified(data, w.Header().Get(contentType), filename)
+	info, err := os.Stat(filename)
+	if err != nil {
+		ac.DataBlockToClient(w, req, filename, datablock.NewDataBlock(data, true))
+		return
+	}
+	var sum string
+	if ac.cacheRendered(filename, filepath.Ext(filename)) && (ac.cacheMaxEntitySize == 0 || uint64(len(data)) <= ac.cacheMaxEntitySize) {
+		sum = contentSum(data)
+		ac.storeRendered(filename, info, renderedPage{modTime: info.ModTime(), size: info.Size(), data: data, sum: sum})
+	}
+	ac.serveDataBlock(w, req, filename, info.ModTime(), sum, datablock.NewDataBlock(data, true))
+}
@@ -15,6 +15,9 @@ func (markdownRenderer) Extensions() []string { return []string{".md", ".markdow
 
 func (markdownRenderer) Render(ac *Config, w http.ResponseWriter, req *http.Request, filename, ext string) error {
 	w.Header().Add(contentType, htmlUTF8)
+	if ac.serveRendered(w, req, filename, ext) {
+		return nil
+	}
 	mdblock, err := ac.ReadAndLogErrors(w, filename, ext)
 	if err != nil {
 		return nil
@@ -29,11 +32,14 @@ type gcssRenderer struct{}
 func (gcssRenderer) Extensions() []string { return []string{".gcss"} }
 
 func (gcssRenderer) Render(ac *Config, w http.ResponseWriter, req *http.Request, filename, ext string) error {
+	w.Header().Add(contentType, "text/css;charset=utf-8")
+	if ac.serveRendered(w, req, filename, ext) {
+		return nil
+	}
 	gcssblock, err := ac.ReadAndLogErrors(w, filename, ext)
 	if err != nil {
 		return nil
 	}
-	w.Header().Add(contentType, "text/css;charset=utf-8")
 	ac.GCSSPage(w, req, filename, gcssblock.Bytes())
 	return nil
 }
@@ -44,11 +50,14 @@ type scssRenderer struct{}
 func (scssRenderer) Extensions() []string { return []string{".scss"} }
 
 func (scssRenderer) Render(ac *Config, w http.ResponseWriter, req *http.Request, filename, ext string) error {
+	w.Header().Add(contentType, "text/css;charset=utf-8")
+	if ac.serveRendered(w, req, filename, ext) {
+		return nil
+	}
 	scssblock, err := ac.ReadAndLogErrors(w, filename, ext)
 	if err != nil {
 		return nil
 	}
-	w.Header().Add(contentType, "text/css;charset=utf-8")
 	ac.SCSSPage(w, req, filename, scssblock.Bytes())
 	return nil
 }
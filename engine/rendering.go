@@ -419,7 +419,7 @@ func (ac *Config) MarkdownPage(w http.ResponseWriter, req *http.Request, mdConte
 		head.WriteString(stylesheetCSS)
 	case ac.fs.Exists(GCSSFilename):
 		if ac.debugMode {
-			gcssblock, err := ac.cache.Read(GCSSFilename, ac.shouldCache(".gcss"))
+			gcssblock, err := ac.readFile(GCSSFilename, ".gcss")
 			if err != nil {
 				fmt.Fprintf(w, "Unable to read %s: %s", filename, err)
 				return
@@ -451,7 +451,7 @@ func (ac *Config) MarkdownPage(w http.ResponseWriter, req *http.Request, mdConte
 		// If serving a single Markdown file, include the CSS file inline in a style tag
 		if ac.markdownMode && ac.fs.Exists(additionalCSSfile) {
 			// Cache the CSS only if Markdown should be cached
-			cssblock, err := ac.cache.Read(additionalCSSfile, ac.shouldCache(".md"))
+			cssblock, err := ac.readFile(additionalCSSfile, ".md")
 			if err != nil {
 				fmt.Fprintf(w, "Unable to read %s: %s", filename, err)
 				return
@@ -527,7 +527,7 @@ func (ac *Config) MarkdownPage(w http.ResponseWriter, req *http.Request, mdConte
 	}
 
 	// Write the rendered Markdown page to the client
-	ac.DataToClient(w, req, filename, htmldata)
+	ac.renderedToClient(w, req, filename, htmldata)
 }
 
 // PongoPage write the given source bytes (ina Pongo2) converted to HTML, to a writer.
@@ -546,7 +546,7 @@ func (ac *Config) PongoPage(w http.ResponseWriter, req *http.Request, filename s
 		linkInCSS = true
 	} else if ac.fs.Exists(GCSSFilename) {
 		if ac.debugMode {
-			gcssblock, err := ac.cache.Read(GCSSFilename, ac.shouldCache(".gcss"))
+			gcssblock, err := ac.readFile(GCSSFilename, ".gcss")
 			if err != nil {
 				fmt.Fprintf(w, "Unable to read %s: %s", filename, err)
 				return
@@ -722,7 +722,7 @@ func (ac *Config) AmberPage(w http.ResponseWriter, req *http.Request, filename s
 		amberdata = themes.StyleAmber(amberdata, themes.DefaultCSSFilename)
 	} else if ac.fs.Exists(GCSSFilename) {
 		if ac.debugMode {
-			gcssblock, err := ac.cache.Read(GCSSFilename, ac.shouldCache(".gcss"))
+			gcssblock, err := ac.readFile(GCSSFilename, ".gcss")
 			if err != nil {
 				fmt.Fprintf(w, "Unable to read %s: %s", filename, err)
 				return
@@ -816,7 +816,7 @@ func (ac *Config) GCSSPage(w http.ResponseWriter, req *http.Request, filename st
 		return
 	}
 	// Write the resulting CSS to the client
-	ac.DataToClient(w, req, filename, buf.Bytes())
+	ac.renderedToClient(w, req, filename, buf.Bytes())
 }
 
 // JSXPage writes the given source bytes (in JSX) converted to JS, to a writer.
@@ -825,7 +825,7 @@ func (ac *Config) JSXPage(w http.ResponseWriter, req *http.Request, filename str
 	// If the source contains import/require statements, use the full bundler
 	// with on-the-fly caching rather than a single-file transform.
 	if needsBundling(jsxdata) {
-		data, err := ac.bundleFile(filename, jsxdata, false)
+		data, sum, err := ac.bundleFile(filename, jsxdata, false)
 		if err != nil {
 			if ac.debugMode {
 				ac.PrettyError(w, req, filename, jsxdata, err.Error(), "jsx")
@@ -834,7 +834,7 @@ func (ac *Config) JSXPage(w http.ResponseWriter, req *http.Request, filename str
 			}
 			return
 		}
-		ac.DataToClient(w, req, filename, data)
+		ac.bundleToClient(w, req, filename, data, sum)
 		return
 	}
 
@@ -883,7 +883,7 @@ func (ac *Config) TSXPage(w http.ResponseWriter, req *http.Request, filename str
 	// If the source contains import/require statements, use the full bundler
 	// with on-the-fly caching rather than a single-file transform.
 	if needsBundling(tsxdata) {
-		data, err := ac.bundleFile(filename, tsxdata, false)
+		data, sum, err := ac.bundleFile(filename, tsxdata, false)
 		if err != nil {
 			if ac.debugMode {
 				ac.PrettyError(w, req, filename, tsxdata, err.Error(), "tsx")
@@ -892,7 +892,7 @@ func (ac *Config) TSXPage(w http.ResponseWriter, req *http.Request, filename str
 			}
 			return
 		}
-		ac.DataToClient(w, req, filename, data)
+		ac.bundleToClient(w, req, filename, data, sum)
 		return
 	}
 
@@ -992,7 +992,7 @@ func (ac *Config) ReactPage(w http.ResponseWriter, req *http.Request, filename s
 		`</script>`)
 
 	// Bundle the JSX/TSX source with esbuild, shimming react imports to globals
-	bundled, err := ac.bundleFile(filename, jsxdata, true)
+	bundled, _, err := ac.bundleFile(filename, jsxdata, true)
 	if err != nil {
 		if ac.debugMode {
 			ac.PrettyError(w, req, filename, jsxdata, err.Error(), "jsx")
@@ -1038,7 +1038,7 @@ func (ac *Config) HyperAppPage(w http.ResponseWriter, req *http.Request, filenam
 		htmlbuf.WriteString(stylesheetCSS)
 	case ac.fs.Exists(GCSSFilename):
 		if ac.debugMode {
-			gcssblock, err := ac.cache.Read(GCSSFilename, ac.shouldCache(".gcss"))
+			gcssblock, err := ac.readFile(GCSSFilename, ".gcss")
 			if err != nil {
 				fmt.Fprintf(w, "Unable to read %s: %s", filename, err)
 				return
@@ -1152,5 +1152,5 @@ func (ac *Config) SCSSPage(w http.ResponseWriter, req *http.Request, filename st
 		return
 	}
 	// Write the resulting CSS to the client
-	ac.DataToClient(w, req, filename, []byte(cssString))
+	ac.renderedToClient(w, req, filename, []byte(cssString))
 }
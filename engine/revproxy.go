@@ -2,8 +2,8 @@ package engine
 
 import (
 	"bufio"
+	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -18,10 +18,8 @@ import (
 // backends are pooled and kept alive across requests.
 var proxyTransport http.RoundTripper = &http.Transport{
 	Proxy: http.ProxyFromEnvironment,
-	DialContext: (&net.Dialer{
-		Timeout:   10 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}).DialContext,
+	// Also dials the Unix sockets of endpoints like "unix:/run/app.sock"
+	DialContext:       proxyDialContext,
 	ForceAttemptHTTP2: true,
 	MaxIdleConns:      256,
 	// The default is 2, which re-dials the backend for almost every request
@@ -39,52 +37,23 @@ type peekedBody struct {
 	io.Closer
 }
 
-// proxyRecorder records the status code and size of a proxied response.
-// Unwrap lets http.ResponseController reach the underlying Flusher and Hijacker.
-type proxyRecorder struct {
-	http.ResponseWriter
-	written int64
-	status  int
-}
-
-func (pr *proxyRecorder) WriteHeader(status int) {
-	if pr.status == 0 {
-		pr.status = status
-	}
-	pr.ResponseWriter.WriteHeader(status)
-}
-
-func (pr *proxyRecorder) Write(p []byte) (int, error) {
-	if pr.status == 0 {
-		pr.status = http.StatusOK
-	}
-	n, err := pr.ResponseWriter.Write(p)
-	pr.written += int64(n)
-	return n, err
-}
-
-func (pr *proxyRecorder) Unwrap() http.ResponseWriter { return pr.ResponseWriter }
-
-// Hijack passes WebSocket upgrades through, while recording that the
-// connection was upgraded, so that the access log gets a status code
-func (pr *proxyRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	conn, brw, err := http.NewResponseController(pr.ResponseWriter).Hijack()
-	if err == nil && pr.status == 0 {
-		pr.status = http.StatusSwitchingProtocols
-	}
-	return conn, brw, err
-}
-
-// ReverseProxy holds which path prefix (like "/api") should be sent where (like "http://localhost:8080")
+// ReverseProxy holds which path prefix (like "/api") should be sent where (like "http://localhost:8080").
+// If Upstreams is set, requests are load balanced between them, according to Options, and Endpoint is not used.
 type ReverseProxy struct {
 	proxy      *httputil.ReverseProxy
+	balancer   *balancer
+	cache      *proxyCache // nil if the responses are not cached
+	hooks      *proxyHooks // nil if there are no Lua hooks
 	PathPrefix string
 	Endpoint   url.URL
+	Upstreams  []url.URL
+	Options    ProxyOptions
 }
 
 // ReverseProxyConfig holds several "path prefix --> URL" ReverseProxy structs,
 // together with structures that speeds up the prefix matching.
 type ReverseProxyConfig struct {
+	cache          *proxyCache // shared by the reverse proxies with the Cache option set
 	proxyMatcher   utils.PrefixMatch
 	prefix2rproxy  map[string]int
 	ReverseProxies []ReverseProxy
@@ -95,19 +64,37 @@ func NewReverseProxyConfig() *ReverseProxyConfig {
 	return &ReverseProxyConfig{}
 }
 
-// Add can add a ReverseProxy and will also (re-)initialize the internal proxy matcher
-func (rc *ReverseProxyConfig) Add(rp *ReverseProxy) {
+// ClearCache removes all cached responses, if caching is enabled
+func (rc *ReverseProxyConfig) ClearCache() {
+	if rc.cache != nil {
+		rc.cache.Clear()
+	}
+}
+
+// Add can add a ReverseProxy and will also (re-)initialize the internal proxy matcher.
+// An error is returned, and the ReverseProxy is not added, if the load balancing options are invalid.
+func (rc *ReverseProxyConfig) Add(rp *ReverseProxy) error {
+	if len(rp.Upstreams) > 0 {
+		if err := rp.Options.Validate(); err != nil {
+			return fmt.Errorf("reverse proxy %s: %w", rp.PathPrefix, err)
+		}
+	}
 	rc.ReverseProxies = append(rc.ReverseProxies, *rp)
-	rc.Init()
+	return rc.Init()
 }
 
 // newProxyHandler builds the httputil.ReverseProxy that does the actual proxying.
 // The prefix is stripped from the request path and the endpoint path is prepended.
-func newProxyHandler(pathPrefix string, endpoint url.URL) *httputil.ReverseProxy {
+// The hooks may be nil.
+func newProxyHandler(pathPrefix string, endpoint url.URL, hooks *proxyHooks) *httputil.ReverseProxy {
 	basePath := strings.TrimSuffix(endpoint.Path, "/")
 	endpointString := endpoint.String()
+	transport := proxyTransport
+	if hooks != nil {
+		transport = hookTransport{proxyTransport}
+	}
 	return &httputil.ReverseProxy{
-		Transport: proxyTransport,
+		Transport: transport,
 		Rewrite: func(r *httputil.ProxyRequest) {
 			r.SetXForwarded()
 			// Forward the Host the client asked for, so that the backend
@@ -122,6 +109,9 @@ func newProxyHandler(pathPrefix string, endpoint url.URL) *httputil.ReverseProxy
 			r.Out.URL.Path = basePath + p
 			// Let EscapedPath re-derive the escaped form from Path
 			r.Out.URL.RawPath = ""
+			if hooks != nil {
+				hooks.rewriteRequest(r)
+			}
 		},
 		ModifyResponse: func(res *http.Response) error {
 			// Peek one byte before sending the status: if upstream fails
@@ -133,14 +123,16 @@ func newProxyHandler(pathPrefix string, endpoint url.URL) *httputil.ReverseProxy
 			// upgrade or a long poll, where the next bytes may only arrive
 			// once the client has spoken, and waiting for them here would
 			// keep the headers from ever reaching the client.
-			if res.ContentLength <= 0 {
-				return nil
+			if res.ContentLength > 0 {
+				br := bufio.NewReader(res.Body)
+				if _, err := br.Peek(1); err != nil && err != io.EOF {
+					return err
+				}
+				res.Body = &peekedBody{Reader: br, Closer: res.Body}
 			}
-			br := bufio.NewReader(res.Body)
-			if _, err := br.Peek(1); err != nil && err != io.EOF {
-				return err
+			if hooks != nil {
+				return hooks.modifyResponse(res)
 			}
-			res.Body = &peekedBody{Reader: br, Closer: res.Body}
 			return nil
 		},
 		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
@@ -154,10 +146,23 @@ func newProxyHandler(pathPrefix string, endpoint url.URL) *httputil.ReverseProxy
 // ServeHTTP proxies the given request to where the ReverseProxy points.
 // Redirects, streaming responses and WebSocket upgrades are passed through.
 func (rp *ReverseProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if rp.cache != nil {
+		rp.cache.ServeHTTP(w, req, http.HandlerFunc(rp.serveUpstream))
+		return
+	}
+	rp.serveUpstream(w, req)
+}
+
+// serveUpstream proxies the given request, without going through the cache
+func (rp *ReverseProxy) serveUpstream(w http.ResponseWriter, req *http.Request) {
+	if rp.balancer != nil {
+		rp.balancer.ServeHTTP(w, req)
+		return
+	}
 	proxy := rp.proxy
 	if proxy == nil {
 		// Not added with Add, which prepares the proxy handler
-		proxy = newProxyHandler(rp.PathPrefix, rp.Endpoint)
+		proxy = newProxyHandler(rp.PathPrefix, rp.Endpoint, rp.hooks)
 	}
 	proxy.ServeHTTP(w, req)
 }
@@ -181,19 +186,45 @@ func (rp *ReverseProxy) DoProxyPass(req http.Request) (*http.Response, error) {
 	return res, nil
 }
 
-// Init prepares the proxyMatcher and prefix2rproxy fields according to the ReverseProxy structs
-func (rc *ReverseProxyConfig) Init() {
+// Init prepares the proxyMatcher and prefix2rproxy fields according to the ReverseProxy structs.
+// An error is returned if the load balancing options of a ReverseProxy are invalid.
+func (rc *ReverseProxyConfig) Init() error {
 	keys := make([]string, 0, len(rc.ReverseProxies))
 	rc.prefix2rproxy = make(map[string]int)
 	for i := range rc.ReverseProxies {
 		rp := &rc.ReverseProxies[i]
+		if len(rp.Upstreams) > 0 && rp.balancer == nil {
+			if err := rp.Options.Validate(); err != nil {
+				return fmt.Errorf("reverse proxy %s: %w", rp.PathPrefix, err)
+			}
+			rp.balancer = newBalancer(rp.PathPrefix, rp.Upstreams, rp.Options, rp.hooks)
+			if rp.Options.HealthPath != "" {
+				go rp.balancer.healthChecks()
+			}
+		}
+		if rp.Options.Cache && rp.cache == nil {
+			if rc.cache == nil {
+				logrus.Warnf("reverse proxy %s: caching is disabled, not caching the responses", rp.PathPrefix)
+			}
+			rp.cache = rc.cache
+		}
 		if rp.proxy == nil {
-			rp.proxy = newProxyHandler(rp.PathPrefix, rp.Endpoint)
+			rp.proxy = newProxyHandler(rp.PathPrefix, rp.Endpoint, rp.hooks)
 		}
 		keys = append(keys, rp.PathPrefix)
 		rc.prefix2rproxy[rp.PathPrefix] = i
 	}
 	rc.proxyMatcher.Build(keys)
+	return nil
+}
+
+// Close stops the health checks of all the load balanced reverse proxies
+func (rc *ReverseProxyConfig) Close() {
+	for i := range rc.ReverseProxies {
+		if b := rc.ReverseProxies[i].balancer; b != nil {
+			b.Close()
+		}
+	}
 }
 
 // FindMatchingReverseProxy checks if the given URL path should be proxied
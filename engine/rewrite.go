@@ -0,0 +1,239 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/xyproto/algernon/utils"
+)
+
+// The kinds of routing rules that can be set up in serverconf.lua
+const (
+	ruleRedirect = iota // Redirect: regular expression, redirect to target
+	ruleRewrite         // Rewrite: regular expression, serve target instead
+	rulePrefix          // RewritePrefix: replace a host prefix and redirect
+	rulePort            // RewritePort: redirect from one port to another
+)
+
+// routingRule is a single Redirect, Rewrite, RewritePrefix or RewritePort
+// directive. The rules are checked in the order they were added, before the
+// permission checks and before a request is mapped to a filename, and the
+// first rule that matches is used.
+type routingRule struct {
+	pattern     *regexp.Regexp // for Redirect and Rewrite
+	matchHost   bool           // match the pattern against "host/path" instead of just "/path"
+	target      string         // for Redirect and Rewrite, may refer to captures, like "$1"
+	prefix      string         // for RewritePrefix, the host prefix to replace
+	replacement string         // for RewritePrefix
+	host        string         // for RewritePort, or "" for all hosts
+	fromPort    string         // for RewritePort
+	toPort      string         // for RewritePort
+	status      int            // the redirect status code
+	kind        int
+}
+
+// redirectStatus checks that the given status code can be used for a redirect.
+// 0 gives the default, 301 Moved Permanently.
+func redirectStatus(status int) (int, error) {
+	switch status {
+	case 0:
+		return http.StatusMovedPermanently, nil
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return status, nil
+	}
+	return 0, fmt.Errorf("not a redirect status code: %d, use 301, 302, 307 or 308", status)
+}
+
+// newPatternRule creates a rule for Redirect or Rewrite. Patterns that start
+// with "/" or "^/" are matched against the path, while other patterns are
+// matched against the host (without the port) followed by the path.
+func newPatternRule(kind int, pattern, target string, status int) (*routingRule, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if target == "" {
+		return nil, errors.New("no target given for " + pattern)
+	}
+	rule := &routingRule{
+		pattern:   re,
+		matchHost: !strings.HasPrefix(strings.TrimPrefix(pattern, "^"), "/"),
+		target:    target,
+		kind:      kind,
+	}
+	if kind == ruleRedirect {
+		if rule.status, err = redirectStatus(status); err != nil {
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+// newPrefixRule creates a rule for RewritePrefix, which redirects to the
+// same URL, but with the given host prefix replaced, like "www." with ""
+func newPrefixRule(prefix, replacement string, status int) (*routingRule, error) {
+	if prefix == replacement {
+		return nil, errors.New("the host prefix and the replacement are the same")
+	}
+	status, err := redirectStatus(status)
+	if err != nil {
+		return nil, err
+	}
+	return &routingRule{prefix: prefix, replacement: replacement, status: status, kind: rulePrefix}, nil
+}
+
+// newPortRule creates a rule for RewritePort, which redirects requests for
+// the given host and port to the same URL, but with another port. Port 443
+// gives https:// and port 80 gives http://. The host may be "" or "*" for
+// matching all hosts.
+func newPortRule(host string, fromPort, toPort, status int) (*routingRule, error) {
+	if fromPort <= 0 || fromPort > 65535 || toPort <= 0 || toPort > 65535 {
+		return nil, errors.New("invalid port number")
+	}
+	if fromPort == toPort {
+		return nil, errors.New("the ports are the same")
+	}
+	status, err := redirectStatus(status)
+	if err != nil {
+		return nil, err
+	}
+	if host == "*" {
+		host = ""
+	}
+	return &routingRule{
+		host:     strings.ToLower(host),
+		fromPort: strconv.Itoa(fromPort),
+		toPort:   strconv.Itoa(toPort),
+		status:   status,
+		kind:     rulePort,
+	}, nil
+}
+
+// requestScheme returns "https" for TLS requests and "http" otherwise
+func requestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestPort returns the port the client connected to, going by the Host
+// header or the default port for the scheme
+func requestPort(req *http.Request) string {
+	if _, port, err := net.SplitHostPort(req.Host); err == nil && port != "" {
+		return port
+	}
+	if req.TLS != nil {
+		return "443"
+	}
+	return "80"
+}
+
+// withQuery adds the query string of the request to the target, unless the
+// target has a query string of its own
+func withQuery(target string, req *http.Request) string {
+	if req.URL.RawQuery == "" || strings.Contains(target, "?") {
+		return target
+	}
+	return target + "?" + req.URL.RawQuery
+}
+
+// apply checks if the rule matches the request. For redirects, the URL to
+// redirect to is returned. For internal rewrites, the new path (and possibly
+// query) is returned.
+func (rule *routingRule) apply(req *http.Request) (string, bool) {
+	host := strings.ToLower(utils.GetHost(req))
+	switch rule.kind {
+	case ruleRedirect, ruleRewrite:
+		subject := req.URL.Path
+		if rule.matchHost {
+			subject = host + subject
+		}
+		match := rule.pattern.FindStringSubmatchIndex(subject)
+		if match == nil {
+			return "", false
+		}
+		target := string(rule.pattern.ExpandString(nil, rule.target, subject, match))
+		if rule.kind == ruleRedirect {
+			target = withQuery(target, req)
+		}
+		return target, true
+	case rulePrefix:
+		var newHost string
+		switch {
+		case rule.prefix == "":
+			// Adding a prefix, like "www.", to hosts that do not already have it
+			if strings.HasPrefix(host, rule.replacement) {
+				return "", false
+			}
+			newHost = rule.replacement + host
+		case strings.HasPrefix(host, rule.prefix):
+			newHost = rule.replacement + strings.TrimPrefix(host, rule.prefix)
+		default:
+			return "", false
+		}
+		if newHost == "" {
+			return "", false
+		}
+		if _, port, err := net.SplitHostPort(req.Host); err == nil && port != "" {
+			newHost = net.JoinHostPort(newHost, port)
+		}
+		return requestScheme(req) + "://" + newHost + req.URL.RequestURI(), true
+	case rulePort:
+		if (rule.host != "" && rule.host != host) || requestPort(req) != rule.fromPort {
+			return "", false
+		}
+		scheme := requestScheme(req)
+		switch rule.toPort {
+		case "443":
+			scheme = "https"
+		case "80":
+			scheme = "http"
+		}
+		newHost := host
+		if utils.IsIPv6(host) {
+			newHost = "[" + host + "]"
+		}
+		if (scheme == "https" && rule.toPort != "443") || (scheme == "http" && rule.toPort != "80") {
+			newHost = net.JoinHostPort(host, rule.toPort)
+		}
+		return scheme + "://" + newHost + req.URL.RequestURI(), true
+	}
+	return "", false
+}
+
+// routingMiddleware applies the Redirect, Rewrite, RewritePrefix and
+// RewritePort rules from the server configuration
+func (ac *Config) routingMiddleware(next http.Handler) http.Handler {
+	if len(ac.routingRules) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, rule := range ac.routingRules {
+			target, ok := rule.apply(req)
+			if !ok {
+				continue
+			}
+			if rule.kind != ruleRewrite {
+				setHandlerType(req, "redirect")
+				http.Redirect(w, req, target, rule.status)
+				return
+			}
+			// An internal rewrite, to a path and an optional query string
+			path, query, hasQuery := strings.Cut(target, "?")
+			req.URL.Path = utils.CanonicalURLPath(path)
+			// Let EscapedPath re-derive the escaped form
+			req.URL.RawPath = ""
+			if hasQuery {
+				req.URL.RawQuery = query
+			}
+			break
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoutingRuleApply(t *testing.T) {
+	mustRule := func(rule *routingRule, err error) *routingRule {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rule
+	}
+	redirect := mustRule(newPatternRule(ruleRedirect, `^/old/(.*)$`, "/new/$1", 0))
+	hostRedirect := mustRule(newPatternRule(ruleRedirect, `^blog\.example\.com/(\d+)$`, "https://example.com/blog/$1", 308))
+	stripWWW := mustRule(newPrefixRule("www.", "", 0))
+	addWWW := mustRule(newPrefixRule("", "www.", 302))
+	toHTTPS := mustRule(newPortRule("example.com", 80, 443, 0))
+	anyHost := mustRule(newPortRule("*", 8080, 8443, 0))
+
+	tests := []struct {
+		rule   *routingRule
+		url    string
+		tls    bool
+		want   string
+		wantOK bool
+	}{
+		{redirect, "http://example.com/old/a/b?x=1", false, "/new/a/b?x=1", true},
+		{redirect, "http://example.com/other", false, "", false},
+		{hostRedirect, "http://blog.example.com:8000/42", false, "https://example.com/blog/42", true},
+		{hostRedirect, "http://example.com/42", false, "", false},
+		{stripWWW, "http://www.example.com/a?b=c", false, "http://example.com/a?b=c", true},
+		{stripWWW, "https://www.example.com:8443/", true, "https://example.com:8443/", true},
+		{stripWWW, "http://example.com/", false, "", false},
+		{addWWW, "http://example.com/", false, "http://www.example.com/", true},
+		{addWWW, "http://www.example.com/", false, "", false},
+		{toHTTPS, "http://example.com/x", false, "https://example.com/x", true},
+		{toHTTPS, "http://other.com/x", false, "", false},
+		{toHTTPS, "https://example.com/x", true, "", false},
+		{anyHost, "http://other.com:8080/", false, "http://other.com:8443/", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		if tt.tls {
+			req.TLS = &tls.ConnectionState{}
+		} else {
+			req.TLS = nil
+		}
+		got, ok := tt.rule.apply(req)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: got %q, %v, want %q, %v", tt.url, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestRoutingRuleErrors(t *testing.T) {
+	if _, err := newPatternRule(ruleRedirect, "/a", "/b", 200); err == nil {
+		t.Error("expected an error for a status code that is not for redirects")
+	}
+	if _, err := newPatternRule(ruleRewrite, "(", "/b", 0); err == nil {
+		t.Error("expected an error for an invalid regular expression")
+	}
+	if _, err := newPrefixRule("www.", "www.", 0); err == nil {
+		t.Error("expected an error for a prefix that is replaced with itself")
+	}
+	if _, err := newPortRule("", 80, 80, 0); err == nil {
+		t.Error("expected an error for redirecting to the same port")
+	}
+}
+
+func TestRoutingMiddleware(t *testing.T) {
+	ac := &Config{}
+	for _, rule := range []struct {
+		kind            int
+		pattern, target string
+		status          int
+	}{
+		{ruleRedirect, `^/legacy$`, "/current", 307},
+		{ruleRewrite, `^/u/([a-z]+)$`, "/users.lua?name=$1", 0},
+	} {
+		r, err := newPatternRule(rule.kind, rule.pattern, rule.target, rule.status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ac.routingRules = append(ac.routingRules, r)
+	}
+	handler := ac.routingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.URL.Path + " " + req.URL.RawQuery))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/legacy", nil))
+	if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != "/current" {
+		t.Errorf("GET /legacy = %d to %q, want %d to %q", rec.Code, rec.Header().Get("Location"), http.StatusTemporaryRedirect, "/current")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/u/alice", nil))
+	if got := rec.Body.String(); got != "/users.lua name=alice" {
+		t.Errorf("GET /u/alice was served as %q", got)
+	}
+}
@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// luaRoute collects the handle() functions that share a path pattern, like
+// "/users/{id}", keyed by HTTP method. Only the path pattern is registered on
+// the mux, so that a request with an unregistered method can be answered
+// with 405 and an Allow header, instead of falling through to a less specific
+// pattern like "/". Patterns that only differ by the names of the wildcards,
+// like "GET /users/{id}" and "POST /users/{name}", share one route.
+type luaRoute struct {
+	pattern  string                     // the path pattern that is registered on the mux
+	handlers map[string]luaRouteHandler // method ("" for any method) -> handler
+}
+
+// luaRouteHandler is a handle() function for one method of a route
+type luaRouteHandler struct {
+	key     string // the Lua registry key of the function
+	pattern string // the path pattern that was given to handle()
+}
+
+// newLuaRoute creates a luaRoute without any handlers, for the given path
+// pattern, which is registered on the mux
+func newLuaRoute(pattern string) *luaRoute {
+	return &luaRoute{pattern: pattern, handlers: make(map[string]luaRouteHandler)}
+}
+
+// add registers the Lua registry key of a handler for the given method and
+// path pattern. An empty method handles all methods that have no handler of
+// their own.
+func (r *luaRoute) add(method, key, pattern string) {
+	r.handlers[method] = luaRouteHandler{key: key, pattern: pattern}
+}
+
+// lookup returns the handler for the given method.
+// HEAD requests are served by the GET handler, the same way http.ServeMux does it.
+func (r *luaRoute) lookup(method string) (luaRouteHandler, bool) {
+	if h, ok := r.handlers[method]; ok {
+		return h, true
+	}
+	if method == http.MethodHead {
+		if h, ok := r.handlers[http.MethodGet]; ok {
+			return h, true
+		}
+	}
+	h, ok := r.handlers[""]
+	return h, ok
+}
+
+// setPathValues makes the wildcards of the handler's own pattern available
+// to param() and params(), when the pattern that is registered on the mux
+// names them differently. The names that only the registered pattern has are
+// cleared, so that they can not be mistaken for wildcards of this handler.
+func (r *luaRoute) setPathValues(req *http.Request, h luaRouteHandler) {
+	if h.pattern == r.pattern {
+		return
+	}
+	registered := patternWildcards(r.pattern)
+	values := make([]string, len(registered))
+	for i, name := range registered {
+		values[i] = req.PathValue(name)
+		req.SetPathValue(name, "")
+	}
+	for i, name := range patternWildcards(h.pattern) {
+		if i < len(values) {
+			req.SetPathValue(name, values[i])
+		}
+	}
+	req.Pattern = h.pattern
+}
+
+// allow returns the value of the Allow header for this route
+func (r *luaRoute) allow() string {
+	methods := make([]string, 0, len(r.handlers)+1)
+	for method := range r.handlers {
+		methods = append(methods, method)
+	}
+	if _, ok := r.handlers[http.MethodGet]; ok && !slices.Contains(methods, http.MethodHead) {
+		methods = append(methods, http.MethodHead)
+	}
+	slices.Sort(methods)
+	return strings.Join(methods, ", ")
+}
+
+// splitMethodPattern splits a http.ServeMux pattern like "GET /users/{id}"
+// into the method and the rest of the pattern. The method is empty if the
+// pattern does not start with one.
+func splitMethodPattern(pattern string) (string, string) {
+	pattern = strings.TrimSpace(pattern)
+	method, rest, found := strings.Cut(pattern, " ")
+	if !found || strings.Contains(method, "/") {
+		return "", pattern
+	}
+	return method, strings.TrimLeft(rest, " \t")
+}
+
+// normalizePattern removes the names of the wildcards from a path pattern,
+// like "/users/{}/{...}" for "/users/{id}/{rest...}", so that patterns that
+// http.ServeMux sees as the same can be grouped together
+func normalizePattern(pattern string) string {
+	// Keep the host, if there is one
+	i := strings.Index(pattern, "/")
+	if i < 0 {
+		return pattern
+	}
+	segments := strings.Split(pattern[i:], "/")
+	for j, segment := range segments {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") || segment == "{$}" {
+			continue
+		}
+		if strings.HasSuffix(segment, "...}") {
+			segments[j] = "{...}"
+		} else {
+			segments[j] = "{}"
+		}
+	}
+	return pattern[:i] + strings.Join(segments, "/")
+}
+
+// patternWildcards returns the names of the wildcards in a http.ServeMux
+// pattern, like "id" and "rest" for "GET /users/{id}/{rest...}"
+func patternWildcards(pattern string) []string {
+	_, pattern = splitMethodPattern(pattern)
+	// Skip the host, if there is one
+	i := strings.Index(pattern, "/")
+	if i < 0 {
+		return nil
+	}
+	var names []string
+	for segment := range strings.SplitSeq(pattern[i:], "/") {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			continue
+		}
+		name := strings.TrimSuffix(segment[1:len(segment)-1], "...")
+		if name == "" || name == "$" {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	lua "github.com/xyproto/gopher-lua"
+)
+
+// newTestLuaMux runs a server script with handle() calls the same way as
+// RunConfiguration, but with a single state in the handler pool
+func newTestLuaMux(t *testing.T, script string) *http.ServeMux {
+	t.Helper()
+	ac := &Config{disableRateLimiting: true}
+	mux := http.NewServeMux()
+
+	L := lua.NewState()
+	defer L.Close()
+	ac.LoadLuaHandlerFunctions(L, "server.lua", mux, false, nil, "", true)
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+
+	poolL := lua.NewState()
+	ac.LoadLuaHandlerFunctions(poolL, "server.lua", mux, false, nil, "", false)
+	if err := poolL.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	ac.handlerPool = newHandlerPool(1)
+	ac.handlerPool.Add(poolL)
+	t.Cleanup(ac.handlerPool.Close)
+
+	return mux
+}
+
+func TestSplitMethodPattern(t *testing.T) {
+	tests := []struct {
+		pattern, method, rest string
+	}{
+		{"/", "", "/"},
+		{"/users/{id}", "", "/users/{id}"},
+		{"GET /users/{id}", "GET", "/users/{id}"},
+		{"POST  example.com/", "POST", "example.com/"},
+		{" DELETE /x ", "DELETE", "/x"},
+	}
+	for _, tt := range tests {
+		method, rest := splitMethodPattern(tt.pattern)
+		if method != tt.method || rest != tt.rest {
+			t.Errorf("splitMethodPattern(%q) = %q, %q, want %q, %q", tt.pattern, method, rest, tt.method, tt.rest)
+		}
+	}
+}
+
+func TestPatternWildcards(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"/", nil},
+		{"GET /users/{id}", []string{"id"}},
+		{"/files/{dir}/{rest...}", []string{"dir", "rest"}},
+		{"/exact/{$}", nil},
+		{"example.com/{name}", []string{"name"}},
+	}
+	for _, tt := range tests {
+		if got := patternWildcards(tt.pattern); !slices.Equal(got, tt.want) {
+			t.Errorf("patternWildcards(%q) = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizePattern(t *testing.T) {
+	tests := []struct {
+		pattern, want string
+	}{
+		{"/", "/"},
+		{"/users/{id}", "/users/{}"},
+		{"/files/{dir}/{rest...}", "/files/{}/{...}"},
+		{"/exact/{$}", "/exact/{$}"},
+		{"example.com/{name}", "example.com/{}"},
+	}
+	for _, tt := range tests {
+		if got := normalizePattern(tt.pattern); got != tt.want {
+			t.Errorf("normalizePattern(%q) = %q, want %q", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestHandlePathParameters(t *testing.T) {
+	mux := newTestLuaMux(t, `
+handle("GET /users/{id}", function()
+  print("user " .. param("id"))
+end)
+handle("/files/{dir}/{rest...}", function()
+  local p = params()
+  print(p.dir .. "|" .. p.rest)
+end)
+`)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users/42", nil))
+	if got := strings.TrimSpace(rec.Body.String()); got != "user 42" {
+		t.Errorf("GET /users/42 = %q, want %q", got, "user 42")
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/files/docs/a/b.txt", nil))
+	if got := strings.TrimSpace(rec.Body.String()); got != "docs|a/b.txt" {
+		t.Errorf("GET /files/docs/a/b.txt = %q, want %q", got, "docs|a/b.txt")
+	}
+}
+
+func TestHandleMethodRouting(t *testing.T) {
+	mux := newTestLuaMux(t, `
+handle("GET /items/{id}", function()
+  print("get " .. param("id"))
+end)
+handle("PUT /items/{id}", function()
+  print("put " .. param("id"))
+end)
+`)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/items/7", nil))
+	if got := strings.TrimSpace(rec.Body.String()); got != "put 7" {
+		t.Errorf("PUT /items/7 = %q, want %q", got, "put 7")
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/items/7", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE /items/7 status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if allow := rec.Header().Get("Allow"); allow != "GET, HEAD, PUT" {
+		t.Errorf("Allow = %q, want %q", allow, "GET, HEAD, PUT")
+	}
+}
+
+func TestHandleWildcardNames(t *testing.T) {
+	mux := newTestLuaMux(t, `
+handle("GET /a/{id}", function()
+  print("get " .. param("id"))
+end)
+handle("POST /a/{name}", function()
+  local p = params()
+  print("post " .. param("name") .. " " .. tostring(p.id) .. " " .. param("id"))
+end)
+`)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/a/1", nil))
+	if got := strings.TrimSpace(rec.Body.String()); got != "get 1" {
+		t.Errorf("GET /a/1 = %q, want %q", got, "get 1")
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/a/bob", nil))
+	if got := strings.TrimSpace(rec.Body.String()); got != "post bob nil" {
+		t.Errorf("POST /a/bob = %q, want %q", got, "post bob nil")
+	}
+}
+
+func TestHandleConflict(t *testing.T) {
+	ac := &Config{disableRateLimiting: true}
+	L := lua.NewState()
+	defer L.Close()
+	ac.LoadLuaHandlerFunctions(L, "server.lua", http.NewServeMux(), false, nil, "", true)
+	err := L.DoString(`
+handle("/a/{x}/b", function() end)
+handle("/a/b/{y}", function() end)
+`)
+	if err == nil || !strings.Contains(err.Error(), "conflicts") {
+		t.Errorf("expected an error for conflicting patterns, got %v", err)
+	}
+}
@@ -57,18 +57,10 @@ func AtShutdown(shutdownFunction func()) {
 
 // NewGracefulServer creates a new graceful server configuration
 func (ac *Config) NewGracefulServer(handler http.Handler, http2support bool, addr string) *GracefulServer {
-	// Cap request bodies before any handler reads them. 0 means unlimited.
-	if ac.largeFileSize > 0 {
-		handler = ac.limitBodyMiddleware(handler)
-	}
-	// Check permissions for every route, not just the ones in RegisterHandlers
-	handler = ac.permissionMiddleware(handler)
-	// Canonicalize the request path before anything else looks at it
-	handler = canonicalPathMiddleware(handler)
 	// Server configuration
 	s := &http.Server{
 		Addr:    addr,
-		Handler: handler, // Use the provided http.Handler (e.g. httprouter)
+		Handler: ac.withMiddleware(handler), // Use the provided http.Handler (e.g. httprouter)
 		// The timeout values are also the maximum time it can take
 		// for a complete page of Server-Sent Events (SSE).
 		ReadHeaderTimeout: 5 * time.Second,
@@ -84,11 +76,32 @@ func (ac *Config) NewGracefulServer(handler http.Handler, http2support bool, add
 		Server:  s,
 		Timeout: ac.shutdownTimeout,
 	}
+	ac.configureListener(gracefulServer)
 	// Handle ctrl-c: run the shutdown functions
 	gracefulServer.ShutdownInitiated = ac.GenerateShutdownFunction(gracefulServer)
 	return gracefulServer
 }
 
+// portSettingFor returns the listener configuration from SetPorts for the
+// given address, if there is one
+func (ac *Config) portSettingFor(addr string) (PortSetting, bool) {
+	for _, ps := range ac.serve.portSettings {
+		if ps.Addr == addr && ps.Protocol != "http3" && ps.Protocol != "event" {
+			return ps, true
+		}
+	}
+	return PortSetting{}, false
+}
+
+// configureListener sets the file mode of Unix sockets and enables the PROXY
+// protocol, according to the listener configuration for the server address
+func (ac *Config) configureListener(gs *GracefulServer) {
+	gs.SocketMode = ac.socketModeFor(gs.Addr)
+	if ps, ok := ac.portSettingFor(gs.Addr); ok && ps.ProxyProtocol {
+		gs.WrapListener = ac.proxyProtocolWrapper()
+	}
+}
+
 // GenerateShutdownFunction generates a function that will run the postponed
 // shutdown functions.  Note that gracefulServer can be nil. It's only used for
 // finding out if the server was interrupted (ctrl-c or killed, SIGINT/SIGTERM)
@@ -218,6 +231,11 @@ func (ac *Config) Serve(handler http.Handler, done, ready chan bool) error {
 		}
 	}
 
+	// Refuse to start if any client could give its own address with the PROXY protocol
+	if err := ac.checkProxyProtocol(); err != nil {
+		ac.fatalExit(err)
+	}
+
 	// If explicit port settings are configured (from SetPorts in Lua), use them
 	if len(ac.serve.portSettings) > 0 {
 		return ac.servePortSettings(handler, done, ready)
@@ -447,7 +465,9 @@ func (ac *Config) servePortSettings(handler http.Handler, done, ready chan bool)
 						if acmeIssuer != nil {
 							h = acmeIssuer.HTTPChallengeHandler(h)
 						}
-						if err := http.ListenAndServe(ps.Addr, h); err != nil {
+						srv := &GracefulServer{Server: &http.Server{Addr: ps.Addr, Handler: h, ReadHeaderTimeout: 5 * time.Second}}
+						ac.configureListener(srv)
+						if err := srv.ListenAndServe(); err != nil {
 							ac.fatalExit(err)
 						}
 					} else {
@@ -498,6 +518,10 @@ func (ac *Config) servePortSettings(handler http.Handler, done, ready chan bool)
 				}()
 			}
 		case "http3":
+			if _, ok := unixSocketPath(ps.Addr); ok {
+				logrus.Errorf("SetPorts: HTTP/3 can not be served on a Unix socket: %s", ps.Addr)
+				continue
+			}
 			if ps.TLS {
 				logrus.Infof("Serving HTTP/3 (QUIC) on https://%s/", utils.HostPortToURL(ps.Addr))
 			} else {
@@ -523,7 +547,7 @@ func (ac *Config) servePortSettings(handler http.Handler, done, ready chan bool)
 		hasTLS := false
 		firstAddr := ""
 		for _, ps := range ac.serve.portSettings {
-			if ps.Protocol == "event" {
+			if _, ok := unixSocketPath(ps.Addr); ok || ps.Protocol == "event" {
 				continue
 			}
 			if firstAddr == "" {
@@ -45,7 +45,7 @@ func (ac *Config) LoadServeFile(w http.ResponseWriter, req *http.Request, L *lua
 		templateFilename := filepath.Join(scriptdir, L.CheckString(1))
 		ext := filepath.Ext(strings.ToLower(templateFilename))
 
-		templateData, err := ac.cache.Read(templateFilename, ac.shouldCache(ext))
+		templateData, err := ac.readFile(templateFilename, ext)
 		if err != nil {
 			if ac.debugMode {
 				fmt.Fprintf(w, "Unable to read %s: %s", templateFilename, err)
@@ -8,7 +8,9 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/xyproto/algernon/utils"
@@ -50,9 +52,21 @@ func (ac *Config) Info() string {
 	})
 
 	sb.WriteString("Cache mode:\t\t" + ac.cacheMode.String() + "\n")
+	if ac.cacheStore != nil {
+		sb.WriteString(fmt.Sprintf("Cache:\t\t\tShared, in the database, for %v\n", ac.cacheTTL))
+	}
+	if len(ac.cacheRules) > 0 {
+		sb.WriteString(fmt.Sprintf("Cache rules:\t\t%d\n", len(ac.cacheRules)))
+	}
 	if ac.cacheSize != 0 {
 		sb.WriteString(fmt.Sprintf("Cache size:\t\t%d bytes\n", ac.cacheSize))
 	}
+	if ac.cacheWatcher != nil {
+		sb.WriteString("Cache invalidation:\tOn changes in " + ac.serverDirOrFilename + "\n")
+	}
+	if ac.diskCache != nil {
+		sb.WriteString(fmt.Sprintf("Disk cache:\t\t%s (%d bytes)\n", ac.diskCacheDir, ac.diskCacheSize))
+	}
 
 	if ac.serverLogFile != "" {
 		sb.WriteString("Log file:\t\t" + ac.serverLogFile + "\n")
@@ -78,6 +92,9 @@ func (ac *Config) Info() string {
 		sb.WriteString("Request limit:\t\tOff\n")
 	} else {
 		sb.WriteString(fmt.Sprintf("Request limit:\t\t%d/sec per visitor\n", ac.limitRequests))
+		if ac.rateLimitStoreName == RateLimitStoreDatabase {
+			sb.WriteString("Rate limits:\t\tShared, in Redis\n")
+		}
 	}
 	if ac.redisDBindex != 0 {
 		sb.WriteString(fmt.Sprintf("Redis database index:\t%d\n", ac.redisDBindex))
@@ -325,6 +342,16 @@ func (ac *Config) loadServerSettingsFunctions(L *lua.LState, filename string) {
 			} else if tlsVal := entry.RawGetInt(3); tlsVal != lua.LNil {
 				ps.TLS = lua.LVAsBool(tlsVal)
 			}
+			// File mode for Unix sockets, like "0660"
+			if modeVal := entry.RawGetString("mode"); modeVal != lua.LNil {
+				mode, err := parseSocketMode(modeVal.String())
+				if err != nil {
+					logrus.Error("SetPorts: ", err)
+				} else {
+					ps.Mode = mode
+				}
+			}
+			ps.ProxyProtocol = lua.LVAsBool(entry.RawGetString("proxyprotocol"))
 			// Normalize "quic" to "http3"
 			if ps.Protocol == "quic" {
 				ps.Protocol = "http3"
@@ -333,6 +360,9 @@ func (ac *Config) loadServerSettingsFunctions(L *lua.LState, filename string) {
 			if ps.Protocol == "http3" && !ps.TLS {
 				logrus.Warn("HTTP/3 without TLS is non-standard and not supported by browsers")
 			}
+			if ps.ProxyProtocol && (ps.Protocol == "http3" || ps.Protocol == "event") {
+				logrus.Warnf("SetPorts: the PROXY protocol is not supported for %s, on %s", ps.Protocol, ps.Addr)
+			}
 			settings = append(settings, ps)
 		})
 		ac.serve.portSettings = settings
@@ -353,32 +383,325 @@ func (ac *Config) loadServerSettingsFunctions(L *lua.LState, filename string) {
 		return 1 // number of results
 	}))
 
-	// Add a new reverse proxy given a: path prefix, endpoint and endpoint URL
+	// Add a new reverse proxy given a path prefix and an endpoint URL, or a
+	// table of endpoint URLs to load balance between, and an optional table
+	// with load balancing and health check options
 	L.SetGlobal("AddReverseProxy", L.NewFunction(func(L *lua.LState) int {
 		var rp ReverseProxy
 
 		rp.PathPrefix = L.ToString(1)
-		endpointURLString := L.ToString(2)
 
-		parsedURL, err := url.Parse(endpointURLString)
+		parseEndpoint := func(endpointURLString string) (*url.URL, bool) {
+			parsedURL, err := parseEndpointURL(endpointURLString)
+			if err != nil {
+				logrus.Error(err)
+				return nil, false
+			}
+			return parsedURL, true
+		}
+
+		if endpointTable, ok := L.Get(2).(*lua.LTable); ok {
+			for i := 1; i <= endpointTable.Len(); i++ {
+				parsedURL, ok := parseEndpoint(endpointTable.RawGetInt(i).String())
+				if !ok {
+					return 0 // number of results
+				}
+				rp.Upstreams = append(rp.Upstreams, *parsedURL)
+			}
+			if len(rp.Upstreams) == 0 {
+				logrus.Error("AddReverseProxy: no endpoint URLs given for " + rp.PathPrefix)
+				return 0 // number of results
+			}
+			rp.Endpoint = rp.Upstreams[0]
+		} else {
+			parsedURL, ok := parseEndpoint(L.ToString(2))
+			if !ok {
+				return 0 // number of results
+			}
+			rp.Endpoint = *parsedURL
+		}
+
+		if optionTable, ok := L.Get(3).(*lua.LTable); ok {
+			if len(rp.Upstreams) == 0 {
+				rp.Upstreams = []url.URL{rp.Endpoint}
+			}
+			seconds := func(key string) time.Duration {
+				return time.Duration(float64(lua.LVAsNumber(optionTable.RawGetString(key))) * float64(time.Second))
+			}
+			rp.Options = ProxyOptions{
+				Policy:         lua.LVAsString(optionTable.RawGetString("policy")),
+				Cookie:         lua.LVAsString(optionTable.RawGetString("cookie")),
+				HealthPath:     lua.LVAsString(optionTable.RawGetString("health")),
+				HealthInterval: seconds("interval"),
+				HealthTimeout:  seconds("timeout"),
+				MaxFails:       int(lua.LVAsNumber(optionTable.RawGetString("max_fails"))),
+				FailTimeout:    seconds("fail_timeout"),
+				Cache:          lua.LVAsBool(optionTable.RawGetString("cache")),
+			}
+			if rp.hooks = newProxyHooks(filename, rp.PathPrefix, optionTable); rp.hooks != nil {
+				ac.addProxyHooks(rp.hooks)
+			}
+		}
+
+		if ac.reverseProxyConfig == nil {
+			ac.reverseProxyConfig = NewReverseProxyConfig()
+			if ac.cacheSize > 0 {
+				// Share the cache size with the file cache
+				ac.reverseProxyConfig.cache = newProxyCache(ac.cacheSize, ac.cacheMaxEntitySize, func() uint64 {
+					if ac.cache == nil {
+						return 0
+					}
+					return ac.cache.BytesUsed()
+				})
+			}
+			AtShutdown(ac.reverseProxyConfig.Close)
+		}
+		if err := ac.reverseProxyConfig.Add(&rp); err != nil {
+			L.RaiseError("AddReverseProxy: %v", err)
+		}
+
+		return 0 // number of results
+	}))
+
+	// Add a FastCGI server given a path prefix, an address like
+	// "unix:/run/php-fpm.sock" or "127.0.0.1:9000", and an optional table
+	// with the root, index and php options
+	L.SetGlobal("AddFastCGI", L.NewFunction(func(L *lua.LState) int {
+		fcgi := FastCGI{
+			PathPrefix: L.ToString(1),
+			ServerName: ac.serverHeaderName,
+		}
+		network, address, err := ParseFastCGIAddress(L.ToString(2))
+		if err != nil {
+			logrus.Errorf("AddFastCGI: could not parse the address: %s: %v", L.ToString(2), err)
+			return 0 // number of results
+		}
+		fcgi.Network, fcgi.Address = network, address
+		if optionTable, ok := L.Get(3).(*lua.LTable); ok {
+			fcgi.Root = lua.LVAsString(optionTable.RawGetString("root"))
+			fcgi.Index = lua.LVAsString(optionTable.RawGetString("index"))
+			fcgi.PHP = lua.LVAsBool(optionTable.RawGetString("php"))
+		}
+		if fcgi.PathPrefix != "" && fcgi.Root == "" {
+			logrus.Error("AddFastCGI: the root option is needed for " + fcgi.PathPrefix)
+			return 0 // number of results
+		}
+		if fcgi.PathPrefix == "" && !fcgi.PHP {
+			logrus.Error("AddFastCGI: no path prefix given, and the php option is not set")
+			return 0 // number of results
+		}
+
+		if ac.fastCGIConfig == nil {
+			ac.fastCGIConfig = NewFastCGIConfig()
+		}
+		ac.fastCGIConfig.Add(&fcgi)
+
+		return 0 // number of results
+	}))
+
+	// Redirect requests that match a regular expression, like "^/old/(.*)",
+	// to a target that may refer to the captures, like "/new/$1".
+	// The status code is optional, and 301 by default.
+	L.SetGlobal("Redirect", L.NewFunction(func(L *lua.LState) int {
+		rule, err := newPatternRule(ruleRedirect, L.CheckString(1), L.CheckString(2), L.OptInt(3, 0))
 		if err != nil {
-			logrus.Errorf("could not parse endpoint URL: %s: %v", endpointURLString, err)
+			logrus.Error("Redirect: ", err)
 			return 0 // number of results
 		}
-		if parsedURL.Scheme == "" || parsedURL.Host == "" {
-			logrus.Errorf("endpoint URL needs a scheme and a host: %s", endpointURLString)
+		ac.routingRules = append(ac.routingRules, rule)
+		return 0 // number of results
+	}))
+
+	// Serve requests that match a regular expression as if they were for
+	// the target path, which may refer to the captures
+	L.SetGlobal("Rewrite", L.NewFunction(func(L *lua.LState) int {
+		rule, err := newPatternRule(ruleRewrite, L.CheckString(1), L.CheckString(2), 0)
+		if err != nil {
+			logrus.Error("Rewrite: ", err)
 			return 0 // number of results
 		}
-		rp.Endpoint = *parsedURL
+		ac.routingRules = append(ac.routingRules, rule)
+		return 0 // number of results
+	}))
 
-		if ac.reverseProxyConfig == nil {
-			ac.reverseProxyConfig = NewReverseProxyConfig()
+	// Redirect to the same URL, but with a host prefix replaced,
+	// like RewritePrefix("www.", "") for removing "www."
+	L.SetGlobal("RewritePrefix", L.NewFunction(func(L *lua.LState) int {
+		rule, err := newPrefixRule(strings.ToLower(L.CheckString(1)), strings.ToLower(L.ToString(2)), L.OptInt(3, 0))
+		if err != nil {
+			logrus.Error("RewritePrefix: ", err)
+			return 0 // number of results
 		}
-		ac.reverseProxyConfig.Add(&rp)
+		ac.routingRules = append(ac.routingRules, rule)
+		return 0 // number of results
+	}))
 
+	// Redirect requests for a host and port to the same URL, but on another
+	// port, like RewritePort("example.com", 80, 443)
+	L.SetGlobal("RewritePort", L.NewFunction(func(L *lua.LState) int {
+		rule, err := newPortRule(L.ToString(1), L.CheckInt(2), L.CheckInt(3), L.OptInt(4, 0))
+		if err != nil {
+			logrus.Error("RewritePort: ", err)
+			return 0 // number of results
+		}
+		ac.routingRules = append(ac.routingRules, rule)
 		return 0 // number of results
 	}))
 
+	// Set the format of the --accesslog file, unless it was already set with
+	// --accesslog-format. Returns true if the format is supported.
+	L.SetGlobal("SetAccessLogFormat", L.NewFunction(func(L *lua.LState) int {
+		format := strings.ToLower(L.ToString(1))
+		if !validAccessLogFormat(format) {
+			logrus.Error("SetAccessLogFormat: unknown access log format: " + format + ", use combined, common or json")
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		if ac.accessLogFormat == "" {
+			ac.accessLogFormat = format
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Set a rate limit for a path prefix, given a table with the rps, burst
+	// and by keys. Returns true if the options are valid.
+	L.SetGlobal("SetRateLimit", L.NewFunction(func(L *lua.LState) int {
+		rl := &RateLimit{Prefix: L.ToString(1)}
+		if optionTable, ok := L.Get(2).(*lua.LTable); ok {
+			rl.RPS = float64(lua.LVAsNumber(optionTable.RawGetString("rps")))
+			rl.Burst = int(lua.LVAsNumber(optionTable.RawGetString("burst")))
+			rl.By = lua.LVAsString(optionTable.RawGetString("by"))
+		}
+		if err := rl.Validate(); err != nil {
+			logrus.Error("SetRateLimit: ", err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		ac.rateLimits = append(ac.rateLimits, rl)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Set the Cache-Control header for successful responses for a file
+	// extension, like ".css", or a path prefix, like "/static/". Returns true
+	// if the extension or prefix is valid.
+	L.SetGlobal("SetCacheControl", L.NewFunction(func(L *lua.LState) int {
+		rule, err := newCacheControlRule(L.ToString(1), L.ToString(2))
+		if err != nil {
+			logrus.Error("SetCacheControl: ", err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		ac.cacheControls = append(ac.cacheControls, rule)
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Select the types of output to minify, with a table like {html=true,
+	// css=true}, or true for all of them, unless --minify was given. Returns
+	// true if all the types are known.
+	L.SetGlobal("SetMinify", L.NewFunction(func(L *lua.LState) int {
+		selected := make(map[string]bool)
+		switch v := L.Get(1).(type) {
+		case *lua.LTable:
+			known := true
+			v.ForEach(func(key, value lua.LValue) {
+				kind := strings.ToLower(key.String())
+				if !slices.Contains(minifyTypes, kind) {
+					logrus.Error("SetMinify: unknown type of output: " + kind + ", use " + strings.Join(minifyTypes, ", "))
+					known = false
+					return
+				}
+				selected[kind] = lua.LVAsBool(value)
+			})
+			if !known {
+				L.Push(lua.LBool(false))
+				return 1 // number of results
+			}
+		default:
+			if lua.LVAsBool(v) {
+				for _, kind := range minifyTypes {
+					selected[kind] = true
+				}
+			}
+		}
+		if !ac.minifyFlag {
+			ac.minifyTypes = selected
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Set which files are cached, and for how long, with a list of rules like
+	// {glob="/static/**", cache=true, ttl="1h"} or {ext=".lua", cache=false}.
+	// The first rule that matches a file is used. Returns true if all the
+	// rules are valid.
+	L.SetGlobal("SetCacheRules", L.NewFunction(func(L *lua.LState) int {
+		table, ok := L.Get(1).(*lua.LTable)
+		if !ok {
+			logrus.Error("SetCacheRules: expected a table of rules")
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		var rules []*cacheRule
+		for i := 1; i <= table.Len(); i++ {
+			rule, err := luaCacheRule(table.RawGetInt(i))
+			if err != nil {
+				logrus.Errorf("SetCacheRules: rule %d: %v", i, err)
+				L.Push(lua.LBool(false))
+				return 1 // number of results
+			}
+			rules = append(rules, rule)
+		}
+		ac.cacheRules = rules
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Set the IP addresses or CIDR ranges of the proxies that are trusted to
+	// give the client IP in the X-Forwarded-For or Forwarded header, unless
+	// they were already given with --trusted-proxy. Returns true if all of
+	// them could be parsed.
+	L.SetGlobal("SetTrustedProxies", L.NewFunction(func(L *lua.LState) int {
+		var proxies []string
+		if table, ok := L.Get(1).(*lua.LTable); ok {
+			for i := 1; i <= table.Len(); i++ {
+				proxies = append(proxies, table.RawGetInt(i).String())
+			}
+		} else {
+			proxies = append(proxies, L.ToString(1))
+		}
+		trustedProxies, err := parseTrustedProxies(proxies)
+		if err != nil {
+			logrus.Error("SetTrustedProxies: ", err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		if ac.trustedProxyFlag == "" {
+			ac.trustedProxies = trustedProxies
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
+	// Set the header that the trusted proxies give the client IP in,
+	// "X-Forwarded-For" or "Forwarded", unless it was already set with
+	// --forwarded-header. Returns true if the header is supported.
+	L.SetGlobal("SetForwardedHeader", L.NewFunction(func(L *lua.LState) int {
+		forwardedHeader, err := parseForwardedHeader(L.ToString(1))
+		if err != nil {
+			logrus.Error("SetForwardedHeader: ", err)
+			L.Push(lua.LBool(false))
+			return 1 // number of results
+		}
+		if ac.forwardedHeader == "" {
+			ac.forwardedHeader = forwardedHeader
+		}
+		L.Push(lua.LBool(true))
+		return 1 // number of results
+	}))
+
 	// Sets a Lua function to be run once the server is done parsing configuration and arguments.
 	L.SetGlobal("OnReady", L.NewFunction(func(L *lua.LState) int {
 		luaReadyFunc := L.ToFunction(1)
@@ -396,6 +719,23 @@ func (ac *Config) loadServerSettingsFunctions(L *lua.LState, filename string) {
 		return 0 // number of results
 	}))
 
+	// Set how many WebSocket connections and event streams can be open at
+	// the same time. Connections that come when all of them are in use get 503.
+	L.SetGlobal("SetStreamLimit", L.NewFunction(func(L *lua.LState) int {
+		ac.maxStreams = max(L.CheckInt(1), 1)
+		return 0 // number of results
+	}))
+
+	// Let pages from other origins, like "https://example.com", open
+	// WebSocket connections. "*" allows all origins.
+	L.SetGlobal("SetWebSocketOrigins", L.NewFunction(func(L *lua.LState) int {
+		ac.websocketOrigins = nil
+		for i := 1; i <= L.GetTop(); i++ {
+			ac.websocketOrigins = append(ac.websocketOrigins, L.CheckString(i))
+		}
+		return 0 // number of results
+	}))
+
 	// Set a access log filename. If blank, the log will go to the console (or browser, if debug mode is set).
 	L.SetGlobal("LogTo", L.NewFunction(func(L *lua.LState) int {
 		filename := L.ToString(1)
@@ -459,6 +799,53 @@ func (ac *Config) loadServerSettingsFunctions(L *lua.LState, filename string) {
 	}))
 }
 
+// luaCacheRule converts a table like {glob="/static/**", cache=true,
+// ttl="1h", maxsize=65536} to a cache rule. The ttl can also be a number of
+// seconds, and cache is true if it is not given.
+func luaCacheRule(value lua.LValue) (*cacheRule, error) {
+	table, ok := value.(*lua.LTable)
+	if !ok {
+		return nil, errors.New("expected a table")
+	}
+	var (
+		glob, ext     string
+		binary        bool
+		cache         = true
+		ttl           time.Duration
+		maxEntitySize uint64
+		err           error
+	)
+	table.ForEach(func(key, value lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch name := key.String(); name {
+		case "glob":
+			glob = value.String()
+		case "ext":
+			ext = value.String()
+		case "binary":
+			binary = lua.LVAsBool(value)
+		case "cache":
+			cache = lua.LVAsBool(value)
+		case "ttl":
+			if seconds, ok := value.(lua.LNumber); ok {
+				ttl = time.Duration(float64(seconds) * float64(time.Second))
+			} else {
+				ttl, err = time.ParseDuration(value.String())
+			}
+		case "maxsize":
+			maxEntitySize = uint64(lua.LVAsNumber(value))
+		default:
+			err = errors.New("unknown field: " + name + ", use glob, ext, binary, cache, ttl or maxsize")
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newCacheRule(glob, ext, binary, cache, ttl, maxEntitySize)
+}
+
 // DatabaseBackend tries to retrieve a database backend, using one of the
 // available permission middleware packages. It assign a name to dbName
 // (used for the status output) and returns a IPermissions struct.
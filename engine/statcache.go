@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pathChecker checks if paths exist and if they are directories. It is
+// implemented by datablock.FileStat and by statCache.
+type pathChecker interface {
+	IsDir(path string) bool
+	Exists(path string) bool
+}
+
+type statCacheEntry struct {
+	exists bool
+	isDir  bool
+}
+
+// statCache caches calls to os.Stat, for --statcache. Unlike
+// datablock.FileStat, paths can be removed from the cache one by one, when
+// they change on disk. All paths are removed every refresh interval, for the
+// paths that are not watched.
+type statCache struct {
+	entries map[string]statCacheEntry
+	refresh time.Duration
+	cleared time.Time
+	mu      sync.RWMutex
+}
+
+// newStatCache creates a stat cache that is cleared every refresh interval,
+// or never if refresh is 0
+func newStatCache(refresh time.Duration) *statCache {
+	return &statCache{
+		entries: make(map[string]statCacheEntry),
+		refresh: refresh,
+		cleared: time.Now(),
+	}
+}
+
+// stat returns the cached information about a path, or stats it
+func (sc *statCache) stat(path string) statCacheEntry {
+	path = filepath.Clean(path)
+	sc.mu.RLock()
+	e, ok := sc.entries[path]
+	expired := sc.refresh > 0 && time.Since(sc.cleared) > sc.refresh
+	sc.mu.RUnlock()
+	if ok && !expired {
+		return e
+	}
+	if info, err := os.Stat(path); err == nil {
+		e = statCacheEntry{exists: true, isDir: info.IsDir()}
+	} else {
+		e = statCacheEntry{}
+	}
+	sc.mu.Lock()
+	if expired {
+		sc.entries = make(map[string]statCacheEntry)
+		sc.cleared = time.Now()
+	}
+	sc.entries[path] = e
+	sc.mu.Unlock()
+	return e
+}
+
+// IsDir checks if a given path is a directory
+func (sc *statCache) IsDir(path string) bool {
+	return sc.stat(path).isDir
+}
+
+// Exists checks if a given path exists
+func (sc *statCache) Exists(path string) bool {
+	return sc.stat(path).exists
+}
+
+// remove removes a path from the cache, and everything below it, if it is a
+// directory
+func (sc *statCache) remove(path string) {
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.entries, path)
+	for p := range sc.entries {
+		if strings.HasPrefix(p, prefix) {
+			delete(sc.entries, p)
+		}
+	}
+}
+
+// Clear removes all paths from the cache
+func (sc *statCache) Clear() {
+	sc.mu.Lock()
+	sc.entries = make(map[string]statCacheEntry)
+	sc.cleared = time.Now()
+	sc.mu.Unlock()
+}
@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"errors"
+	"sync"
+
+	lua "github.com/xyproto/gopher-lua"
+)
+
+// defaultMaxStreams is how many WebSocket connections and event streams can
+// be open at the same time, unless SetStreamLimit is used
+const defaultMaxStreams = 256
+
+// errStreamLimit is returned by streamPool.Get when all states are in use
+var errStreamLimit = errors.New("too many open connections")
+
+// streamPool lends Lua states to WebSocket connections and event streams,
+// which can stay open for a long time. It is kept apart from ac.handlerPool, so that open
+// connections never leave handle() routes without states. States are made
+// when they are first needed, up to the limit, and Get does not wait for a
+// state to be returned if all of them are in use.
+type streamPool struct {
+	newState func() (*lua.LState, error)
+	idle     chan *lua.LState // states that have been returned
+	slots    chan struct{}    // one for each state that is lent out
+	states   []*lua.LState    // kept for Close()
+	mu       sync.Mutex
+}
+
+// newStreamPool creates a pool of up to size states, made by newState
+func newStreamPool(size int, newState func() (*lua.LState, error)) *streamPool {
+	if size < 1 {
+		size = 1
+	}
+	return &streamPool{
+		newState: newState,
+		idle:     make(chan *lua.LState, size),
+		slots:    make(chan struct{}, size),
+	}
+}
+
+// Get borrows a state, or returns errStreamLimit if all states are in use
+func (p *streamPool) Get() (*lua.LState, error) {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return nil, errStreamLimit
+	}
+	select {
+	case L := <-p.idle:
+		return L, nil
+	default:
+	}
+	L, err := p.newState()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	p.mu.Lock()
+	p.states = append(p.states, L)
+	p.mu.Unlock()
+	return L, nil
+}
+
+// Put returns a state to the pool
+func (p *streamPool) Put(L *lua.LState) {
+	p.idle <- L
+	<-p.slots
+}
+
+// Close shuts down all states, like handlerPool.Close
+func (p *streamPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, L := range p.states {
+		L.Close()
+	}
+}
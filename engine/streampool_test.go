@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	lua "github.com/xyproto/gopher-lua"
+)
+
+func TestStreamPool(t *testing.T) {
+	made := 0
+	pool := newStreamPool(2, func() (*lua.LState, error) {
+		made++
+		return lua.NewState(), nil
+	})
+	defer pool.Close()
+
+	a, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Get(); !errors.Is(err, errStreamLimit) {
+		t.Errorf("expected errStreamLimit when all states are in use, got %v", err)
+	}
+	pool.Put(a)
+	if L, err := pool.Get(); err != nil || L != a {
+		t.Errorf("expected the returned state to be lent out again, got %v", err)
+	}
+	pool.Put(b)
+	if made != 2 {
+		t.Errorf("made %d states, want 2", made)
+	}
+
+	// A state that could not be made does not use up the limit
+	failing := newStreamPool(1, func() (*lua.LState, error) {
+		return nil, errors.New("script error")
+	})
+	for range 2 {
+		if _, err := failing.Get(); err == nil || errors.Is(err, errStreamLimit) {
+			t.Errorf("expected the script error, got %v", err)
+		}
+	}
+}
+
+func TestStreamLimit(t *testing.T) {
+	ac := &Config{disableRateLimiting: true}
+	mux := http.NewServeMux()
+	script := `
+sse("/events", function(stream) end)
+websocket("/ws", function(conn) end)
+`
+	L := lua.NewState()
+	defer L.Close()
+	ac.LoadLuaHandlerFunctions(L, "server.lua", mux, false, nil, "", true)
+	if err := L.DoString(script); err != nil {
+		t.Fatal(err)
+	}
+	ac.streamPool = newStreamPool(1, func() (*lua.LState, error) {
+		poolL := lua.NewState()
+		ac.LoadLuaHandlerFunctions(poolL, "server.lua", mux, false, nil, "", false)
+		return poolL, poolL.DoString(script)
+	})
+	defer ac.streamPool.Close()
+
+	// All states are in use, so new connections are turned away before the
+	// WebSocket handshake, and before the event stream is opened
+	busy, err := ac.streamPool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/events", "/ws"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("GET %s: got %d, want 503", path, rec.Code)
+		}
+	}
+	ac.streamPool.Put(busy)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/event-stream") {
+		t.Errorf("GET /events: got %d with %v, want an event stream", rec.Code, rec.Header())
+	}
+}
@@ -54,7 +54,7 @@ const App = () => {
 
 	ac := newTSXTestConfig()
 
-	bundled, err := ac.bundleFile(tsxFile, []byte(tsxContent), false)
+	bundled, _, err := ac.bundleFile(tsxFile, []byte(tsxContent), false)
 	if err != nil {
 		t.Fatalf("Failed to compile/bundle TSX: %v", err)
 	}
@@ -67,7 +67,7 @@ const App = () => {
 
 	// Cache hit: bundling the same file again should hit the in-memory bundle cache.
 	ac.bundleCache.Clear()
-	if _, err := ac.bundleFile(tsxFile, []byte(tsxContent), false); err != nil {
+	if _, _, err := ac.bundleFile(tsxFile, []byte(tsxContent), false); err != nil {
 		t.Fatal(err)
 	}
 
@@ -75,9 +75,14 @@ const App = () => {
 	hitsBefore := ac.bundleCache.hits[tsxFile]
 	ac.bundleCache.mu.RUnlock()
 
-	if _, err := ac.bundleFile(tsxFile, []byte(tsxContent), false); err != nil {
+	cached, sum, err := ac.bundleFile(tsxFile, []byte(tsxContent), false)
+	if err != nil {
 		t.Fatal(err)
 	}
+	// The sum for the ETag is found when the bundle enters the cache
+	if sum == "" || sum != contentSum(cached) {
+		t.Errorf("Expected the content sum of the cached bundle, got %q", sum)
+	}
 
 	ac.bundleCache.mu.RLock()
 	hitsAfter := ac.bundleCache.hits[tsxFile]
@@ -93,7 +98,7 @@ const App = () => {
 		t.Fatal(err)
 	}
 
-	if _, err := ac.bundleFile(tsxFile, []byte(tsxContent), false); err != nil {
+	if _, _, err := ac.bundleFile(tsxFile, []byte(tsxContent), false); err != nil {
 		t.Fatal(err)
 	}
 
@@ -199,7 +204,7 @@ const Comment = ({ author, children }: CommentProps) => {
 
 	ac := newTSXTestConfig()
 
-	bundled, err := ac.bundleFile(tsxFile, []byte(tsxContent), false)
+	bundled, _, err := ac.bundleFile(tsxFile, []byte(tsxContent), false)
 	if err != nil {
 		t.Fatalf("Failed to compile/bundle complex TSX: %v", err)
 	}
@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unixSocketPrefix is the prefix for addresses and endpoints that are Unix
+// domain sockets, as in "unix:/run/app.sock"
+const unixSocketPrefix = "unix:"
+
+// defaultSocketMode is the file mode for the Unix sockets that are listened on
+const defaultSocketMode os.FileMode = 0o660
+
+// unixSocketHosts maps the host names that are made up for Unix socket
+// endpoints to the socket paths, for proxyDialContext
+var unixSocketHosts sync.Map
+
+// unixSocketPath returns the path of the socket if the address is given as
+// "unix:/path/to.sock" or "unix:///path/to.sock"
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return "", false
+	}
+	socketPath := strings.TrimPrefix(addr[len(unixSocketPrefix):], "//")
+	if socketPath == "" {
+		return "", false
+	}
+	return socketPath, true
+}
+
+// parseSocketMode parses a file mode for Unix sockets, given in octal, like "0660"
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid socket file mode: %q, use octal, like 0660", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// unixSocketEndpoint returns an endpoint URL for proxying to the given Unix
+// socket. The host name is made up, and is dialed by proxyDialContext.
+func unixSocketEndpoint(socketPath string) url.URL {
+	h := fnv.New32a()
+	h.Write([]byte(socketPath))
+	host := fmt.Sprintf("unix-%08x.socket", h.Sum32())
+	unixSocketHosts.Store(host, socketPath)
+	return url.URL{Scheme: "http", Host: host}
+}
+
+// parseEndpointURL parses an endpoint URL for a reverse proxy, like
+// "http://localhost:3000" or "unix:/run/app.sock"
+func parseEndpointURL(endpointURLString string) (*url.URL, error) {
+	if socketPath, ok := unixSocketPath(endpointURLString); ok {
+		endpoint := unixSocketEndpoint(socketPath)
+		return &endpoint, nil
+	}
+	parsedURL, err := url.Parse(endpointURLString)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse endpoint URL: %s: %w", endpointURLString, err)
+	}
+	if parsedURL.Scheme == "" || parsedURL.Host == "" {
+		return nil, errors.New("endpoint URL needs a scheme and a host, or unix:/path/to.sock: " + endpointURLString)
+	}
+	return parsedURL, nil
+}
+
+// proxyDialer dials the backends of the reverse proxies
+var proxyDialer = &net.Dialer{
+	Timeout:   10 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// proxyDialContext dials the Unix socket for endpoints that were given as
+// "unix:/path/to.sock", and TCP for all other endpoints
+func proxyDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if socketPath, ok := unixSocketHosts.Load(host); ok {
+		return proxyDialer.DialContext(ctx, "unix", socketPath.(string))
+	}
+	return proxyDialer.DialContext(ctx, network, addr)
+}
+
+// listenUnix listens on a Unix socket and sets the file mode of it. A socket
+// file that is left over from an earlier run is removed first, but only if
+// nothing is listening on it.
+func listenUnix(socketPath string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(socketPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+			conn.Close()
+			return nil, &net.OpError{Op: "listen", Net: "unix", Err: errors.New("the socket is already in use: " + socketPath)}
+		}
+		os.Remove(socketPath)
+	}
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if mode == 0 {
+		mode = defaultSocketMode
+	}
+	if err := os.Chmod(socketPath, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// socketModeFor returns the file mode for the Unix socket at the given
+// address, from SetPorts or from the --socketmode flag
+func (ac *Config) socketModeFor(addr string) os.FileMode {
+	if ps, ok := ac.portSettingFor(addr); ok && ps.Mode != 0 {
+		return ps.Mode
+	}
+	if ac.serve.socketMode != 0 {
+		return ac.serve.socketMode
+	}
+	return defaultSocketMode
+}
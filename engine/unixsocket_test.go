@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// shortTempDir returns a temporary directory with a path that is short
+// enough for Unix sockets
+func shortTempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// unixClient returns a HTTP client that sends all requests to the socket
+func unixClient(socketPath string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+}
+
+func TestParseEndpointURL(t *testing.T) {
+	for _, s := range []string{"unix:/run/app.sock", "unix:///run/app.sock"} {
+		u, err := parseEndpointURL(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		socketPath, ok := unixSocketHosts.Load(u.Host)
+		if !ok || socketPath != "/run/app.sock" || u.Scheme != "http" {
+			t.Errorf("%s: got %s for %v", s, u, socketPath)
+		}
+	}
+	for _, s := range []string{"localhost:3000", "unix:", "/run/app.sock"} {
+		if _, err := parseEndpointURL(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestReverseProxyUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(shortTempDir(t), "app.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &httptest.Server{
+		Listener: l,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			io.WriteString(w, "unix "+req.URL.Path)
+		})},
+	}
+	backend.Start()
+	defer backend.Close()
+
+	endpoint, err := parseEndpointURL("unix:" + socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := NewReverseProxyConfig()
+	rc.Add(&ReverseProxy{PathPrefix: "/app", Endpoint: *endpoint})
+	rp := rc.FindMatchingReverseProxy("/app/hello")
+
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/app/hello", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "unix /hello" {
+		t.Errorf("got %d %q, want 200 \"unix /hello\"", rec.Code, rec.Body.String())
+	}
+}
+
+func TestGracefulServerUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(shortTempDir(t), "algernon.sock")
+	// A socket file that is left over from an earlier run
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	gs := &GracefulServer{
+		Server: &http.Server{
+			Addr: "unix:" + socketPath,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				io.WriteString(w, "hi")
+			}),
+		},
+		SocketMode: 0o600,
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- gs.ListenAndServe() }()
+	defer gs.stop()
+
+	var res *http.Response
+	for range 50 {
+		if res, err = unixClient(socketPath).Get("http://algernon/"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "hi" {
+		t.Errorf("got %q, want \"hi\"", body)
+	}
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("got file mode %o, want 600", fi.Mode().Perm())
+	}
+
+	// The socket is in use, so a second server can not listen on it
+	if _, err := listenUnix(socketPath, 0); !isBindError(err) {
+		t.Errorf("expected a bind error, got %v", err)
+	}
+}
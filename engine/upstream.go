@@ -0,0 +1,259 @@
+package engine
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Load balancing policies for reverse proxies with several upstreams
+const (
+	PolicyRoundRobin = "round_robin" // the default
+	PolicyLeastConn  = "least_conn"  // the upstream with the fewest requests in flight
+	PolicyIPHash     = "ip_hash"     // consistent hashing by client IP
+	PolicyCookieHash = "cookie_hash" // consistent hashing by the value of a cookie
+)
+
+// Default values for ProxyOptions fields that are left at zero
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+	defaultMaxFails       = 3
+	defaultFailTimeout    = 30 * time.Second
+)
+
+// ProxyOptions configures how a reverse proxy with several upstreams picks
+// an upstream, and how failing upstreams are detected
+type ProxyOptions struct {
+	Policy         string        // PolicyRoundRobin, PolicyLeastConn, PolicyIPHash or PolicyCookieHash
+	Cookie         string        // the name of the cookie to hash, for PolicyCookieHash
+	HealthPath     string        // path for active health checks, like "/healthz", or "" for none
+	HealthInterval time.Duration // time between health checks
+	HealthTimeout  time.Duration // timeout for a single health check
+	MaxFails       int           // 502 responses in a row before an upstream is ejected
+	FailTimeout    time.Duration // for how long an upstream is ejected after MaxFails
+	Cache          bool          // cache the responses, according to the Cache-Control headers
+}
+
+// Validate fills in default values and checks the policy
+func (opts *ProxyOptions) Validate() error {
+	if opts.HealthInterval <= 0 {
+		opts.HealthInterval = defaultHealthInterval
+	}
+	if opts.HealthTimeout <= 0 {
+		opts.HealthTimeout = defaultHealthTimeout
+	}
+	if opts.MaxFails <= 0 {
+		opts.MaxFails = defaultMaxFails
+	}
+	if opts.FailTimeout <= 0 {
+		opts.FailTimeout = defaultFailTimeout
+	}
+	switch opts.Policy {
+	case "":
+		opts.Policy = PolicyRoundRobin
+	case PolicyRoundRobin, PolicyLeastConn, PolicyIPHash:
+	case PolicyCookieHash:
+		if opts.Cookie == "" {
+			return errors.New("the cookie_hash policy needs a cookie name")
+		}
+	default:
+		return errors.New("unknown load balancing policy: " + opts.Policy + ", use round_robin, least_conn, ip_hash or cookie_hash")
+	}
+	return nil
+}
+
+// upstream is one of the backends of a load balanced reverse proxy
+type upstream struct {
+	proxy     *httputil.ReverseProxy
+	endpoint  url.URL
+	inFlight  atomic.Int64 // requests that are being proxied right now
+	fails     atomic.Int64 // 502 responses in a row
+	unhealthy atomic.Bool  // set by the active health checks
+	ejectedTo atomic.Int64 // set by the passive failure counting, in Unix nanoseconds
+}
+
+// available checks if the upstream can be given new requests
+func (u *upstream) available(now time.Time) bool {
+	return !u.unhealthy.Load() && now.UnixNano() >= u.ejectedTo.Load()
+}
+
+// balancer picks one of several upstreams for each request
+type balancer struct {
+	opts      ProxyOptions
+	upstreams []*upstream
+	next      atomic.Uint64 // for round robin
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// newBalancer creates a balancer for the given endpoints. The options must
+// have been validated.
+func newBalancer(pathPrefix string, endpoints []url.URL, opts ProxyOptions, hooks *proxyHooks) *balancer {
+	b := &balancer{opts: opts, stop: make(chan struct{})}
+	for _, endpoint := range endpoints {
+		u := &upstream{endpoint: endpoint}
+		u.proxy = newProxyHandler(pathPrefix, endpoint, hooks)
+		// Count 502 responses and proxy errors as failures
+		modifyResponse := u.proxy.ModifyResponse
+		u.proxy.ModifyResponse = func(res *http.Response) error {
+			if err := modifyResponse(res); err != nil {
+				return err // counted by the error handler, unless a hook failed
+			}
+			if res.StatusCode == http.StatusBadGateway {
+				b.fail(u)
+			} else {
+				u.fails.Store(0)
+			}
+			return nil
+		}
+		errorHandler := u.proxy.ErrorHandler
+		u.proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+			if !errors.Is(err, errProxyHook) {
+				b.fail(u)
+			}
+			errorHandler(w, req, err)
+		}
+		b.upstreams = append(b.upstreams, u)
+	}
+	return b
+}
+
+// fail counts a failed request, and ejects the upstream for a while if
+// there have been too many failures in a row
+func (b *balancer) fail(u *upstream) {
+	if u.fails.Add(1) < int64(b.opts.MaxFails) {
+		return
+	}
+	u.fails.Store(0)
+	u.ejectedTo.Store(time.Now().Add(b.opts.FailTimeout).UnixNano())
+	logrus.Warnf("reverse proxy: ejecting %s for %s, after %d failures", u.endpoint.String(), b.opts.FailTimeout, b.opts.MaxFails)
+}
+
+// hashKey returns the string that a request is hashed by, for the
+// consistent hashing policies
+func (b *balancer) hashKey(req *http.Request) string {
+	if b.opts.Policy == PolicyCookieHash {
+		if cookie, err := req.Cookie(b.opts.Cookie); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	// Fall back on the client IP for requests without the cookie
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// pick selects an upstream for the request, or returns nil if none are available
+func (b *balancer) pick(req *http.Request) *upstream {
+	now := time.Now()
+	candidates := make([]*upstream, 0, len(b.upstreams))
+	for _, u := range b.upstreams {
+		if u.available(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	switch b.opts.Policy {
+	case PolicyLeastConn:
+		best := candidates[0]
+		for _, u := range candidates[1:] {
+			if u.inFlight.Load() < best.inFlight.Load() {
+				best = u
+			}
+		}
+		return best
+	case PolicyIPHash, PolicyCookieHash:
+		// Rendezvous hashing, so that only the clients of an upstream that
+		// goes away are moved to other upstreams
+		key := b.hashKey(req)
+		var best *upstream
+		var bestScore uint64
+		for _, u := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			h.Write([]byte(u.endpoint.String()))
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = u, score
+			}
+		}
+		return best
+	}
+	return candidates[(b.next.Add(1)-1)%uint64(len(candidates))]
+}
+
+// ServeHTTP proxies the request to one of the available upstreams
+func (b *balancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	u := b.pick(req)
+	if u == nil {
+		logrus.Error("reverse proxy: no healthy upstreams for " + req.URL.Path)
+		http.Error(w, "no healthy upstreams", http.StatusServiceUnavailable)
+		return
+	}
+	u.inFlight.Add(1)
+	defer u.inFlight.Add(-1)
+	u.proxy.ServeHTTP(w, req)
+}
+
+// checkHealth sends a GET request for the health path to the upstream.
+// Any 2xx or 3xx response counts as healthy.
+func (b *balancer) checkHealth(client *http.Client, u *upstream) bool {
+	healthURL := url.URL{Scheme: u.endpoint.Scheme, Host: u.endpoint.Host, Path: path.Join("/", u.endpoint.Path, b.opts.HealthPath)}
+	res, err := client.Get(healthURL.String())
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode >= 200 && res.StatusCode < 400
+}
+
+// healthChecks checks all upstreams at every health check interval, until
+// the balancer is closed
+func (b *balancer) healthChecks() {
+	client := &http.Client{
+		Transport: proxyTransport,
+		Timeout:   b.opts.HealthTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ticker := time.NewTicker(b.opts.HealthInterval)
+	defer ticker.Stop()
+	for {
+		for _, u := range b.upstreams {
+			healthy := b.checkHealth(client, u)
+			if wasUnhealthy := u.unhealthy.Swap(!healthy); wasUnhealthy == healthy {
+				if healthy {
+					logrus.Infof("reverse proxy: %s is healthy again", u.endpoint.String())
+				} else {
+					logrus.Warnf("reverse proxy: %s failed the health check, ejecting it", u.endpoint.String())
+				}
+			}
+		}
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops the health checks
+func (b *balancer) Close() {
+	b.stopOnce.Do(func() {
+		close(b.stop)
+	})
+}
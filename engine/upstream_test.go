@@ -0,0 +1,176 @@
+package engine
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestBackends starts n backends that reply with their own number
+func newTestBackends(t *testing.T, n int) []url.URL {
+	t.Helper()
+	var endpoints []url.URL
+	for i := range n {
+		name := string(rune('a' + i))
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			io.WriteString(w, name)
+		}))
+		t.Cleanup(backend.Close)
+		u, err := url.Parse(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoints = append(endpoints, *u)
+	}
+	return endpoints
+}
+
+// newTestBalancedProxy load balances /api between the given endpoints
+func newTestBalancedProxy(t *testing.T, endpoints []url.URL, opts ProxyOptions) *ReverseProxy {
+	t.Helper()
+	if err := opts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	rc := NewReverseProxyConfig()
+	t.Cleanup(rc.Close)
+	if err := rc.Add(&ReverseProxy{PathPrefix: "/api", Upstreams: endpoints, Options: opts}); err != nil {
+		t.Fatal(err)
+	}
+	return rc.FindMatchingReverseProxy("/api/x")
+}
+
+// get sends a request through the proxy and returns the status and body
+func get(rp *ReverseProxy, remoteAddr string, cookies ...*http.Cookie) (int, string) {
+	req := httptest.NewRequest(http.MethodGet, "/api/x", nil)
+	req.RemoteAddr = remoteAddr
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	rp.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	rp := newTestBalancedProxy(t, newTestBackends(t, 3), ProxyOptions{})
+	var got string
+	for range 6 {
+		_, body := get(rp, "192.0.2.1:1234")
+		got += body
+	}
+	if got != "abcabc" {
+		t.Errorf("got %q, want %q", got, "abcabc")
+	}
+}
+
+func TestBalancerConsistentHashing(t *testing.T) {
+	endpoints := newTestBackends(t, 4)
+	rp := newTestBalancedProxy(t, endpoints, ProxyOptions{Policy: PolicyIPHash})
+	_, first := get(rp, "192.0.2.1:1234")
+	for range 5 {
+		if _, body := get(rp, "192.0.2.1:5678"); body != first {
+			t.Fatalf("the same client IP was sent to %q and %q", first, body)
+		}
+	}
+
+	rp = newTestBalancedProxy(t, endpoints, ProxyOptions{Policy: PolicyCookieHash, Cookie: "session"})
+	session := &http.Cookie{Name: "session", Value: "abc123"}
+	_, first = get(rp, "192.0.2.1:1234", session)
+	for i := range 5 {
+		// The same cookie from other client IPs
+		if _, body := get(rp, "198.51.100."+strconv.Itoa(i+1)+":1234", session); body != first {
+			t.Fatalf("the same cookie was sent to %q and %q", first, body)
+		}
+	}
+}
+
+func TestBalancerLeastConn(t *testing.T) {
+	rp := newTestBalancedProxy(t, newTestBackends(t, 2), ProxyOptions{Policy: PolicyLeastConn})
+	// Pretend that the first upstream is busy
+	rp.balancer.upstreams[0].inFlight.Add(1)
+	for range 3 {
+		if _, body := get(rp, "192.0.2.1:1234"); body != "b" {
+			t.Errorf("got %q, want the least busy upstream, %q", body, "b")
+		}
+	}
+}
+
+func TestBalancerPassiveFailures(t *testing.T) {
+	endpoints := newTestBackends(t, 1)
+	gone := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	goneURL, _ := url.Parse(gone.URL)
+	gone.Close() // nothing is listening any more
+	endpoints = append(endpoints, *goneURL)
+
+	rp := newTestBalancedProxy(t, endpoints, ProxyOptions{MaxFails: 2, FailTimeout: time.Minute})
+	failures := 0
+	for range 8 {
+		if status, _ := get(rp, "192.0.2.1:1234"); status == http.StatusBadGateway {
+			failures++
+		}
+	}
+	if failures != 2 {
+		t.Errorf("got %d failed requests, want 2 before the upstream is ejected", failures)
+	}
+}
+
+func TestBalancerHealthChecks(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/app/healthz" && !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	// The health path is relative to the path of the endpoint
+	u, _ := url.Parse(backend.URL + "/app")
+
+	rp := newTestBalancedProxy(t, []url.URL{*u}, ProxyOptions{HealthPath: "/healthz", HealthInterval: 10 * time.Millisecond})
+	waitFor := func(wantStatus int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if status, _ := get(rp, "192.0.2.1:1234"); status == wantStatus {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for status %d", wantStatus)
+	}
+	waitFor(http.StatusOK)
+	healthy.Store(false)
+	waitFor(http.StatusServiceUnavailable)
+	healthy.Store(true)
+	waitFor(http.StatusOK)
+}
+
+func TestProxyOptionsValidate(t *testing.T) {
+	if err := (&ProxyOptions{Policy: "random"}).Validate(); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+	if err := (&ProxyOptions{Policy: PolicyCookieHash}).Validate(); err == nil {
+		t.Error("expected an error for cookie_hash without a cookie name")
+	}
+	opts := ProxyOptions{}
+	if err := opts.Validate(); err != nil || opts.Policy != PolicyRoundRobin || opts.MaxFails != defaultMaxFails {
+		t.Errorf("got %+v, %v, want the defaults", opts, err)
+	}
+
+	// Invalid options are not added
+	rc := NewReverseProxyConfig()
+	endpoints := newTestBackends(t, 1)
+	if err := rc.Add(&ReverseProxy{PathPrefix: "/api", Upstreams: endpoints, Options: ProxyOptions{Policy: "random"}}); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+	if rc.FindMatchingReverseProxy("/api/x") != nil {
+		t.Error("expected the invalid reverse proxy to not be added")
+	}
+}
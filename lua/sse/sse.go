@@ -0,0 +1,126 @@
+package sse
+
+import (
+	"time"
+
+	lua "github.com/xyproto/gopher-lua"
+)
+
+// Class is an identifier for the EventStream class in Lua
+const Class = "EventStream"
+
+// Get the first argument, "self", and cast it from userdata to a Stream
+func checkStream(L *lua.LState) *Stream {
+	ud := L.CheckUserData(1)
+	if stream, ok := ud.Value.(*Stream); ok {
+		return stream
+	}
+	L.ArgError(1, "EventStream expected")
+	return nil
+}
+
+// seconds converts a number of seconds from Lua to a time.Duration
+func seconds(n lua.LNumber) time.Duration {
+	return time.Duration(float64(n) * float64(time.Second))
+}
+
+// String representation
+func streamToString(L *lua.LState) int {
+	L.Push(lua.LString("EventStream"))
+	return 1 // number of results
+}
+
+// Send an event. Takes an optional event name, the data and an optional id.
+// With a single argument, only the data is sent. Returns true if the event was sent.
+func streamSend(L *lua.LState) int {
+	stream := checkStream(L) // arg 1
+	var event, data, id string
+	if L.GetTop() == 2 {
+		data = L.ToString(2)
+	} else {
+		event = L.ToString(2)
+		data = L.ToString(3)
+		id = L.OptString(4, "")
+	}
+	L.Push(lua.LBool(stream.Send(event, data, id) == nil))
+	return 1 // number of results
+}
+
+// Send a comment, which is ignored by the client. Returns true if it was sent.
+func streamComment(L *lua.LState) int {
+	stream := checkStream(L) // arg 1
+	L.Push(lua.LBool(stream.Comment(L.OptString(2, "")) == nil))
+	return 1 // number of results
+}
+
+// Tell the client how many milliseconds to wait before reconnecting
+func streamRetry(L *lua.LState) int {
+	stream := checkStream(L) // arg 1
+	ms := L.CheckInt(2)
+	L.Push(lua.LBool(stream.Retry(time.Duration(ms)*time.Millisecond) == nil))
+	return 1 // number of results
+}
+
+// Set the number of seconds between each heartbeat. 0 turns it off.
+func streamHeartbeat(L *lua.LState) int {
+	stream := checkStream(L) // arg 1
+	stream.SetHeartbeat(seconds(L.CheckNumber(2)))
+	return 0 // number of results
+}
+
+// Wait for the given number of seconds.
+// Returns false if the client disconnected while waiting.
+func streamWait(L *lua.LState) int {
+	stream := checkStream(L) // arg 1
+	L.Push(lua.LBool(stream.Wait(seconds(L.CheckNumber(2)))))
+	return 1 // number of results
+}
+
+// Check if the client has disconnected or the stream has been closed
+func streamClosed(L *lua.LState) int {
+	stream := checkStream(L) // arg 1
+	L.Push(lua.LBool(stream.Closed()))
+	return 1 // number of results
+}
+
+// Return the Last-Event-ID header from a reconnecting client, or an empty string
+func streamLastID(L *lua.LState) int {
+	stream := checkStream(L) // arg 1
+	L.Push(lua.LString(stream.LastEventID()))
+	return 1 // number of results
+}
+
+// Close the stream
+func streamClose(L *lua.LState) int {
+	stream := checkStream(L) // arg 1
+	stream.Close()
+	return 0 // number of results
+}
+
+// The hash map methods that are to be registered
+var streamMethods = map[string]lua.LGFunction{
+	"__tostring": streamToString,
+	"send":       streamSend,
+	"comment":    streamComment,
+	"retry":      streamRetry,
+	"heartbeat":  streamHeartbeat,
+	"wait":       streamWait,
+	"closed":     streamClosed,
+	"lastid":     streamLastID,
+	"close":      streamClose,
+}
+
+// Load registers the EventStream class and the methods that belongs with it
+func Load(L *lua.LState) {
+	mt := L.NewTypeMetatable(Class)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, streamMethods)
+}
+
+// New wraps the given stream in a Lua userdata value of the EventStream class
+func New(L *lua.LState, stream *Stream) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = stream
+	L.SetMetatable(ud, L.GetTypeMetatable(Class))
+	return ud
+}
@@ -0,0 +1,99 @@
+package sse
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/xyproto/gopher-lua"
+)
+
+// newLuaServer serves an event stream that is handled by the given Lua script,
+// with the stream available as "stream". The returned channel is closed when
+// the script is done.
+func newLuaServer(t *testing.T, script string) (*httptest.Server, chan struct{}) {
+	t.Helper()
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer close(done)
+		stream, err := Open(w, req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer stream.Close()
+		L := lua.NewState()
+		defer L.Close()
+		Load(L)
+		L.SetGlobal("stream", New(L, stream))
+		if err := L.DoString(script); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, done
+}
+
+func TestLuaSend(t *testing.T) {
+	srv, done := newLuaServer(t, `
+stream:retry(3000)
+stream:send("hello")
+stream:send("tick", "line 1\nline 2", "7")
+stream:send("last-id", stream:lastid())
+`)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Last-Event-ID", "6")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want %q", ct, "text/event-stream")
+	}
+	<-done
+
+	var sb strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		sb.WriteString(scanner.Text() + "\n")
+	}
+	const want = "retry: 3000\n\n" +
+		"data: hello\n\n" +
+		"id: 7\nevent: tick\ndata: line 1\ndata: line 2\n\n" +
+		"event: last-id\ndata: 6\n\n"
+	if got := sb.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLuaDisconnect(t *testing.T) {
+	srv, done := newLuaServer(t, `
+stream:heartbeat(0.01)
+while stream:wait(0.01) do
+  stream:send("ping", "")
+end
+assert(stream:closed())
+assert(not stream:send("too late"))
+`)
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read a little bit, then disconnect
+	bufio.NewReader(resp.Body).ReadString('\n')
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the Lua handler did not notice that the client disconnected")
+	}
+}
@@ -0,0 +1,185 @@
+// Package sse provides Server-Sent Event streams and the Lua functions for using them
+package sse
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeat is how often a comment is sent to keep idle connections open
+const DefaultHeartbeat = 15 * time.Second
+
+// ErrClosed is returned when sending to a stream that has been closed, or
+// when the client has disconnected
+var ErrClosed = errors.New("sse: stream closed")
+
+// Stream is an event stream to a single client
+type Stream struct {
+	w           http.ResponseWriter
+	rc          *http.ResponseController
+	ctx         context.Context
+	lastEventID string
+	heartbeat   *time.Ticker
+	done        chan struct{}
+	closeOnce   sync.Once
+	mut         sync.Mutex
+	closed      bool // guarded by mut
+}
+
+// Open starts an event stream for the given request. The response headers
+// are sent right away, and a heartbeat is sent every DefaultHeartbeat until
+// the stream is closed or the client disconnects.
+func Open(w http.ResponseWriter, req *http.Request) (*Stream, error) {
+	rc := http.NewResponseController(w)
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// Ask reverse proxies like nginx to not buffer the events
+	header.Set("X-Accel-Buffering", "no")
+	if req.ProtoMajor == 1 {
+		header.Set("Connection", "keep-alive")
+	}
+	// The server may have a write timeout for regular requests, which must
+	// not apply to a stream that may be open for hours
+	rc.SetWriteDeadline(time.Time{})
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, errors.New("sse: streaming is not supported: " + err.Error())
+	}
+	s := &Stream{
+		w:           w,
+		rc:          rc,
+		ctx:         req.Context(),
+		lastEventID: req.Header.Get("Last-Event-ID"),
+		heartbeat:   time.NewTicker(DefaultHeartbeat),
+		done:        make(chan struct{}),
+	}
+	go s.keepAlive()
+	return s, nil
+}
+
+// keepAlive sends a comment at every heartbeat, until the stream is closed
+func (s *Stream) keepAlive() {
+	for {
+		select {
+		case <-s.heartbeat.C:
+			s.write(":\n\n")
+		case <-s.ctx.Done():
+			s.Close()
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// write sends the given text to the client, and flushes it
+func (s *Stream) write(text string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.closed || s.ctx.Err() != nil {
+		return ErrClosed
+	}
+	if _, err := io.WriteString(s.w, text); err != nil {
+		s.closed = true
+		return ErrClosed
+	}
+	if err := s.rc.Flush(); err != nil {
+		s.closed = true
+		return ErrClosed
+	}
+	return nil
+}
+
+// oneLine removes line breaks, which are not allowed in the event and id fields
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+// Send sends an event with the given data to the client.
+// The event name and id are optional, and data may contain several lines.
+func (s *Stream) Send(event, data, id string) error {
+	var sb strings.Builder
+	if id != "" {
+		sb.WriteString("id: " + oneLine(id) + "\n")
+	}
+	if event != "" {
+		sb.WriteString("event: " + oneLine(event) + "\n")
+	}
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\r", "\n")
+	for line := range strings.SplitSeq(data, "\n") {
+		sb.WriteString("data: " + line + "\n")
+	}
+	sb.WriteString("\n")
+	return s.write(sb.String())
+}
+
+// Comment sends a comment, which is ignored by the client
+func (s *Stream) Comment(text string) error {
+	var sb strings.Builder
+	for line := range strings.SplitSeq(strings.ReplaceAll(text, "\r", ""), "\n") {
+		sb.WriteString(": " + line + "\n")
+	}
+	sb.WriteString("\n")
+	return s.write(sb.String())
+}
+
+// Retry tells the client how long to wait before reconnecting, if the connection is lost
+func (s *Stream) Retry(d time.Duration) error {
+	return s.write("retry: " + strconv.FormatInt(d.Milliseconds(), 10) + "\n\n")
+}
+
+// SetHeartbeat changes how often a heartbeat is sent. 0 turns it off.
+func (s *Stream) SetHeartbeat(d time.Duration) {
+	if d <= 0 {
+		s.heartbeat.Stop()
+		return
+	}
+	s.heartbeat.Reset(d)
+}
+
+// LastEventID returns the id of the last event the client received before
+// it reconnected, or an empty string
+func (s *Stream) LastEventID() string {
+	return s.lastEventID
+}
+
+// Closed checks if the stream has been closed or the client has disconnected
+func (s *Stream) Closed() bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.closed || s.ctx.Err() != nil
+}
+
+// Wait sleeps for the given duration. Returns false right away if the
+// stream is closed or the client disconnects while waiting.
+func (s *Stream) Wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return !s.Closed()
+	case <-s.ctx.Done():
+		return false
+	case <-s.done:
+		return false
+	}
+}
+
+// Close stops the stream. Nothing more is written to the client after this.
+func (s *Stream) Close() {
+	s.mut.Lock()
+	s.closed = true
+	s.mut.Unlock()
+	s.closeOnce.Do(func() {
+		s.heartbeat.Stop()
+		close(s.done)
+	})
+}
@@ -0,0 +1,358 @@
+// Package websocket provides WebSocket connections (RFC 6455) and the Lua functions for using them
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/xyproto/algernon/utils"
+)
+
+// Frame opcodes, from RFC 6455 section 5.2
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close status codes, from RFC 6455 section 7.4.1
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	CloseMessageTooBig   = 1009
+	CloseInternalFailure = 1011
+)
+
+// acceptGUID is appended to the client key when calculating Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// DefaultMaxMessageSize is the largest message that is accepted from a client
+const DefaultMaxMessageSize = 16 * utils.MiB
+
+var (
+	// ErrClosed is returned when reading from or writing to a closed connection
+	ErrClosed = errors.New("websocket: connection closed")
+
+	// ErrTimeout is returned when no message arrived within the given timeout
+	ErrTimeout = errors.New("websocket: timeout")
+)
+
+// Conn is a WebSocket connection that has been upgraded from a HTTP request
+type Conn struct {
+	conn           net.Conn
+	br             *bufio.Reader
+	MaxMessageSize int64
+	writeMut       sync.Mutex
+	closeOnce      sync.Once
+	closed         bool // guarded by writeMut
+}
+
+// IsUpgrade checks if the given request asks for a WebSocket connection
+func IsUpgrade(req *http.Request) bool {
+	return headerContainsToken(req.Header, "Connection", "upgrade") &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// headerContainsToken checks if a comma separated header contains the given token
+func headerContainsToken(header http.Header, key, token string) bool {
+	for _, value := range header.Values(key) {
+		for field := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptKey calculates the Sec-WebSocket-Accept value for a Sec-WebSocket-Key
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// originAllowed checks if the Origin header of a request is for the host
+// that was asked for, or is one of the allowed origins, where "*" allows all.
+// Browsers always send the header, so that a page on another site can not
+// open a connection with the cookies of the user. Requests without the
+// header are not from browsers, and are allowed.
+func originAllowed(req *http.Request, allowedOrigins []string) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, req.Host)
+}
+
+// Upgrade performs the WebSocket handshake and takes over the connection.
+// Requests from pages on other origins than the allowed ones are rejected.
+// If the request is not a valid WebSocket request, an HTTP error is written
+// to the client and an error is returned.
+func Upgrade(w http.ResponseWriter, req *http.Request, allowedOrigins []string) (*Conn, error) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: the request method must be GET")
+	}
+	if !IsUpgrade(req) {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "426 upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: not a websocket upgrade request")
+	}
+	if !originAllowed(req, allowedOrigins) {
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+		return nil, errors.New("websocket: connection from another origin: " + req.Header.Get("Origin"))
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "400 bad request", http.StatusBadRequest)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := strings.TrimSpace(req.Header.Get("Sec-WebSocket-Key"))
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "400 bad request", http.StatusBadRequest)
+		return nil, errors.New("websocket: invalid Sec-WebSocket-Key")
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return nil, fmt.Errorf("websocket: %w", err)
+	}
+	// The server may have set deadlines for the HTTP request, which must not
+	// apply to a connection that may live for hours
+	conn.SetDeadline(time.Time{})
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := brw.WriteString(response); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, br: brw.Reader, MaxMessageSize: DefaultMaxMessageSize}, nil
+}
+
+// RemoteAddr returns the address of the client
+func (c *Conn) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+// writeFrame writes a single, unmasked and final frame
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	_, err := c.conn.Write(append(header, payload...))
+	return err
+}
+
+// readFrame reads a single frame from the client, and unmasks the payload
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.br, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	if header[0]&0x70 != 0 {
+		// No extensions have been negotiated, so the RSV bits must be zero
+		err = c.fail(CloseProtocolError, "reserved bits are set")
+		return
+	}
+	if header[1]&0x80 == 0 {
+		err = c.fail(CloseProtocolError, "frames from the client must be masked")
+		return
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= opClose && (length > 125 || !fin) {
+		err = c.fail(CloseProtocolError, "invalid control frame")
+		return
+	}
+	if length > uint64(c.MaxMessageSize) {
+		err = c.fail(CloseMessageTooBig, "message too big")
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// fail closes the connection with the given status code and returns an error
+func (c *Conn) fail(code int, reason string) error {
+	c.Close(code, reason)
+	return errors.New("websocket: " + reason)
+}
+
+// ReadMessage waits for the next text or binary message from the client.
+// Ping frames are answered while waiting. A timeout of 0 waits forever.
+// If the timeout is reached before a message has started to arrive,
+// ErrTimeout is returned and the connection can still be used.
+func (c *Conn) ReadMessage(timeout time.Duration) (data []byte, binaryMessage bool, err error) {
+	var (
+		messageOpcode byte
+		message       []byte
+	)
+	for {
+		if messageOpcode == 0 && timeout > 0 {
+			// Only wait with a deadline at the start of a frame, so that
+			// a timeout never leaves half a frame in the buffer
+			c.conn.SetReadDeadline(time.Now().Add(timeout))
+			_, err := c.br.Peek(1)
+			c.conn.SetReadDeadline(time.Time{})
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil, false, ErrTimeout
+			} else if err != nil {
+				c.Close(CloseGoingAway, "")
+				return nil, false, ErrClosed
+			}
+		}
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			c.Close(CloseGoingAway, "")
+			return nil, false, ErrClosed
+		}
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, false, ErrClosed
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			// Echo the status code back, to complete the closing handshake
+			code := CloseNoStatus
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.Close(code, "")
+			return nil, false, ErrClosed
+		case opText, opBinary:
+			if messageOpcode != 0 {
+				return nil, false, c.fail(CloseProtocolError, "expected a continuation frame")
+			}
+			messageOpcode = opcode
+			message = payload
+		case opContinuation:
+			if messageOpcode == 0 {
+				return nil, false, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+			if int64(len(message)+len(payload)) > c.MaxMessageSize {
+				return nil, false, c.fail(CloseMessageTooBig, "message too big")
+			}
+			message = append(message, payload...)
+		default:
+			return nil, false, c.fail(CloseProtocolError, "unknown opcode")
+		}
+		if fin {
+			if messageOpcode == opText && !utf8.Valid(message) {
+				return nil, false, c.fail(CloseInvalidPayload, "invalid UTF-8 in text message")
+			}
+			return message, messageOpcode == opBinary, nil
+		}
+	}
+}
+
+// WriteMessage sends a text or binary message to the client
+func (c *Conn) WriteMessage(data []byte, binaryMessage bool) error {
+	if binaryMessage {
+		return c.writeFrame(opBinary, data)
+	}
+	return c.writeFrame(opText, data)
+}
+
+// Ping sends a ping frame, with optional application data
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > 125 {
+		data = data[:125]
+	}
+	return c.writeFrame(opPing, data)
+}
+
+// Close sends a close frame with the given status code and reason, if it
+// has not already been sent, and then closes the connection
+func (c *Conn) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		var payload []byte
+		if code != CloseNoStatus && code > 0 {
+			payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+			if len(reason) > 123 {
+				reason = reason[:123]
+			}
+			payload = append(payload, reason...)
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(opClose, payload)
+		c.writeMut.Lock()
+		c.closed = true
+		c.writeMut.Unlock()
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,105 @@
+package websocket
+
+import (
+	"time"
+
+	lua "github.com/xyproto/gopher-lua"
+)
+
+// Class is an identifier for the WebSocket class in Lua
+const Class = "WebSocket"
+
+// Get the first argument, "self", and cast it from userdata to a Conn
+func checkConn(L *lua.LState) *Conn {
+	ud := L.CheckUserData(1)
+	if conn, ok := ud.Value.(*Conn); ok {
+		return conn
+	}
+	L.ArgError(1, "WebSocket expected")
+	return nil
+}
+
+// String representation
+func connToString(L *lua.LState) int {
+	conn := checkConn(L) // arg 1
+	L.Push(lua.LString("WebSocket connection from " + conn.RemoteAddr()))
+	return 1 // number of results
+}
+
+// Send a message. Takes a string and an optional bool for sending it as
+// binary data instead of as text. Returns true if the message was sent.
+func connSend(L *lua.LState) int {
+	conn := checkConn(L)  // arg 1
+	data := L.ToString(2) // arg 2
+	binaryMessage := L.GetTop() >= 3 && L.ToBool(3)
+	L.Push(lua.LBool(conn.WriteMessage([]byte(data), binaryMessage) == nil))
+	return 1 // number of results
+}
+
+// Wait for a message. Takes an optional timeout, in seconds.
+// Returns the message, or nil and "timeout" or "closed".
+func connReceive(L *lua.LState) int {
+	conn := checkConn(L) // arg 1
+	var timeout time.Duration
+	if L.GetTop() >= 2 {
+		timeout = time.Duration(float64(L.ToNumber(2)) * float64(time.Second))
+	}
+	data, _, err := conn.ReadMessage(timeout)
+	if err != nil {
+		L.Push(lua.LNil)
+		if err == ErrTimeout {
+			L.Push(lua.LString("timeout"))
+		} else {
+			L.Push(lua.LString("closed"))
+		}
+		return 2 // number of results
+	}
+	L.Push(lua.LString(data))
+	return 1 // number of results
+}
+
+// Send a ping, with optional data. Returns true if the ping was sent.
+func connPing(L *lua.LState) int {
+	conn := checkConn(L) // arg 1
+	var data []byte
+	if L.GetTop() >= 2 {
+		data = []byte(L.ToString(2))
+	}
+	L.Push(lua.LBool(conn.Ping(data) == nil))
+	return 1 // number of results
+}
+
+// Close the connection. Takes an optional status code and reason.
+func connClose(L *lua.LState) int {
+	conn := checkConn(L) // arg 1
+	code := CloseNormal
+	if L.GetTop() >= 2 {
+		code = L.ToInt(2)
+	}
+	conn.Close(code, L.OptString(3, ""))
+	return 0 // number of results
+}
+
+// The hash map methods that are to be registered
+var connMethods = map[string]lua.LGFunction{
+	"__tostring": connToString,
+	"send":       connSend,
+	"receive":    connReceive,
+	"ping":       connPing,
+	"close":      connClose,
+}
+
+// Load registers the WebSocket class and the methods that belongs with it
+func Load(L *lua.LState) {
+	mt := L.NewTypeMetatable(Class)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, connMethods)
+}
+
+// New wraps the given connection in a Lua userdata value of the WebSocket class
+func New(L *lua.LState, conn *Conn) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = conn
+	L.SetMetatable(ud, L.GetTypeMetatable(Class))
+	return ud
+}
@@ -0,0 +1,164 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	lua "github.com/xyproto/gopher-lua"
+)
+
+// writeClientFrame writes a single, final and masked frame, like a browser would
+func writeClientFrame(t *testing.T, conn net.Conn, opcode byte, payload []byte) {
+	t.Helper()
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readServerFrame reads a single, short and unmasked frame from the server
+func readServerFrame(t *testing.T, br *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, header[1]&0x7F)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+func TestLuaEcho(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer close(done)
+		conn, err := Upgrade(w, req, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		L := lua.NewState()
+		defer L.Close()
+		Load(L)
+		L.SetGlobal("conn", New(L, conn))
+		if err := L.DoString(`
+local msg, err = conn:receive(0.05)
+assert(msg == nil and err == "timeout")
+while true do
+  msg = conn:receive()
+  if not msg then break end
+  conn:send("echo: " .. msg)
+end
+`); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	// The example from RFC 6455 section 1.3
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept = %q", accept)
+	}
+
+	// Wait for the timeout in the script to pass before sending anything
+	time.Sleep(100 * time.Millisecond)
+
+	writeClientFrame(t, conn, opPing, []byte("hi"))
+	if opcode, payload := readServerFrame(t, br); opcode != opPong || string(payload) != "hi" {
+		t.Errorf("got opcode %d with %q, want a pong with %q", opcode, payload, "hi")
+	}
+
+	writeClientFrame(t, conn, opText, []byte("hello"))
+	if opcode, payload := readServerFrame(t, br); opcode != opText || string(payload) != "echo: hello" {
+		t.Errorf("got opcode %d with %q, want a text message with %q", opcode, payload, "echo: hello")
+	}
+
+	writeClientFrame(t, conn, opClose, binary.BigEndian.AppendUint16(nil, CloseNormal))
+	opcode, payload := readServerFrame(t, br)
+	if opcode != opClose || len(payload) < 2 || binary.BigEndian.Uint16(payload) != CloseNormal {
+		t.Errorf("got opcode %d with %v, want a close frame with code %d", opcode, payload, CloseNormal)
+	}
+	<-done
+}
+
+func TestUpgradeRequired(t *testing.T) {
+	rec := httptest.NewRecorder()
+	if _, err := Upgrade(rec, httptest.NewRequest(http.MethodGet, "/ws", nil), nil); err == nil {
+		t.Error("expected an error for a request without an Upgrade header")
+	}
+	if rec.Code != http.StatusUpgradeRequired {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUpgradeRequired)
+	}
+	if !strings.EqualFold(rec.Header().Get("Upgrade"), "websocket") {
+		t.Errorf("Upgrade = %q, want %q", rec.Header().Get("Upgrade"), "websocket")
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{"", nil, true},
+		{"http://example.com", nil, true},
+		{"https://EXAMPLE.com", nil, true},
+		{"https://evil.example", nil, false},
+		{"null", nil, false},
+		{"https://app.example", []string{"https://app.example/"}, true},
+		{"https://evil.example", []string{"https://app.example"}, false},
+		{"https://evil.example", []string{"*"}, true},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		if got := originAllowed(req, test.allowed); got != test.want {
+			t.Errorf("Origin %q with %v: got %v, want %v", test.origin, test.allowed, got, test.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Origin", "https://evil.example")
+	if _, err := Upgrade(rec, req, nil); err == nil || rec.Code != http.StatusForbidden {
+		t.Errorf("got %d and %v, want 403 for a connection from another origin", rec.Code, err)
+	}
+}